@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Convert script to text. Instructions are followed by their operand in
+// hex, unknown bytes are shown as UNKNOWN:0xXX.
+// Text can be assembled back into the same script.
+func (script *Script) Disassemble() (string, error) {
+	elem := make([]string, 0)
+
+	for i := 0; i < len(script.data); {
+		op := GetOpcode(Instruction(script.data[i]))
+		if op == nil {
+			elem = append(elem, fmt.Sprintf("UNKNOWN:0x%02x", script.data[i]))
+			i++
+			continue
+		}
+
+		elem = append(elem, op.name)
+
+		if op.parse == nil {
+			i++
+			continue
+		}
+
+		bytes, next, ok := op.parse(script.data, i+1)
+		if !ok {
+			return strings.Join(elem, " "), errors.New(fmt.Sprintf("%s: Truncated data at offset %d", op.name, i))
+		}
+
+		elem = append(elem, fmt.Sprintf("0x%x", bytes))
+		i = next
+	}
+
+	return strings.Join(elem, " "), nil
+}
+
+// Parse script text. Tokens can be:
+// - Instruction names, followed by their operand if any,
+// - Hex data (0xabcd), pushed using OP_PUSH_BYTES,
+// - Decimal numbers, pushed using the smallest push instruction,
+// - UNKNOWN:0xXX, added as is.
+func AssembleScript(text string) (*Script, error) {
+	script := new(Script)
+	tokens := strings.Fields(text)
+
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+
+		switch {
+		case strings.HasPrefix(token, "UNKNOWN:0x"):
+			value, err := strconv.ParseUint(token[len("UNKNOWN:0x"):], 16, 8)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid unknown instruction: %s", token))
+			}
+			script.addByte(byte(value))
+
+		case strings.HasPrefix(token, "OP_"):
+			op := GetOpcodeByName(token)
+			if op == nil {
+				return nil, errors.New(fmt.Sprintf("Unknown instruction: %s", token))
+			}
+
+			if op.encode == nil {
+				script.addInstruction(op.inst)
+				continue
+			}
+
+			if i+1 >= len(tokens) {
+				return nil, errors.New(fmt.Sprintf("%s: Missing data", token))
+			}
+			i++
+
+			data, err := parseScriptData(tokens[i])
+			if err != nil {
+				return nil, err
+			}
+
+			err = op.encode(script, data)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("%s: %s", token, err))
+			}
+
+		case strings.HasPrefix(token, "0x"):
+			data, err := parseScriptData(token)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(data) > 0xffff {
+				return nil, errors.New(fmt.Sprintf("Data too long (%d bytes)", len(data)))
+			}
+			script.addPushBytes(data)
+
+		default:
+			value, err := strconv.ParseUint(token, 10, 32)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid token: %s", token))
+			}
+			script.addPushNumber(uint32(value))
+		}
+	}
+
+	return script, nil
+}
+
+func parseScriptData(token string) ([]byte, error) {
+	if !strings.HasPrefix(token, "0x") {
+		return nil, errors.New(fmt.Sprintf("Invalid data, expecting 0x prefix: %s", token))
+	}
+
+	data, err := hex.DecodeString(token[2:])
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid data %s: %s", token, err))
+	}
+
+	return data, nil
+}
+
+// Parse script given either as hex with 0x prefix, or as text to assemble.
+// A single 0x token is the whole script, not data to push: numbers are
+// always decimal.
+func ParseScriptText(text string) (*Script, error) {
+	text = strings.TrimSpace(text)
+
+	if strings.HasPrefix(text, "0x") && len(strings.Fields(text)) == 1 {
+		data, err := hex.DecodeString(text[2:])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid script %s: %s", text, err))
+		}
+
+		return &Script{data: data}, nil
+	}
+
+	return AssembleScript(text)
+}
@@ -5,7 +5,7 @@ import (
 
 	"bytes"
 	"fmt"
-	"os"
+	"io"
 	"strconv"
 	"time"
 )
@@ -50,88 +50,180 @@ func (b *Block) ComputeHash(update bool) []byte {
 	return hash
 }
 
-// XXX to rewrite using bytes...
-func (b *Block) SaveBlock(fd *os.File) error {
-	WriteUint64ToFd(fd, b.index)
-	WriteBytesToFd(fd, b.last_hash)
-	WriteUint64ToFd(fd, b.timestamp)
-	WriteBytesToFd(fd, b.hash)
+// Hash is not encoded, it is computed again when decoding.
+func (b *Block) Encode(w io.Writer) error {
+	err := WriteVarInt(w, b.index)
+	if err != nil {
+		return err
+	}
+
+	err = WriteVarBytes(w, b.last_hash)
+	if err != nil {
+		return err
+	}
+
+	err = WriteVarInt(w, b.timestamp)
+	if err != nil {
+		return err
+	}
 
-	// Save transactions
-	WriteUint32ToFd(fd, uint32(len(b.txns)))
+	err = WriteVarInt(w, uint64(len(b.txns)))
+	if err != nil {
+		return err
+	}
 
 	for _, txn := range b.txns {
-		txn.SaveTransaction(fd)
+		err = txn.Encode(w)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (b *Block) Dump() string {
-	var dump string
+func (b *Block) Decode(r io.Reader) error {
+	return b.decode(r, CHAIN_FORMAT_VERSION)
+}
 
-	dump = fmt.Sprintf("Hash:\t\t%x\n", b.hash)
-	dump += fmt.Sprintf("LastHash:\t%x\n", b.last_hash)
-	dump += fmt.Sprintf("Txn count:\t%d\n", len(b.txns))
+func (b *Block) decode(r io.Reader, format uint32) error {
+	var err error
 
-	for i := 0; i < len(b.txns); i++ {
-		dump += b.txns[i].String()
+	b.index, err = ReadVarInt(r)
+	if err != nil {
+		return err
 	}
 
-	return dump
-}
+	b.last_hash, err = ReadVarBytes(r, MAX_HASH_SIZE, "Block last hash")
+	if err != nil {
+		return err
+	}
 
-func (b *Block) AddTransaction(txn *Transaction) {
-	b.txns = append(b.txns, txn)
+	b.timestamp, err = ReadVarInt(r)
+	if err != nil {
+		return err
+	}
+
+	txn_cnt, err := ReadBoundedVarInt(r, MAX_BLOCK_TXNS, "Block transactions")
+	if err != nil {
+		return err
+	}
+
+	b.txns = make([]*Transaction, txn_cnt)
+	for i := range b.txns {
+		b.txns[i] = new(Transaction)
+
+		err = b.txns[i].decode(r, format)
+		if err != nil {
+			return err
+		}
+	}
 
-	// Recompute hash
 	b.ComputeHash(true)
+
+	return nil
 }
 
-func CreateBlockFromFd(fd *os.File) (*Block, error) {
-	var err error
-	var i uint32
+func (b *Block) MarshalBinary() ([]byte, error) {
+	return marshalBinary(b)
+}
+
+func (b *Block) UnmarshalBinary(data []byte) error {
+	return unmarshalBinary(b, data)
+}
+
+// Block written with given chain format.
+func unmarshalBlock(data []byte, format uint32) (*Block, error) {
 	b := new(Block)
 
-	b.index, err = ReadUint64FromFd(fd)
+	err := unmarshalBinary(decoderFunc(func(r io.Reader) error {
+		return b.decode(r, format)
+	}), data)
 	if err != nil {
 		return nil, err
 	}
 
-	b.last_hash, err = ReadBytesFromFd(fd)
+	return b, nil
+}
+
+// Block without its transactions, kept once block is pruned.
+func (b *Block) Header() *Block {
+	header := new(Block)
+	header.index = b.index
+	header.last_hash = b.last_hash
+	header.timestamp = b.timestamp
+	header.hash = b.hash
+
+	return header
+}
+
+// Header can't be hashed again without transactions: hash is encoded.
+func (b *Block) EncodeHeader(w io.Writer) error {
+	err := WriteVarInt(w, b.index)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	b.timestamp, err = ReadUint64FromFd(fd)
+	err = WriteVarBytes(w, b.last_hash)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	b.hash, err = ReadBytesFromFd(fd)
+	err = WriteVarInt(w, b.timestamp)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	txn_cnt, err := ReadUint32FromFd(fd)
+	return WriteVarBytes(w, b.hash)
+}
+
+func (b *Block) DecodeHeader(r io.Reader) error {
+	var err error
+
+	b.index, err = ReadVarInt(r)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	for i = 0; i < txn_cnt; i++ {
-		txn, err := CreateTransactionFromFd(fd)
-		if err != nil {
-			return nil, err
-		}
+	b.last_hash, err = ReadVarBytes(r, MAX_HASH_SIZE, "Block last hash")
+	if err != nil {
+		return err
+	}
 
-		b.AddTransaction(txn)
+	b.timestamp, err = ReadVarInt(r)
+	if err != nil {
+		return err
 	}
 
-	return b, nil
+	b.hash, err = ReadVarBytes(r, MAX_HASH_SIZE, "Block hash")
+
+	return err
+}
+
+func (b *Block) Dump() string {
+	var dump string
+
+	dump = fmt.Sprintf("Hash:\t\t%x\n", b.hash)
+	dump += fmt.Sprintf("LastHash:\t%x\n", b.last_hash)
+	dump += fmt.Sprintf("Txn count:\t%d\n", len(b.txns))
+
+	for i := 0; i < len(b.txns); i++ {
+		dump += b.txns[i].String()
+	}
+
+	return dump
+}
+
+func (b *Block) AddTransaction(txn *Transaction) {
+	b.txns = append(b.txns, txn)
+
+	// Recompute hash
+	b.ComputeHash(true)
 }
 
 /* Verifying a block.
  * - Verify that hash is correct
+ * - Verify that transactions are final at block height & time
  * - Verify that inputs are valid
  *   - First transaction can have a null input as this is block generation
  *
@@ -142,6 +234,12 @@ func (b *Block) VerifyBlock() bool {
 		return false
 	}
 
+	for _, txn := range b.txns {
+		if !txn.IsFinal(b.index, b.timestamp) {
+			return false
+		}
+	}
+
 	// XXX to do
 
 	return true
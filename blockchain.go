@@ -3,14 +3,32 @@ package main
 import (
 	"crypto/ecdsa"
 
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
 )
 
+type TxnDestination struct {
+	Addr   string  `json:"addr"`
+	Amount float64 `json:"amount"`
+}
+
+// Payment to one or more destinations, paid by a single transaction. Addr
+// and Amount are the destination when Destinations is empty.
 type TxnOrder struct {
-	Addr   string
-	Amount float64
+	Addr         string           `json:"addr"`
+	Amount       float64          `json:"amount"`
+	Destinations []TxnDestination `json:"destinations"`
+	Fee          float64          `json:"fee"`
+	Strategy     string           `json:"strategy"` // Coin selection, newest first if empty
+
+	selection *CoinSelection // Chosen when transaction is built
+	result    chan error     // Reports queuing, if set
 }
 
 type OutputFund struct {
@@ -21,15 +39,23 @@ type OutputFund struct {
 
 type Blockchain struct {
 	last_index uint64
-	blocks     []*Block
+	blocks     []*Block // Only headers below pruned
+	pruned     uint64
+	params     *NetworkParams
 
 	// Do not store in blockchain
+	store    ChainStore
+	index    *ChainIndex // nil when disabled
 	txnQueue []*Transaction
+
+	// Held by daemon routines while they use chain or queue
+	lock sync.Mutex
 }
 
 func CreateBlockchain() *Blockchain {
 	blockchain := new(Blockchain)
 	blockchain.last_index = 0
+	blockchain.params = &MainNetParams
 
 	return blockchain
 }
@@ -37,55 +63,311 @@ func CreateBlockchain() *Blockchain {
 func LoadBlockchain(config Config) (*Blockchain, error) {
 	blockchain := CreateBlockchain()
 
-	if _, err := os.Stat(config.Blockchain); os.IsNotExist(err) {
-		fmt.Printf("No existing block chain found...\n")
+	params, err := GetNetworkParams(config.Network)
+	if err != nil {
+		return nil, err
+	}
+	blockchain.params = params
 
-		return blockchain, nil
+	info, err := os.Stat(config.Blockchain)
+	if err == nil && info.Mode().IsRegular() {
+		return nil, errors.New(fmt.Sprintf("%s is a single file chain, migrate it with -migrate", config.Blockchain))
+	}
+
+	// Chain of first versions would be ignored, starting a new one
+	if os.IsNotExist(err) && config.Store != STORE_MEMORY {
+		legacy := filepath.Join(filepath.Dir(config.Blockchain), LEGACY_BLOCKCHAIN_FILE)
+
+		info, err = os.Stat(legacy)
+		if err == nil && info.Mode().IsRegular() {
+			return nil, errors.New(fmt.Sprintf("No chain in %s, but single file chain %s found, migrate it with -migrate %s", config.Blockchain, legacy, legacy))
+		}
 	}
 
-	fd, err := os.Open(config.Blockchain)
+	blockchain.store, err = OpenChainStore(config)
 	if err != nil {
 		return nil, err
 	}
 
-	blockchain.last_index, err = ReadUint64FromFd(fd)
+	if store, ok := blockchain.store.(*BlockStore); ok {
+		for _, msg := range store.recovered {
+			fmt.Fprintf(os.Stderr, "Recovered block store, dropped %s\n", msg)
+		}
+	}
+
+	network, err := blockchain.store.GetMeta("network")
 	if err != nil {
 		return nil, err
 	}
 
-	for {
-		// Read blocks
-		block, err := CreateBlockFromFd(fd)
+	if network != nil && string(network) != params.Name {
+		return nil, errors.New(fmt.Sprintf("Stored chain is for %s network, not %s", network, params.Name))
+	}
+
+	count := blockchain.store.BlockCount()
+	if count == 0 {
+		fmt.Fprintf(os.Stderr, "No existing block chain found...\n")
+
+		return blockchain, nil
+	}
+
+	blockchain.pruned = blockchain.store.PrunedHeight()
+
+	for i := uint64(0); i < count; i++ {
+		var block *Block
+		if i < blockchain.pruned {
+			block, err = blockchain.store.GetHeader(i)
+		} else {
+			block, err = blockchain.store.GetBlock(i)
+		}
 		if err != nil {
 			return nil, err
 		}
 
 		blockchain.blocks = append(blockchain.blocks, block)
+	}
+
+	blockchain.last_index = count - 1
 
-		if block.index == blockchain.last_index {
-			break
+	pending, _, err := blockchain.PendingSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	if pending > 0 {
+		fmt.Fprintf(os.Stderr, "Chain starts from a snapshot of %d blocks, not checked yet\n", pending)
+	}
+
+	if config.TxIndex {
+		err = blockchain.loadIndex()
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	return blockchain, nil
 }
 
+// Read index saved with chain, indexing blocks added since.
+func (bc *Blockchain) loadIndex() error {
+	index, err := LoadChainIndex(bc.store, bc.params)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid transaction index (%s), rebuild it with -reindex", err))
+	}
+
+	if index == nil {
+		fmt.Fprintf(os.Stderr, "Building transaction index...\n")
+
+		return bc.Reindex()
+	}
+
+	if index.count < bc.pruned {
+		return errors.New(fmt.Sprintf("Transaction index is behind pruned blocks (%d), they can't be indexed", bc.pruned))
+	}
+
+	if index.count > uint64(len(bc.blocks)) || (index.count > 0 && !bytes.Equal(index.tip, bc.blocks[index.count-1].hash)) {
+		return errors.New("Transaction index does not match chain, rebuild it with -reindex")
+	}
+
+	bc.index = index
+
+	for _, b := range bc.blocks[index.count:] {
+		err = bc.index.ConnectBlock(b, bc.findIndexedTransaction)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Build indexes again from all blocks.
+func (bc *Blockchain) Reindex() error {
+	if bc.pruned > 0 {
+		return errors.New(fmt.Sprintf("Blocks before %d are pruned, they can't be indexed", bc.pruned))
+	}
+
+	bc.index = CreateChainIndex()
+	bc.index.params = bc.params
+
+	for _, b := range bc.blocks {
+		err := bc.index.ConnectBlock(b, bc.findIndexedTransaction)
+		if err != nil {
+			bc.index = nil
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (bc *Blockchain) findIndexedTransaction(hash []byte) (*Transaction, error) {
+	txn, _, err := bc.FindTransaction(hash)
+
+	return txn, err
+}
+
+// Payments to and spends from an address, by block.
+func (bc *Blockchain) GetAddressHistory(address string) ([]*AddressEntry, error) {
+	if bc.index == nil {
+		return nil, errors.New("Address index is disabled, set txindex in configuration")
+	}
+
+	return bc.index.GetAddressHistory(address), nil
+}
+
+// Append blocks not stored yet.
 func (bc *Blockchain) SaveBlockchain(config Config) error {
-	fd, err := os.OpenFile(config.Blockchain, os.O_RDWR|os.O_CREATE, 0644)
+	var err error
+
+	if bc.store == nil {
+		bc.store, err = OpenChainStore(config)
+		if err != nil {
+			return err
+		}
+	}
+
+	count := bc.store.BlockCount()
+	if count > uint64(len(bc.blocks)) {
+		return errors.New(fmt.Sprintf("Stored chain is longer than current one (%d blocks)", count))
+	}
+
+	// Last stored block must be ours
+	if count > 0 {
+		last, err := bc.store.GetHeader(count - 1)
+		if err != nil {
+			return err
+		}
+
+		if bytes.Compare(last.hash, bc.blocks[count-1].hash) != 0 {
+			return errors.New(fmt.Sprintf("Stored block %d does not match chain", count-1))
+		}
+	} else {
+		err = bc.store.PutMeta("network", []byte(bc.params.Name))
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := count; i < uint64(len(bc.blocks)); i++ {
+		err = bc.store.PutBlock(bc.blocks[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	if bc.index != nil {
+		err = bc.index.Save(bc.store)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.Prune > 0 && uint64(len(bc.blocks)) > config.Prune {
+		err = bc.PruneBlocks(uint64(len(bc.blocks)) - config.Prune)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Drop stored blocks below height, keeping their headers. Store may keep
+// some of them.
+func (bc *Blockchain) PruneBlocks(height uint64) error {
+	err := bc.store.PruneBlocks(height)
 	if err != nil {
 		return err
 	}
 
-	WriteUint64ToFd(fd, bc.last_index)
+	for ; bc.pruned < bc.store.PrunedHeight(); bc.pruned++ {
+		bc.blocks[bc.pruned] = bc.blocks[bc.pruned].Header()
+	}
 
-	// Write blocks
-	for i := 0; i < len(bc.blocks); i++ {
-		bc.blocks[i].SaveBlock(fd)
+	return nil
+}
+
+// Block at height, ErrPrunedBlock if only its header is kept.
+func (bc *Blockchain) GetBlock(height uint64) (*Block, error) {
+	if height >= uint64(len(bc.blocks)) {
+		return nil, errors.New(fmt.Sprintf("Block %d not found", height))
 	}
 
-	fd.Close()
+	if height < bc.pruned {
+		return nil, ErrPrunedBlock
+	}
 
-	return nil
+	return bc.blocks[height], nil
+}
+
+// Added to lookup errors, as pruned blocks are not searched.
+func (bc *Blockchain) prunedNote() string {
+	if bc.pruned == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf(" (blocks before %d are pruned)", bc.pruned)
+}
+
+// Transactions of pruned blocks with unspent outputs, rebuilt from unspent
+// set. Spent outputs are nil.
+func (bc *Blockchain) getPrunedTransactions() ([]*Transaction, error) {
+	if bc.pruned == 0 {
+		return nil, nil
+	}
+
+	// Transactions of blocks kept are read from blocks
+	kept := make(map[string]bool)
+	for _, b := range bc.blocks[bc.pruned:] {
+		for _, tx := range b.txns {
+			kept[string(tx.hash)] = true
+		}
+	}
+
+	txns := make(map[string]*Transaction)
+	err := bc.store.ForEachUnspent(func(txhash []byte, output_id uint32, output *TxOutput) error {
+		if kept[string(txhash)] {
+			return nil
+		}
+
+		tx, ok := txns[string(txhash)]
+		if !ok {
+			tx = new(Transaction)
+			tx.hash = txhash
+			txns[string(txhash)] = tx
+		}
+
+		for uint32(len(tx.outputs)) <= output_id {
+			tx.outputs = append(tx.outputs, nil)
+		}
+		tx.outputs[output_id] = output
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Same order on each call
+	list := make([]*Transaction, 0, len(txns))
+	for _, tx := range txns {
+		list = append(list, tx)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return bytes.Compare(list[i].hash, list[j].hash) < 0
+	})
+
+	return list, nil
+}
+
+// Release chain store.
+func (bc *Blockchain) Close() error {
+	if bc.store == nil {
+		return nil
+	}
+
+	return bc.store.Close()
 }
 
 func (bc *Blockchain) MineBlock(key ecdsa.PublicKey) error {
@@ -108,22 +390,85 @@ func (bc *Blockchain) MineBlock(key ecdsa.PublicKey) error {
 
 	b.AddTransaction(txn)
 
-	// Add Txn from queue
+	// Add Txn from queue, keeping locked ones for a later block
+	queue := []*Transaction{}
 	for _, txn = range bc.txnQueue {
+		if bc.CheckTransactionLocks(txn, b.index, b.timestamp) != nil {
+			queue = append(queue, txn)
+			continue
+		}
+
 		b.AddTransaction(txn)
 	}
 
-	bc.txnQueue = []*Transaction{}
+	bc.txnQueue = queue
 
 	bc.blocks = append(bc.blocks, b)
 	bc.last_index = b.index
 
+	if bc.index != nil {
+		return bc.index.ConnectBlock(b, bc.findIndexedTransaction)
+	}
+
+	return nil
+}
+
+// Remove last block, which must not be stored yet, so chain and indexes
+// go back to their stored state. Its transactions are queued again, its
+// coinbase is dropped.
+func (bc *Blockchain) DisconnectBlock() error {
+	if len(bc.blocks) == 0 {
+		return errors.New("No block to disconnect")
+	}
+
+	b := bc.blocks[len(bc.blocks)-1]
+	if bc.store != nil && b.index < bc.store.BlockCount() {
+		return errors.New(fmt.Sprintf("Block %d is stored, it can't be disconnected", b.index))
+	}
+
+	if bc.index != nil {
+		err := bc.index.DisconnectBlock(b, bc.findIndexedTransaction)
+		if err != nil {
+			return err
+		}
+	}
+
+	bc.blocks = bc.blocks[:len(bc.blocks)-1]
+	if b.index > 0 {
+		bc.last_index = b.index - 1
+	}
+
+	// Same hash may be in an earlier block, as for coinbases paying same key
+	if bc.index != nil {
+		missing := make(map[string]bool)
+		for _, txn := range b.txns {
+			if _, ok := bc.index.FindTransaction(txn.hash); !ok {
+				missing[string(txn.hash)] = true
+			}
+		}
+
+		for height := len(bc.blocks) - 1; height >= int(bc.pruned) && len(missing) > 0; height-- {
+			for position, txn := range bc.blocks[height].txns {
+				if missing[string(txn.hash)] {
+					bc.index.relocateTransaction(txn.hash, TxLocation{uint64(height), uint32(position)})
+					delete(missing, string(txn.hash))
+				}
+			}
+		}
+	}
+
+	bc.txnQueue = append(append([]*Transaction{}, b.txns[1:]...), bc.txnQueue...)
+
 	return nil
 }
 
 func (bc *Blockchain) Dump() {
 	for i := 0; i < len(bc.blocks); i++ {
-		fmt.Printf("### Block %d ###\n", i)
+		if uint64(i) < bc.pruned {
+			fmt.Printf("### Block %d (pruned) ###\n", i)
+		} else {
+			fmt.Printf("### Block %d ###\n", i)
+		}
 		fmt.Printf(bc.blocks[i].Dump())
 		fmt.Println()
 	}
@@ -131,127 +476,240 @@ func (bc *Blockchain) Dump() {
 	fmt.Printf("%d block(s).\n", len(bc.blocks))
 }
 
-func (bc *Blockchain) CreateTransfertTransaction(wallet Wallet, txnOrder *TxnOrder) (*Transaction, error) {
-	required_amount := txnOrder.Amount
-	used_funds := make([]*OutputFund, 0)
-	funds := bc.GetFunds(&wallet)
+// Destinations of order, with their total amount. Addresses must belong to
+// network.
+func (txnOrder *TxnOrder) GetDestinations(params *NetworkParams) ([]TxnDestination, float64, error) {
+	destinations := txnOrder.Destinations
+	if len(destinations) == 0 {
+		destinations = []TxnDestination{{txnOrder.Addr, txnOrder.Amount}}
+	} else if txnOrder.Addr != "" || txnOrder.Amount != 0 {
+		return nil, 0, errors.New("Order has both a single destination and a destination list")
+	}
+
+	// Room for change output
+	if len(destinations) >= MAX_TXN_OUTPUTS {
+		return nil, 0, errors.New(fmt.Sprintf("Order has %d destinations, over %d", len(destinations), MAX_TXN_OUTPUTS-1))
+	}
 
-	for _, fund := range funds {
-		required_amount -= fund.txn.outputs[fund.output_id].amount
-		used_funds = append(used_funds, fund)
+	total := 0.0
+	for i, destination := range destinations {
+		if destination.Amount < 0 {
+			return nil, 0, errors.New(fmt.Sprintf("Destination %d: invalid amount %f", i, destination.Amount))
+		}
 
-		if required_amount <= 0 {
-			break
+		_, err := DecodeAddress(destination.Addr, params)
+		if err != nil {
+			return nil, 0, errors.New(fmt.Sprintf("Destination %d: %s", i, err))
 		}
+
+		total += destination.Amount
 	}
 
-	if required_amount > 0 {
-		// could not create transaction.
-		return nil, errors.New("Not enough funds.")
+	return destinations, total, nil
+}
+
+// Create one transaction paying all order destinations, with a single
+// change output.
+func (bc *Blockchain) CreateTransfertTransaction(wallet *Wallet, txnOrder *TxnOrder) (*Transaction, error) {
+	destinations, total, err := txnOrder.GetDestinations(bc.params)
+	if err != nil {
+		return nil, err
 	}
 
-	txn := new(Transaction)
+	selection, err := bc.SelectCoins(wallet, total, txnOrder.Fee, txnOrder.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	txnOrder.selection = selection
+
+	outputs := make([]*TxOutput, len(destinations))
+	for i, destination := range destinations {
+		outputs[i] = CreateTxOutput(BuildP2PKHScript([]byte(destination.Addr)), destination.Amount)
+	}
 
-	for _, used_fund := range used_funds {
-		input := new(TxInput)
-		input.script = used_fund.script
-		input.txhash = used_fund.txn.hash
+	return selection.BuildTransaction(wallet, outputs)
+}
 
-		txn.AddInput(input)
+// Create a transaction paying amount to given output script from wallet funds.
+func (bc *Blockchain) CreateScriptTransaction(wallet *Wallet, script *Script, amount float64) (*Transaction, error) {
+	selection, err := bc.SelectCoins(wallet, amount, 0, SELECT_NEWEST_FIRST)
+	if err != nil {
+		return nil, err
 	}
 
-	output := new(TxOutput)
-	output.amount = txnOrder.Amount
-	output.script = BuildP2PKHScript([]byte(txnOrder.Addr))
-	txn.AddOutput(output)
+	return selection.BuildTransaction(wallet, []*TxOutput{CreateTxOutput(script, amount)})
+}
 
-	// Add remaining funds into a new output
-	if required_amount < 0 {
-		output = new(TxOutput)
-		output.amount = 0 - required_amount
-		output.script = BuildP2PKHScript([]byte(GetPublicKeyHash(wallet.PrivateKeys[0].PublicKey)))
-		txn.AddOutput(output)
+// Verify transaction is standard and can be mined in next block, then queue
+// it. Only queued transactions are mined.
+func (bc *Blockchain) QueueTransaction(txn *Transaction) error {
+	err := CheckStandardTransaction(txn)
+	if err != nil {
+		return err
 	}
 
-	for _, used_fund := range used_funds {
-		// Copy other outputs
-		for i, output := range used_fund.txn.outputs {
-			if used_fund.output_id != i {
-				txn.AddOutput(output)
-			}
-		}
+	err = bc.VerifyTransaction(txn, uint64(len(bc.blocks)), uint64(time.Now().Unix()))
+	if err != nil {
+		return err
 	}
 
-	txn.ComputeHash(true)
+	bc.txnQueue = append(bc.txnQueue, txn)
 
-	return txn, nil
+	return nil
 }
 
-func (bc *Blockchain) QueueTransaction(txn *Transaction) {
-	bc.txnQueue = append(bc.txnQueue, txn)
-}
+// Look for a mined transaction. Returns it with the block containing it.
+func (bc *Blockchain) FindTransaction(hash []byte) (*Transaction, *Block, error) {
+	if bc.index != nil {
+		location, ok := bc.index.FindTransaction(hash)
+		if !ok || location.height >= uint64(len(bc.blocks)) {
+			return nil, nil, errors.New(fmt.Sprintf("Unknown transaction %x", hash))
+		}
 
-func TryOutput(wallet *Wallet, outputScript *Script) (*Script, bool) {
-	// Prepare a VM to execute output scripts.
-	vm := new(VM)
+		b := bc.blocks[location.height]
+		if location.height < bc.pruned {
+			return nil, nil, errors.New(fmt.Sprintf("Transaction %x is in pruned block %d", hash, location.height))
+		}
 
-	for _, pk := range wallet.PrivateKeys {
-		input_scr := new(Script)
+		return b.txns[location.position], b, nil
+	}
 
-		sign, _ := SignMessage(pk, outputScript.data)
+	for j := len(bc.blocks) - 1; j >= 0; j-- {
+		for _, tx := range bc.blocks[j].txns {
+			if bytes.Equal(tx.hash, hash) {
+				return tx, bc.blocks[j], nil
+			}
+		}
+	}
 
-		input_scr.addPushBytes(sign)
+	return nil, nil, errors.New(fmt.Sprintf("Unknown transaction %x%s", hash, bc.prunedNote()))
+}
 
-		res, _ := vm.runInputOutput(*input_scr, *outputScript)
+// Look for an output to spend. Outputs of pruned blocks are read from
+// unspent set.
+func (bc *Blockchain) findOutput(txhash []byte, output_id uint32) (*TxOutput, error) {
+	prev, _, err := bc.FindTransaction(txhash)
+	if err != nil && bc.pruned > 0 {
+		output, unspent_err := bc.store.GetUnspent(txhash, output_id)
+		if unspent_err == nil {
+			return output, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if int(output_id) >= len(prev.outputs) {
+		return nil, errors.New(fmt.Sprintf("Invalid output %d for transaction %x", output_id, txhash))
+	}
+
+	return prev.outputs[output_id], nil
+}
+
+// Check transaction lock time and inputs relative locks against a block at
+// given height and time.
+func (bc *Blockchain) CheckTransactionLocks(txn *Transaction, height uint64, timestamp uint64) error {
+	if !txn.IsFinal(height, timestamp) {
+		return errors.New(fmt.Sprintf("Transaction is locked until %d", txn.locktime))
+	}
 
-		if res {
-			return input_scr, true
+	for _, input := range txn.inputs {
+		if input.sequence&SEQUENCE_DISABLE_FLAG != 0 {
+			continue
 		}
 
-		// Try P2PKH
-		input_scr.addPushBytes(PublicKeyToBytes(pk.PublicKey))
+		value := uint64(input.sequence & SEQUENCE_MASK)
 
-		res, _ = vm.runInputOutput(*input_scr, *outputScript)
+		_, block, err := bc.FindTransaction(input.txhash)
+		if err != nil && bc.pruned > 0 {
+			if _, unspent_err := bc.store.GetUnspent(input.txhash, input.output_id); unspent_err == nil {
+				// Spent block is pruned, it is at most the last pruned one
+				block, err = bc.blocks[bc.pruned-1], nil
+			}
+		}
+		if err != nil {
+			return err
+		}
 
-		if res {
-			return input_scr, true
+		pruned := block.index < bc.pruned
+
+		if input.sequence&SEQUENCE_TYPE_FLAG != 0 {
+			if block.timestamp+(value<<SEQUENCE_GRANULARITY) > timestamp {
+				if pruned {
+					return errors.New(fmt.Sprintf("Input %x: relative lock can't be checked, its block is pruned", input.txhash))
+				}
+				return errors.New(fmt.Sprintf("Input %x is locked for %d seconds", input.txhash, value<<SEQUENCE_GRANULARITY))
+			}
+		} else {
+			if block.index+value > height {
+				if pruned {
+					return errors.New(fmt.Sprintf("Input %x: relative lock can't be checked, its block is pruned", input.txhash))
+				}
+				return errors.New(fmt.Sprintf("Input %x is locked for %d blocks", input.txhash, value))
+			}
 		}
 	}
 
-	return nil, false
+	return nil
 }
 
-// Scan blockchain for unspent output transactions matching out wallet private keys
-func (bc *Blockchain) GetFunds(wallet *Wallet) []*OutputFund {
-	used_inputs := make(map[string]bool)
-	funds := make([]*OutputFund, 0)
+// Verify a transaction can be included in a block at given height and time:
+// locks must be released, and each input must unlock the output it spends.
+func (bc *Blockchain) VerifyTransaction(txn *Transaction, height uint64, timestamp uint64) error {
+	err := bc.CheckTransactionLocks(txn, height, timestamp)
+	if err != nil {
+		return err
+	}
 
-	// Scan all blocks for unspent outputs matching our private keys.
-	for j := len(bc.blocks) - 1; j >= 0; j-- {
-		for _, tx := range bc.blocks[j].txns {
-			for _, input := range tx.inputs {
-				used_inputs[string(input.txhash)] = true
+	for i, input := range txn.inputs {
+		// First chains did not check inputs against outputs they spend
+		if input.output_id == OUTPUT_ID_ALL {
+			if txn.version != TXN_VERSION_LEGACY {
+				return errors.New(fmt.Sprintf("Input %d: only version 0 transactions spend all outputs", i))
 			}
-			if _, ok := used_inputs[string(tx.hash)]; ok {
-				// This transaction was already used. Skipping.
-				continue
-			}
-			for k, output := range tx.outputs {
-				// Try output.
-				script, res := TryOutput(wallet, output.script)
-				if res {
-					// Adding this transaction in list
-					of := new(OutputFund)
-					of.output_id = k
-					of.txn = tx
-					of.script = script
-
-					funds = append(funds, of)
 
-				}
+			_, _, err = bc.FindTransaction(input.txhash)
+			if err != nil {
+				return err
 			}
+
+			continue
+		}
+
+		output, err := bc.findOutput(input.txhash, input.output_id)
+		if err != nil {
+			return err
+		}
+
+		if output.script.IsUnspendable() {
+			return errors.New(fmt.Sprintf("Output %d of transaction %x is unspendable", input.output_id, input.txhash))
+		}
+
+		vm := NewVM(txn, i)
+		vm.params = bc.params
+		_, err = vm.runInputOutput(*input.script, *output.script)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Input %d: %s", i, err))
 		}
 	}
 
-	return funds
+	return nil
 }
+
+// Verify block hash and all its transactions against current chain.
+// The first transaction, money creation, has no input.
+func (bc *Blockchain) VerifyBlock(b *Block) error {
+	if !b.VerifyBlock() {
+		return errors.New(fmt.Sprintf("Invalid block %x", b.hash))
+	}
+
+	for _, txn := range b.txns {
+		err := bc.VerifyTransaction(txn, b.index, b.timestamp)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
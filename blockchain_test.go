@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"math"
+	"path/filepath"
 	"testing"
 )
 
@@ -61,7 +62,10 @@ func TestMining(t *testing.T) {
 	}
 
 	// Scan chain
-	funds := bc.GetFunds(wallet)
+	funds, err := bc.GetFunds(wallet)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if len(funds) != 2 {
 		t.Error("Invalid available funds number")
@@ -77,8 +81,12 @@ func TestMining(t *testing.T) {
 	}
 }
 
+// Wallet funds, -1 if they can't be scanned.
 func CheckFunds(bc *Blockchain, wallet *Wallet) float64 {
-	funds := bc.GetFunds(wallet)
+	funds, err := bc.GetFunds(wallet)
+	if err != nil {
+		return -1
+	}
 
 	amount := float64(0)
 	for _, fund := range funds {
@@ -122,7 +130,7 @@ func TestTransaction(t *testing.T) {
 	txnOrder.Amount = 150.55
 	txnOrder.Addr = GetPublicKeyHash(wallet2.PrivateKeys[0].PublicKey)
 
-	txn, err := bc.CreateTransfertTransaction(*wallet1, txnOrder)
+	txn, err := bc.CreateTransfertTransaction(wallet1, txnOrder)
 	if err != nil {
 		t.Error(err)
 	}
@@ -145,7 +153,7 @@ func TestTransaction(t *testing.T) {
 	txnOrder.Amount = 130
 	txnOrder.Addr = GetPublicKeyHash(wallet1.PrivateKeys[0].PublicKey)
 
-	txn, err = bc.CreateTransfertTransaction(*wallet2, txnOrder)
+	txn, err = bc.CreateTransfertTransaction(wallet2, txnOrder)
 	if err != nil {
 		t.Error(err)
 	}
@@ -161,7 +169,7 @@ func TestTransaction(t *testing.T) {
 	txnOrder.Amount = 20.55
 	txnOrder.Addr = GetPublicKeyHash(wallet1.PrivateKeys[0].PublicKey)
 
-	txn, err = bc.CreateTransfertTransaction(*wallet2, txnOrder)
+	txn, err = bc.CreateTransfertTransaction(wallet2, txnOrder)
 	if err != nil {
 		t.Error(err)
 	}
@@ -180,13 +188,67 @@ func TransferFund(bc *Blockchain, w1 *Wallet, w2 *Wallet, amount float64) {
 	txnOrder.Amount = amount
 	txnOrder.Addr = GetPublicKeyHash(w2.PrivateKeys[0].PublicKey)
 
-	txn, err := bc.CreateTransfertTransaction(*w1, txnOrder)
+	txn, err := bc.CreateTransfertTransaction(w1, txnOrder)
 	if err != nil {
 		panic(err)
 	}
 	bc.QueueTransaction(txn)
 }
 
+func TestMultipleDestinations(t *testing.T) {
+	bc := CreateBlockchain()
+	w1 := CreateTestingWallet()
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	txnOrder := new(TxnOrder)
+	recipients := []*Wallet{}
+	for i := 0; i < 5; i++ {
+		w := CreateTestingWallet()
+		recipients = append(recipients, w)
+		txnOrder.Destinations = append(txnOrder.Destinations, TxnDestination{GetPublicKeyHash(w.PrivateKeys[0].PublicKey), float64(5 * (i + 1))})
+	}
+
+	txn, err := bc.CreateTransfertTransaction(w1, txnOrder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One output per destination, then change
+	if len(txn.inputs) != 1 || len(txn.outputs) != 6 || txn.outputs[5].amount != 25 {
+		t.Fatalf("Invalid transaction:\n%s", txn)
+	}
+
+	err = bc.QueueTransaction(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc.MineBlock(recipients[0].PrivateKeys[0].PublicKey)
+
+	for i, w := range recipients {
+		amount := float64(5 * (i + 1))
+		if i == 0 {
+			amount += 100
+		}
+
+		ControlFunds(t, w, bc, amount)
+	}
+	ControlFunds(t, w1, bc, 25)
+
+	// Single destination and list are exclusive
+	txnOrder.Addr = GetPublicKeyHash(w1.PrivateKeys[0].PublicKey)
+	_, err = bc.CreateTransfertTransaction(w1, txnOrder)
+	if err == nil {
+		t.Error("Order with both destination kinds accepted.")
+	}
+
+	txnOrder = &TxnOrder{Destinations: []TxnDestination{{txnOrder.Addr, 10}, {txnOrder.Addr, -5}}}
+	_, err = bc.CreateTransfertTransaction(w1, txnOrder)
+	if err == nil {
+		t.Error("Negative destination amount accepted.")
+	}
+}
+
 func TestSaveLoadChain(t *testing.T) {
 	bc := CreateBlockchain()
 	w1 := CreateTestingWallet()
@@ -208,7 +270,8 @@ func TestSaveLoadChain(t *testing.T) {
 		t.Errorf("Invalid sum")
 	}
 
-	c := Config{Blockchain: "chain.dat"}
+	c := Config{Blockchain: t.Name(), Store: STORE_MEMORY}
+
 	// Save blockchain.
 
 	err := bc.SaveBlockchain(c)
@@ -287,3 +350,126 @@ func TestVerifyblock(t *testing.T) {
 		}
 	}
 }
+
+func TestTransactionLockTime(t *testing.T) {
+	bc := CreateBlockchain()
+	w1 := CreateTestingWallet()
+	w2 := CreateTestingWallet()
+
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	txnOrder := new(TxnOrder)
+	txnOrder.Amount = 50
+	txnOrder.Addr = GetPublicKeyHash(w2.PrivateKeys[0].PublicKey)
+
+	txn, err := bc.CreateTransfertTransaction(w1, txnOrder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lock transaction until block 3
+	txn.locktime = 3
+	txn.inputs[0].sequence = 0
+	txn.ComputeHash(true)
+
+	err = bc.QueueTransaction(txn)
+	if err == nil {
+		t.Error("Locked transaction should not be queued")
+	}
+
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	err = bc.QueueTransaction(txn)
+	if err != nil {
+		t.Error(err)
+	}
+
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	ControlFunds(t, w2, bc, 50)
+
+	for _, b := range bc.blocks {
+		err = bc.VerifyBlock(b)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestTransactionSequenceLock(t *testing.T) {
+	bc := CreateBlockchain()
+	w1 := CreateTestingWallet()
+	w2 := CreateTestingWallet()
+
+	// Coinbase transactions can share their hash: use a transfer as funding.
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	TransferFund(bc, w1, w2, 50)
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	txnOrder := new(TxnOrder)
+	txnOrder.Amount = 50
+	txnOrder.Addr = GetPublicKeyHash(w1.PrivateKeys[0].PublicKey)
+
+	txn, err := bc.CreateTransfertTransaction(w2, txnOrder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Input can only be spent 2 blocks after its funding one
+	txn.inputs[0].sequence = 2
+	txn.ComputeHash(true)
+
+	err = bc.QueueTransaction(txn)
+	if err == nil {
+		t.Error("Locked input should not be queued")
+	}
+
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	err = bc.QueueTransaction(txn)
+	if err != nil {
+		t.Error(err)
+	}
+
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	ControlFunds(t, w2, bc, 0)
+}
+
+func TestNetworkAddresses(t *testing.T) {
+	dir := t.TempDir()
+
+	w1, _ := LoadWallet(Config{Wallet: filepath.Join(dir, "w1.key"), Network: RegTestParams.Name})
+	w2, _ := LoadWallet(Config{Wallet: filepath.Join(dir, "w2.key"), Network: RegTestParams.Name})
+	for _, w := range []*Wallet{w1, w2} {
+		key, _ := CreateKeyPair()
+		w.AddPrivateKey(*key)
+	}
+
+	bc := CreateBlockchain()
+	bc.params = &RegTestParams
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	// Main network address is refused
+	_, err := bc.CreateTransfertTransaction(w1, &TxnOrder{Addr: GetPublicKeyHash(w2.PrivateKeys[0].PublicKey), Amount: 10})
+	if err == nil {
+		t.Error("Transfer to another network address created.")
+	}
+
+	// Second transfer spends change of first one
+	for i := 0; i < 2; i++ {
+		txn, err := bc.CreateTransfertTransaction(w1, &TxnOrder{Addr: w2.Address(w2.PrivateKeys[0].PublicKey), Amount: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = bc.QueueTransaction(txn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bc.MineBlock(w2.PrivateKeys[0].PublicKey)
+	}
+
+	ControlFunds(t, w1, bc, 80)
+	ControlFunds(t, w2, bc, 220)
+}
@@ -0,0 +1,923 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// A new block file is started once current one reaches this size.
+const MAX_BLOCK_FILE_SIZE = 128 * 1024 * 1024
+
+// Where a block is stored.
+type BlockLocation struct {
+	file   uint32
+	offset uint64
+}
+
+// Blocks are appended to numbered block files (blk00000.dat, ...). An
+// index file maps block height and hash to their location and header, one
+// record appended per block. Each block and index entry is a checksummed
+// record, synced before the next one is written. Metadata is rewritten as
+// a whole in meta.dat. Chain index records are appended to txindex.dat,
+// the last one of each key is kept. Files start with a header giving their
+// format version.
+//
+// Pruning deletes whole block files. Unspent outputs are then saved in
+// utxo.dat first, as they can't be rebuilt from blocks anymore.
+type BlockStore struct {
+	dir           string
+	max_file_size int64
+
+	// By height
+	locations []BlockLocation
+	headers   []*Block
+	hashes    map[string]uint64
+
+	// End of each index record
+	index_ends    []int64
+	index_version uint32
+
+	// What was dropped when opening store
+	recovered []string
+
+	// First block whose file is kept
+	pruned uint64
+
+	// Blocks read when opening store, shared with chain, by height. Later
+	// ones are read from their file.
+	blocks []*Block
+
+	// Rebuilt from blocks and utxo.dat when opening store
+	utxos *unspentSet
+	meta  map[string][]byte
+
+	// Chain index records, and bytes of txindex.dat holding them, so
+	// stale ones are dropped once they take most of the file
+	txindex      map[string][]byte
+	txindex_size int64
+	txindex_live int64
+}
+
+func OpenBlockStore(dir string) (*BlockStore, error) {
+	store := new(BlockStore)
+	store.dir = dir
+	store.max_file_size = MAX_BLOCK_FILE_SIZE
+	store.hashes = make(map[string]uint64)
+	store.utxos = createUnspentSet(nil)
+	store.meta = make(map[string][]byte)
+	store.txindex = make(map[string][]byte)
+	store.index_version = CHAIN_FORMAT_VERSION
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.readIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.recoverBlocks()
+	if err != nil {
+		return nil, err
+	}
+
+	// Files of pruned blocks are gone
+	for store.pruned < store.BlockCount() {
+		_, err := os.Stat(store.blockFilePath(store.locations[store.pruned].file))
+		if err == nil {
+			break
+		}
+
+		store.pruned++
+	}
+
+	start := uint64(0)
+	if store.pruned > 0 {
+		start, err = store.readUnspent()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Each block is read once, kept for chain
+	store.blocks = make([]*Block, store.BlockCount())
+	for i := start; i < store.BlockCount(); i++ {
+		b, err := store.GetBlock(i)
+		if err != nil {
+			return nil, err
+		}
+		store.blocks[i] = b
+
+		// Headers were not indexed before
+		if store.headers[i] == nil {
+			store.headers[i] = b.Header()
+		}
+
+		err = store.utxos.applyBlock(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if store.index_version < CHAIN_FORMAT_HEADERS {
+		err = store.rewriteIndex()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = store.readMeta()
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.readTxIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *BlockStore) blockFilePath(file uint32) string {
+	return filepath.Join(store.dir, fmt.Sprintf("blk%05d.dat", file))
+}
+
+func (store *BlockStore) indexPath() string {
+	return filepath.Join(store.dir, "index.dat")
+}
+
+func (store *BlockStore) metaPath() string {
+	return filepath.Join(store.dir, "meta.dat")
+}
+
+func (store *BlockStore) txIndexPath() string {
+	return filepath.Join(store.dir, "txindex.dat")
+}
+
+func (store *BlockStore) unspentPath() string {
+	return filepath.Join(store.dir, "utxo.dat")
+}
+
+// Index record: height, hash, file, offset, then header fields (last hash,
+// timestamp) since CHAIN_FORMAT_HEADERS.
+func encodeIndexEntry(loc BlockLocation, header *Block) []byte {
+	entry := new(bytes.Buffer)
+	WriteVarInt(entry, header.index)
+	WriteVarBytes(entry, header.hash)
+	WriteVarInt(entry, uint64(loc.file))
+	WriteVarInt(entry, loc.offset)
+	WriteVarBytes(entry, header.last_hash)
+	WriteVarInt(entry, header.timestamp)
+
+	return entry.Bytes()
+}
+
+// Reading stops at the first truncated or invalid record, which is dropped
+// with all following ones.
+func (store *BlockStore) readIndex() error {
+	fd, err := os.Open(store.indexPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	store.index_version, err = ReadFileHeader(fd, INDEX_FILE_MAGIC)
+	if err == io.EOF {
+		store.index_version = CHAIN_FORMAT_VERSION
+		return nil
+	}
+	if err == io.ErrUnexpectedEOF {
+		store.recovered = append(store.recovered, "index: truncated header")
+		return store.truncateIndex()
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s: %s", store.indexPath(), err))
+	}
+
+	var end int64 = FILE_HEADER_SIZE
+	for {
+		payload, err := ReadRecord(fd)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			store.recovered = append(store.recovered, fmt.Sprintf("index: %s after entry %d", err, len(store.locations)))
+			break
+		}
+
+		reader := bytes.NewReader(payload)
+
+		height, err := ReadVarInt(reader)
+		if err != nil {
+			return err
+		}
+
+		hash, err := ReadVarBytes(reader, MAX_HASH_SIZE, "Index hash")
+		if err != nil {
+			return err
+		}
+
+		var loc BlockLocation
+		file, err := ReadBoundedVarInt(reader, math.MaxUint32, "Index file")
+		if err != nil {
+			return err
+		}
+		loc.file = uint32(file)
+
+		loc.offset, err = ReadVarInt(reader)
+		if err != nil {
+			return err
+		}
+
+		if height != uint64(len(store.locations)) {
+			return errors.New(fmt.Sprintf("Invalid index: block %d found at position %d", height, len(store.locations)))
+		}
+
+		// Read from block otherwise
+		var header *Block
+		if store.index_version >= CHAIN_FORMAT_HEADERS {
+			header = new(Block)
+			header.index = height
+			header.hash = hash
+
+			header.last_hash, err = ReadVarBytes(reader, MAX_HASH_SIZE, "Index last hash")
+			if err != nil {
+				return err
+			}
+
+			header.timestamp, err = ReadVarInt(reader)
+			if err != nil {
+				return err
+			}
+		}
+
+		end += int64(RECORD_HEADER_SIZE + len(payload))
+
+		store.locations = append(store.locations, loc)
+		store.headers = append(store.headers, header)
+		store.hashes[string(hash)] = height
+		store.index_ends = append(store.index_ends, end)
+	}
+
+	return store.truncateIndex()
+}
+
+// Rewrite index with current entries only.
+func (store *BlockStore) truncateIndex() error {
+	data, err := ioutil.ReadFile(store.indexPath())
+	if err != nil {
+		return err
+	}
+
+	var end int64
+	if len(store.index_ends) > 0 {
+		end = store.index_ends[len(store.index_ends)-1]
+	}
+
+	return WriteFileAtomic(store.indexPath(), data[:end], 0644)
+}
+
+// Write index again in current format.
+func (store *BlockStore) rewriteIndex() error {
+	data := new(bytes.Buffer)
+	WriteFileHeader(data, INDEX_FILE_MAGIC)
+
+	store.index_ends = nil
+	for i, loc := range store.locations {
+		WriteRecord(data, encodeIndexEntry(loc, store.headers[i]))
+		store.index_ends = append(store.index_ends, int64(data.Len()))
+	}
+
+	err := WriteFileAtomic(store.indexPath(), data.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+
+	store.index_version = CHAIN_FORMAT_VERSION
+
+	return nil
+}
+
+// Format version of a block file, 0 if it can't be read.
+func (store *BlockStore) blockFileVersion(file uint32) uint32 {
+	fd, err := os.Open(store.blockFilePath(file))
+	if err != nil {
+		return 0
+	}
+	defer fd.Close()
+
+	version, err := ReadFileHeader(fd, BLOCK_FILE_MAGIC)
+	if err != nil {
+		return 0
+	}
+
+	return version
+}
+
+// Read block record at given location, returns block and record end.
+func (store *BlockStore) readBlockRecord(loc BlockLocation) (*Block, int64, error) {
+	fd, err := os.Open(store.blockFilePath(loc.file))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer fd.Close()
+
+	version, err := ReadFileHeader(fd, BLOCK_FILE_MAGIC)
+	if err == io.EOF {
+		err = ErrTruncatedRecord
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	_, err = fd.Seek(int64(loc.offset), io.SeekStart)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	payload, err := ReadRecord(fd)
+	if err == io.EOF {
+		err = ErrTruncatedRecord
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	b, err := unmarshalBlock(payload, version)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return b, int64(loc.offset) + int64(RECORD_HEADER_SIZE+len(payload)), nil
+}
+
+// Drop indexed blocks which can't be read, then bytes written after last
+// indexed block: a block written without its index entry.
+func (store *BlockStore) recoverBlocks() error {
+	var file uint32
+	var end int64
+
+	dropped := 0
+	for len(store.locations) > 0 {
+		height := len(store.locations) - 1
+		loc := store.locations[height]
+
+		_, block_end, err := store.readBlockRecord(loc)
+		if err == nil {
+			file = loc.file
+			end = block_end
+			break
+		}
+
+		// Imported from snapshot, only headers are kept
+		if os.IsNotExist(err) {
+			file = loc.file
+			break
+		}
+
+		store.recovered = append(store.recovered, fmt.Sprintf("block %d: %s", height, err))
+
+		for hash, h := range store.hashes {
+			if h == uint64(height) {
+				delete(store.hashes, hash)
+			}
+		}
+
+		store.locations = store.locations[:height]
+		store.headers = store.headers[:height]
+		store.index_ends = store.index_ends[:height]
+		dropped++
+	}
+
+	if dropped > 0 {
+		err := store.truncateIndex()
+		if err != nil {
+			return err
+		}
+	}
+
+	info, err := os.Stat(store.blockFilePath(file))
+	if err == nil && info.Size() > end {
+		store.recovered = append(store.recovered, fmt.Sprintf("%s: %d bytes after last block", filepath.Base(store.blockFilePath(file)), info.Size()-end))
+
+		err = os.Truncate(store.blockFilePath(file), end)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Block files started after last block
+	for next := file + 1; ; next++ {
+		path := store.blockFilePath(next)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+
+		store.recovered = append(store.recovered, fmt.Sprintf("%s: file after last block", filepath.Base(path)))
+
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Number of stored blocks.
+func (store *BlockStore) BlockCount() uint64 {
+	return uint64(len(store.locations))
+}
+
+// Append record to file and sync it, starting file with its header.
+// Returns record offset.
+func appendRecord(path string, magic uint32, payload []byte) (int64, error) {
+	record := new(bytes.Buffer)
+	WriteRecord(record, payload)
+
+	return appendRecords(path, magic, record.Bytes())
+}
+
+// Append written records at once.
+func appendRecords(path string, magic uint32, records []byte) (int64, error) {
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+
+	info, err := fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// Header & records are written at once
+	buffer := new(bytes.Buffer)
+	offset := info.Size()
+	if offset == 0 {
+		WriteFileHeader(buffer, magic)
+		offset = FILE_HEADER_SIZE
+	}
+	buffer.Write(records)
+
+	_, err = fd.Write(buffer.Bytes())
+	if err != nil {
+		// Drop partial record
+		fd.Truncate(info.Size())
+		return 0, err
+	}
+
+	err = fd.Sync()
+	if err != nil {
+		return 0, err
+	}
+
+	// New file entry
+	if info.Size() == 0 {
+		err = SyncDir(filepath.Dir(path))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return offset, nil
+}
+
+// Append block, which must be the next one. Block is synced before being
+// indexed, so an indexed block is always complete.
+func (store *BlockStore) PutBlock(b *Block) error {
+	if b.index != store.BlockCount() {
+		return errors.New(fmt.Sprintf("Block %d is not next block (%d)", b.index, store.BlockCount()))
+	}
+
+	var loc BlockLocation
+	if len(store.locations) > 0 {
+		loc.file = store.locations[len(store.locations)-1].file
+
+		// Imported from snapshot, file of last block never existed
+		if store.pruned == store.BlockCount() {
+			loc.file++
+		}
+	}
+
+	// Rotate, blocks are not appended to files of an older format
+	info, err := os.Stat(store.blockFilePath(loc.file))
+	if err == nil && info.Size() > 0 && (info.Size() >= store.max_file_size || store.blockFileVersion(loc.file) < CHAIN_FORMAT_VERSION) {
+		loc.file++
+	}
+
+	payload, err := b.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	offset, err := appendRecord(store.blockFilePath(loc.file), BLOCK_FILE_MAGIC, payload)
+	if err != nil {
+		return err
+	}
+	loc.offset = uint64(offset)
+
+	// Block is written, index it
+	entry := encodeIndexEntry(loc, b)
+
+	offset, err = appendRecord(store.indexPath(), INDEX_FILE_MAGIC, entry)
+	if err != nil {
+		return err
+	}
+
+	store.locations = append(store.locations, loc)
+	store.headers = append(store.headers, b.Header())
+	store.hashes[string(b.hash)] = b.index
+	store.index_ends = append(store.index_ends, offset+int64(RECORD_HEADER_SIZE+len(entry)))
+
+	return store.utxos.applyBlock(b)
+}
+
+func (store *BlockStore) GetBlock(height uint64) (*Block, error) {
+	if height >= store.BlockCount() {
+		return nil, errors.New(fmt.Sprintf("Block %d not found", height))
+	}
+
+	if height < store.pruned {
+		return nil, ErrPrunedBlock
+	}
+
+	if height < uint64(len(store.blocks)) && store.blocks[height] != nil {
+		return store.blocks[height], nil
+	}
+
+	b, _, err := store.readBlockRecord(store.locations[height])
+
+	return b, err
+}
+
+func (store *BlockStore) GetHeader(height uint64) (*Block, error) {
+	if height >= store.BlockCount() {
+		return nil, errors.New(fmt.Sprintf("Block %d not found", height))
+	}
+
+	return store.headers[height], nil
+}
+
+// Delete block files holding only blocks below height. Current file is
+// always kept.
+func (store *BlockStore) PruneBlocks(height uint64) error {
+	if store.BlockCount() == 0 {
+		return nil
+	}
+
+	if height > store.BlockCount()-1 {
+		height = store.BlockCount() - 1
+	}
+
+	keep := store.locations[height].file
+
+	pruned := store.pruned
+	for pruned < height && store.locations[pruned].file < keep {
+		pruned++
+	}
+
+	if pruned == store.pruned {
+		return nil
+	}
+
+	// Blocks won't be there to rebuild unspent outputs
+	err := store.writeUnspent()
+	if err != nil {
+		return err
+	}
+
+	for file := store.locations[store.pruned].file; file < keep; file++ {
+		err = os.Remove(store.blockFilePath(file))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	for ; store.pruned < pruned; store.pruned++ {
+		if store.pruned < uint64(len(store.blocks)) {
+			store.blocks[store.pruned] = nil
+		}
+	}
+
+	return SyncDir(store.dir)
+}
+
+func (store *BlockStore) PrunedHeight() uint64 {
+	return store.pruned
+}
+
+// Headers are indexed in a block file which is never written, so they are
+// found pruned when opening store.
+func (store *BlockStore) ImportSnapshot(headers []*Block, utxos map[string]*TxOutput) error {
+	if store.BlockCount() > 0 {
+		return errors.New(fmt.Sprintf("Store already holds %d blocks", store.BlockCount()))
+	}
+
+	for _, header := range headers {
+		store.locations = append(store.locations, BlockLocation{})
+		store.headers = append(store.headers, header)
+		store.hashes[string(header.hash)] = header.index
+	}
+
+	store.blocks = make([]*Block, store.BlockCount())
+	store.utxos = createUnspentSet(utxos)
+	store.pruned = store.BlockCount()
+
+	// Left empty by recovery
+	err := os.Remove(store.blockFilePath(0))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Index makes unspent outputs used
+	err = store.writeUnspent()
+	if err != nil {
+		return err
+	}
+
+	return store.rewriteIndex()
+}
+
+// Save unspent outputs after all stored blocks.
+func (store *BlockStore) writeUnspent() error {
+	payload := new(bytes.Buffer)
+
+	err := encodeUnspentSet(payload, store.BlockCount(), store.utxos.outputs)
+	if err != nil {
+		return err
+	}
+
+	data := new(bytes.Buffer)
+	WriteFileHeader(data, UTXO_FILE_MAGIC)
+	WriteRecord(data, payload.Bytes())
+
+	return WriteFileAtomic(store.unspentPath(), data.Bytes(), 0644)
+}
+
+// Load unspent outputs saved when pruning, returns the number of blocks
+// applied to them.
+func (store *BlockStore) readUnspent() (uint64, error) {
+	fd, err := os.Open(store.unspentPath())
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Blocks before %d are pruned, unspent outputs can't be read: %s", store.pruned, err))
+	}
+	defer fd.Close()
+
+	_, err = ReadFileHeader(fd, UTXO_FILE_MAGIC)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("%s: %s", store.unspentPath(), err))
+	}
+
+	payload, err := ReadRecord(fd)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("%s: %s", store.unspentPath(), err))
+	}
+
+	count, utxos, err := decodeUnspentSet(bytes.NewReader(payload))
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("%s: %s", store.unspentPath(), err))
+	}
+
+	if count < store.pruned || count > store.BlockCount() {
+		return 0, errors.New(fmt.Sprintf("%s: saved after block %d, stored blocks are %d to %d", store.unspentPath(), count, store.pruned, store.BlockCount()))
+	}
+
+	store.utxos = createUnspentSet(utxos)
+
+	return count, nil
+}
+
+func (store *BlockStore) FindBlock(hash []byte) (*Block, error) {
+	height, ok := store.hashes[string(hash)]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Block %x not found", hash))
+	}
+
+	return store.GetBlock(height)
+}
+
+func (store *BlockStore) GetUnspent(txhash []byte, output_id uint32) (*TxOutput, error) {
+	return store.utxos.get(txhash, output_id)
+}
+
+func (store *BlockStore) ForEachUnspent(fn func(txhash []byte, output_id uint32, output *TxOutput) error) error {
+	return store.utxos.forEach(fn)
+}
+
+// Metadata: one record of key & value pairs.
+func (store *BlockStore) readMeta() error {
+	fd, err := os.Open(store.metaPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	_, err = ReadFileHeader(fd, META_FILE_MAGIC)
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s: %s", store.metaPath(), err))
+	}
+
+	payload, err := ReadRecord(fd)
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s: %s", store.metaPath(), err))
+	}
+
+	reader := bytes.NewReader(payload)
+	for reader.Len() > 0 {
+		key, err := ReadVarBytes(reader, MAX_RECORD_SIZE, "Meta key")
+		if err != nil {
+			return err
+		}
+
+		value, err := ReadVarBytes(reader, MAX_RECORD_SIZE, "Meta value")
+		if err != nil {
+			return err
+		}
+
+		store.meta[string(key)] = value
+	}
+
+	return nil
+}
+
+func (store *BlockStore) GetMeta(key string) ([]byte, error) {
+	return store.meta[key], nil
+}
+
+func (store *BlockStore) PutMeta(key string, value []byte) error {
+	store.meta[key] = value
+
+	payload := new(bytes.Buffer)
+	for key, value := range store.meta {
+		WriteVarBytes(payload, []byte(key))
+		WriteVarBytes(payload, value)
+	}
+
+	record := new(bytes.Buffer)
+	WriteFileHeader(record, META_FILE_MAGIC)
+	WriteRecord(record, payload.Bytes())
+
+	return WriteFileAtomic(store.metaPath(), record.Bytes(), 0644)
+}
+
+func encodeTxIndexRecord(key string, value []byte) []byte {
+	payload := new(bytes.Buffer)
+	WriteVarBytes(payload, []byte(key))
+	WriteVarBytes(payload, value)
+
+	return payload.Bytes()
+}
+
+// Each record is a key & value, a later record replaces an earlier one of
+// same key, or removes it if empty. Reading stops at the first truncated or invalid record, file
+// is then written again with records read.
+func (store *BlockStore) readTxIndex() error {
+	fd, err := os.Open(store.txIndexPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	_, err = ReadFileHeader(fd, TXIDX_FILE_MAGIC)
+	if err == io.EOF {
+		return nil
+	}
+	if err == io.ErrUnexpectedEOF {
+		store.recovered = append(store.recovered, "txindex: truncated header")
+		return store.writeTxIndex()
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s: %s", store.txIndexPath(), err))
+	}
+
+	store.txindex_size = FILE_HEADER_SIZE
+	for {
+		payload, err := ReadRecord(fd)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			store.recovered = append(store.recovered, fmt.Sprintf("txindex: %s after %d records", err, len(store.txindex)))
+			return store.writeTxIndex()
+		}
+
+		reader := bytes.NewReader(payload)
+
+		key, err := ReadVarBytes(reader, MAX_RECORD_SIZE, "Index key")
+		if err != nil {
+			return err
+		}
+
+		value, err := ReadVarBytes(reader, MAX_RECORD_SIZE, "Index value")
+		if err != nil {
+			return err
+		}
+
+		store.setTxIndexRecord(string(key), value)
+		store.txindex_size += int64(RECORD_HEADER_SIZE + len(payload))
+	}
+}
+
+// Empty value removes record, its own record is then stale.
+func (store *BlockStore) setTxIndexRecord(key string, value []byte) {
+	old, ok := store.txindex[key]
+	if ok {
+		store.txindex_live -= int64(RECORD_HEADER_SIZE + len(encodeTxIndexRecord(key, old)))
+	}
+
+	if len(value) == 0 {
+		delete(store.txindex, key)
+		return
+	}
+
+	store.txindex[key] = value
+	store.txindex_live += int64(RECORD_HEADER_SIZE + len(encodeTxIndexRecord(key, value)))
+}
+
+// Rewrite txindex.dat with current records only.
+func (store *BlockStore) writeTxIndex() error {
+	data := new(bytes.Buffer)
+	WriteFileHeader(data, TXIDX_FILE_MAGIC)
+
+	for key, value := range store.txindex {
+		WriteRecord(data, encodeTxIndexRecord(key, value))
+	}
+
+	err := WriteFileAtomic(store.txIndexPath(), data.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+
+	store.txindex_size = int64(data.Len())
+
+	return nil
+}
+
+func (store *BlockStore) PutIndexRecords(records map[string][]byte, replace bool) error {
+	if replace {
+		store.txindex = make(map[string][]byte)
+		store.txindex_live = 0
+	}
+
+	data := new(bytes.Buffer)
+	for key, value := range records {
+		payload := encodeTxIndexRecord(key, value)
+		if len(payload) > MAX_RECORD_SIZE {
+			return errors.New(fmt.Sprintf("Index record %x too large (%d bytes)", key, len(payload)))
+		}
+
+		store.setTxIndexRecord(key, value)
+		WriteRecord(data, payload)
+	}
+
+	if replace || store.txindex_size+int64(data.Len()) > 2*(FILE_HEADER_SIZE+store.txindex_live) {
+		return store.writeTxIndex()
+	}
+
+	_, err := appendRecords(store.txIndexPath(), TXIDX_FILE_MAGIC, data.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if store.txindex_size == 0 {
+		store.txindex_size = FILE_HEADER_SIZE
+	}
+	store.txindex_size += int64(data.Len())
+
+	return nil
+}
+
+func (store *BlockStore) ForEachIndexRecord(fn func(key string, value []byte) error) error {
+	for key, value := range store.txindex {
+		err := fn(key, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Files are only open while used.
+func (store *BlockStore) Close() error {
+	return nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestBlockStoreAppend(t *testing.T) {
+	bc := CreateBlockchain()
+	w1 := CreateTestingWallet()
+
+	c := Config{Blockchain: t.TempDir()}
+
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	err := bc.SaveBlockchain(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate files on each block
+	store := bc.store.(*BlockStore)
+	store.max_file_size = 1
+
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	err = bc.SaveBlockchain(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Saving again writes nothing
+	err = bc.SaveBlockchain(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store.BlockCount() != 4 {
+		t.Errorf("Invalid stored block count: %d", store.BlockCount())
+	}
+
+	for i, file := range []uint32{0, 0, 1, 2} {
+		if store.locations[i].file != file {
+			t.Errorf("Block %d stored in file %d, expected %d", i, store.locations[i].file, file)
+		}
+	}
+
+	c2, err := LoadBlockchain(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c2.blocks) != 4 || c2.last_index != 3 {
+		t.Fatalf("Invalid block number: %d", len(c2.blocks))
+	}
+
+	// Lookup by hash
+	b, err := c2.store.FindBlock(bc.blocks[2].hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.index != 2 {
+		t.Errorf("Invalid block found: %d", b.index)
+	}
+
+	// A different chain can't be appended
+	other := CreateBlockchain()
+	other.MineBlock(w1.PrivateKeys[0].PublicKey)
+	other.blocks[0].timestamp++
+	other.blocks[0].ComputeHash(true)
+	other.MineBlock(w1.PrivateKeys[0].PublicKey)
+	other.MineBlock(w1.PrivateKeys[0].PublicKey)
+	other.MineBlock(w1.PrivateKeys[0].PublicKey)
+	other.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	err = other.SaveBlockchain(c)
+	if err == nil {
+		t.Error("Other chain should not be saved.")
+	}
+}
+
+// Fails once limit bytes are written.
+type shortWriter struct {
+	limit   int
+	written int
+}
+
+func (w *shortWriter) Write(data []byte) (int, error) {
+	if w.written+len(data) > w.limit {
+		n := w.limit - w.written
+		w.written = w.limit
+		return n, errors.New("Short write")
+	}
+
+	w.written += len(data)
+	return len(data), nil
+}
+
+func TestBlockStoreShortWrite(t *testing.T) {
+	bc := CreateBlockchain()
+	w1 := CreateTestingWallet()
+
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	b := bc.blocks[0]
+
+	// Every truncation point is reported
+	for limit := 0; limit < 100; limit++ {
+		err := b.Encode(&shortWriter{limit: limit})
+		if err == nil {
+			t.Fatalf("Short write at %d bytes not reported", limit)
+		}
+
+		err = WriteRecord(&shortWriter{limit: limit}, []byte("payload"))
+		if limit < RECORD_HEADER_SIZE+7 && err == nil {
+			t.Fatalf("Short record write at %d bytes not reported", limit)
+		}
+	}
+}
+
+func TestBlockStoreRecovery(t *testing.T) {
+	bc := CreateBlockchain()
+	w1 := CreateTestingWallet()
+
+	c := Config{Blockchain: t.TempDir()}
+
+	for i := 0; i < 3; i++ {
+		bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	}
+
+	err := bc.SaveBlockchain(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Crash while writing last block: only part of it reached the disk
+	path := bc.store.(*BlockStore).blockFilePath(0)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Truncate(path, info.Size()-5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenBlockStore(c.Blockchain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store.BlockCount() != 2 {
+		t.Errorf("Invalid block count after recovery: %d", store.BlockCount())
+	}
+
+	if len(store.recovered) == 0 {
+		t.Error("Recovery not reported.")
+	}
+
+	// Crash after block, before its index entry
+	err = store.PutBlock(bc.blocks[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only part of the index entry reached the disk
+	info, err = os.Stat(store.indexPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Truncate(store.indexPath(), info.Size()-3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenBlockStore(c.Blockchain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store.BlockCount() != 2 || len(store.recovered) == 0 {
+		t.Errorf("Invalid index recovery: %d blocks, %v", store.BlockCount(), store.recovered)
+	}
+
+	// Store is usable again: append lost block
+	bc2 := CreateBlockchain()
+	bc2.store = store
+	bc2.blocks = bc.blocks
+	bc2.last_index = 2
+
+	err = bc2.SaveBlockchain(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc3, err := LoadBlockchain(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bc3.blocks) != 3 {
+		t.Fatalf("Invalid block number: %d", len(bc3.blocks))
+	}
+
+	if string(bc3.blocks[2].hash) != string(bc.blocks[2].hash) {
+		t.Error("Invalid recovered block")
+	}
+
+	// Corrupted block is detected by checksum
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-1] ^= 0xff
+	os.WriteFile(path, raw, 0644)
+
+	store, err = OpenBlockStore(c.Blockchain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store.BlockCount() != 2 {
+		t.Errorf("Corrupted block not dropped: %d blocks", store.BlockCount())
+	}
+}
+
+// Index entries written before headers were indexed.
+func TestBlockStoreIndexUpgrade(t *testing.T) {
+	bc := CreateBlockchain()
+	w1 := CreateTestingWallet()
+
+	c := Config{Blockchain: t.TempDir()}
+
+	for i := 0; i < 3; i++ {
+		bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	}
+
+	err := bc.SaveBlockchain(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := bc.store.(*BlockStore)
+
+	index := new(bytes.Buffer)
+	WriteUint32ToFd(index, INDEX_FILE_MAGIC)
+	WriteUint32ToFd(index, 1)
+	for i, loc := range store.locations {
+		entry := new(bytes.Buffer)
+		WriteVarInt(entry, uint64(i))
+		WriteVarBytes(entry, bc.blocks[i].hash)
+		WriteVarInt(entry, uint64(loc.file))
+		WriteVarInt(entry, loc.offset)
+		WriteRecord(index, entry.Bytes())
+	}
+	os.WriteFile(store.indexPath(), index.Bytes(), 0644)
+
+	store, err = OpenBlockStore(c.Blockchain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store.index_version != CHAIN_FORMAT_VERSION {
+		t.Errorf("Index not upgraded: version %d", store.index_version)
+	}
+
+	// Headers are read from index now
+	store, err = OpenBlockStore(c.Blockchain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, b := range bc.blocks {
+		header, err := store.GetHeader(uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if header.timestamp != b.timestamp || !bytes.Equal(header.last_hash, b.last_hash) {
+			t.Errorf("Invalid header %d", i)
+		}
+	}
+
+	err = store.PutBlock(CreateBlock(3, bc.blocks[2].hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Coin selection: which wallet funds a transaction spends. Newest first
+// is GetFunds order. Branch and bound looks for funds matching amount
+// without change, falling back to largest first.
+const (
+	SELECT_NEWEST_FIRST   = "newest-first"
+	SELECT_LARGEST_FIRST  = "largest-first"
+	SELECT_SMALLEST_FIRST = "smallest-first"
+	SELECT_BNB            = "bnb"
+	SELECT_RANDOM         = "random"
+)
+
+// Branch and bound spends up to MIN_CHANGE over amount as fee rather than
+// adding a change output, and gives up after BNB_MAX_TRIES. Sums of same
+// amounts in another order may differ by rounding, up to AMOUNT_TOLERANCE.
+const (
+	MIN_CHANGE       = 0.01
+	BNB_MAX_TRIES    = 100000
+	AMOUNT_TOLERANCE = 1e-9
+)
+
+// Funds chosen for a transaction, before it is built. Fee is left out of
+// outputs.
+type CoinSelection struct {
+	strategy string
+	funds    []*OutputFund
+	total    float64
+	amount   float64
+	change   float64
+	fee      float64
+}
+
+func (of *OutputFund) amount() float64 {
+	return of.txn.outputs[of.output_id].amount
+}
+
+// Take funds in order until amount and fee are covered, at least one.
+func accumulateFunds(funds []*OutputFund, target float64) ([]*OutputFund, float64, bool) {
+	used_funds := make([]*OutputFund, 0)
+	total := 0.0
+
+	for _, fund := range funds {
+		total += fund.amount()
+		used_funds = append(used_funds, fund)
+
+		if total >= target {
+			break
+		}
+	}
+
+	return used_funds, total, total >= target
+}
+
+// Depth first search over funds sorted by decreasing amount, including
+// each one before excluding it. Returns funds with smallest excess in
+// [target, target+MIN_CHANGE].
+func branchAndBound(funds []*OutputFund, target float64) ([]*OutputFund, float64, bool) {
+	sorted := append([]*OutputFund{}, funds...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].amount() > sorted[j].amount()
+	})
+
+	// Amount of funds after each position
+	remaining := make([]float64, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + sorted[i].amount()
+	}
+
+	var best []*OutputFund
+	best_total := 0.0
+	tries := 0
+	current := make([]*OutputFund, 0)
+
+	var search func(i int, total float64) bool
+	search = func(i int, total float64) bool {
+		tries++
+		if tries > BNB_MAX_TRIES {
+			return true
+		}
+
+		if total > target+MIN_CHANGE+AMOUNT_TOLERANCE || total+remaining[i] < target-AMOUNT_TOLERANCE {
+			return false
+		}
+
+		if total >= target-AMOUNT_TOLERANCE && len(current) > 0 {
+			if best == nil || total < best_total {
+				best = append([]*OutputFund{}, current...)
+				best_total = total
+			}
+
+			// Exact match, nothing better to find
+			return math.Abs(total-target) <= AMOUNT_TOLERANCE
+		}
+
+		if i == len(sorted) {
+			return false
+		}
+
+		current = append(current, sorted[i])
+		done := search(i+1, total+sorted[i].amount())
+		current = current[:len(current)-1]
+		if done {
+			return true
+		}
+
+		return search(i+1, total)
+	}
+
+	search(0, 0)
+
+	return best, best_total, best != nil
+}
+
+// Choose wallet funds paying amount and fee with given strategy, newest
+// first if empty. Funds spent by queued transactions are left out, the
+// caller holding chain lock while building and queuing.
+func (bc *Blockchain) SelectCoins(wallet *Wallet, amount float64, fee float64, strategy string) (*CoinSelection, error) {
+	if amount < 0 || fee < 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid amount %f or fee %f", amount, fee))
+	}
+
+	if strategy == "" {
+		strategy = SELECT_NEWEST_FIRST
+	}
+
+	// Inputs spend all outputs of their transaction
+	queued := make(map[string]bool)
+	for _, txn := range bc.txnQueue {
+		for _, input := range txn.inputs {
+			queued[string(input.txhash)] = true
+		}
+	}
+
+	wallet_funds, err := bc.GetFunds(wallet)
+	if err != nil {
+		return nil, err
+	}
+
+	funds := []*OutputFund{}
+	for _, fund := range wallet_funds {
+		if !queued[string(fund.txn.hash)] {
+			funds = append(funds, fund)
+		}
+	}
+	target := amount + fee
+
+	selection := new(CoinSelection)
+	selection.strategy = strategy
+	selection.amount = amount
+
+	var ok bool
+
+	switch strategy {
+	case SELECT_NEWEST_FIRST:
+		selection.funds, selection.total, ok = accumulateFunds(funds, target)
+	case SELECT_LARGEST_FIRST, SELECT_SMALLEST_FIRST:
+		sort.SliceStable(funds, func(i, j int) bool {
+			if strategy == SELECT_SMALLEST_FIRST {
+				return funds[i].amount() < funds[j].amount()
+			}
+			return funds[i].amount() > funds[j].amount()
+		})
+		selection.funds, selection.total, ok = accumulateFunds(funds, target)
+	case SELECT_RANDOM:
+		rand.Shuffle(len(funds), func(i, j int) {
+			funds[i], funds[j] = funds[j], funds[i]
+		})
+		selection.funds, selection.total, ok = accumulateFunds(funds, target)
+	case SELECT_BNB:
+		selection.funds, selection.total, ok = branchAndBound(funds, target)
+		if ok {
+			// Excess goes to fee, rounding below amount doesn't
+			selection.fee = math.Max(selection.total-amount, 0)
+			return selection, nil
+		}
+
+		selection.strategy = SELECT_LARGEST_FIRST
+		sort.SliceStable(funds, func(i, j int) bool {
+			return funds[i].amount() > funds[j].amount()
+		})
+		selection.funds, selection.total, ok = accumulateFunds(funds, target)
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown coin selection strategy %s", strategy))
+	}
+
+	if !ok {
+		// could not create transaction.
+		return nil, errors.New("Not enough funds.")
+	}
+
+	selection.fee = fee
+	selection.change = selection.total - target
+
+	return selection, nil
+}
+
+// Build transaction spending selected funds to outputs, paying selected
+// amount, then change to a new wallet key.
+func (selection *CoinSelection) BuildTransaction(wallet *Wallet, outputs []*TxOutput) (*Transaction, error) {
+	for _, fund := range selection.funds {
+		if fund.script == nil {
+			return nil, errors.New(fmt.Sprintf("Fund %x:%d is watch-only, create a partial transaction", fund.txn.hash, fund.output_id))
+		}
+	}
+
+	var change *Script
+	if selection.change > 0 {
+		key, err := wallet.CreateChangeKey()
+		if err != nil {
+			return nil, err
+		}
+
+		change = BuildP2PKHScript([]byte(wallet.Address(key.PublicKey)))
+	}
+
+	return selection.buildTransaction(outputs, change, false)
+}
+
+// Inputs are signed with fund scripts, or left empty if unsigned. Change,
+// if any, is paid to given script. Copies of other outputs of spent
+// transactions must fit in it too.
+func (selection *CoinSelection) buildTransaction(outputs []*TxOutput, change *Script, unsigned bool) (*Transaction, error) {
+	txn := new(Transaction)
+	txn.version = TXN_VERSION
+
+	selected := make(map[string]bool)
+	for _, used_fund := range selection.funds {
+		selected[string(outpointKey(used_fund.txn.hash, uint32(used_fund.output_id)))] = true
+	}
+
+	// Copy other outputs, data is already committed in chain
+	copies := []*TxOutput{}
+	for _, used_fund := range selection.funds {
+		for i, output := range used_fund.txn.outputs {
+			if used_fund.output_id != i && output != nil && !output.script.IsUnspendable() &&
+				!selected[string(outpointKey(used_fund.txn.hash, uint32(i)))] {
+				copies = append(copies, output)
+				selected[string(outpointKey(used_fund.txn.hash, uint32(i)))] = true
+			}
+		}
+	}
+
+	count := len(outputs) + len(copies)
+	if selection.change > 0 {
+		count++
+	}
+
+	if count > MAX_TXN_OUTPUTS {
+		return nil, errors.New(fmt.Sprintf("Transaction has %d outputs with change and copies, over %d", count, MAX_TXN_OUTPUTS))
+	}
+
+	for _, used_fund := range selection.funds {
+		script := used_fund.script
+		if unsigned {
+			script = new(Script)
+		}
+
+		txn.AddInput(CreateTxInput(used_fund.txn.hash, uint32(used_fund.output_id), script))
+	}
+
+	for _, output := range outputs {
+		txn.AddOutput(output)
+	}
+
+	// Add remaining funds into a new output
+	if selection.change > 0 {
+		txn.AddOutput(CreateTxOutput(change, selection.change))
+	}
+
+	for _, output := range copies {
+		txn.AddOutput(output)
+	}
+
+	txn.ComputeHash(true)
+
+	return txn, nil
+}
+
+func (selection *CoinSelection) String() string {
+	var dump string
+
+	dump += fmt.Sprintf("Strategy: %s\n", selection.strategy)
+
+	for _, fund := range selection.funds {
+		dump += fmt.Sprintf("- Input: %x:%d %f\n", fund.txn.hash, fund.output_id, fund.amount())
+	}
+
+	dump += fmt.Sprintf("Total: %f\n", selection.total)
+	dump += fmt.Sprintf("Amount: %f\n", selection.amount)
+	dump += fmt.Sprintf("Change: %f\n", selection.change)
+	dump += fmt.Sprintf("Fee: %f\n", selection.fee)
+
+	return dump
+}
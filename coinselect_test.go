@@ -0,0 +1,148 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestSelectCoins(t *testing.T) {
+	// One key per block, so coinbase transactions differ
+	w1 := new(Wallet)
+	for i := 0; i < 4; i++ {
+		key, _ := CreateKeyPair()
+		w1.AddPrivateKey(*key)
+	}
+	w2 := CreateTestingWallet()
+
+	bc := CreateBlockchain()
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	for i, amount := range []float64{10, 25, 40} {
+		TransferFund(bc, w1, w2, amount)
+		bc.MineBlock(w1.PrivateKeys[i+1].PublicKey)
+	}
+
+	tests := []struct {
+		strategy string
+		amount   float64
+		fee      float64
+		selected string
+		inputs   []float64
+		change   float64
+	}{
+		{SELECT_LARGEST_FIRST, 30, 0, SELECT_LARGEST_FIRST, []float64{40}, 10},
+		{SELECT_LARGEST_FIRST, 30, 1, SELECT_LARGEST_FIRST, []float64{40}, 9},
+		{SELECT_SMALLEST_FIRST, 30, 0, SELECT_SMALLEST_FIRST, []float64{10, 25}, 5},
+		{SELECT_NEWEST_FIRST, 30, 0, SELECT_NEWEST_FIRST, []float64{40}, 10},
+		{SELECT_BNB, 35, 0, SELECT_BNB, []float64{25, 10}, 0},
+		{SELECT_BNB, 64.995, 0, SELECT_BNB, []float64{40, 25}, 0},
+		// No match without change
+		{SELECT_BNB, 30, 0, SELECT_LARGEST_FIRST, []float64{40}, 10},
+	}
+
+	for _, test := range tests {
+		selection, err := bc.SelectCoins(w2, test.amount, test.fee, test.strategy)
+		if err != nil {
+			t.Fatalf("%s %f: %s", test.strategy, test.amount, err)
+		}
+
+		if selection.strategy != test.selected || len(selection.funds) != len(test.inputs) {
+			t.Errorf("%s %f: Invalid selection:\n%s", test.strategy, test.amount, selection)
+			continue
+		}
+
+		for i, fund := range selection.funds {
+			if fund.amount() != test.inputs[i] {
+				t.Errorf("%s %f: Invalid input %d: %f", test.strategy, test.amount, i, fund.amount())
+			}
+		}
+
+		// Inputs are spent on amount, change and fee
+		if math.Abs(selection.change-test.change) > 1e-9 || math.Abs(selection.total-selection.amount-selection.change-selection.fee) > 1e-9 {
+			t.Errorf("%s %f: Invalid change %f, fee %f", test.strategy, test.amount, selection.change, selection.fee)
+		}
+	}
+
+	selection, err := bc.SelectCoins(w2, 75, 0, SELECT_RANDOM)
+	if err != nil || len(selection.funds) != 3 {
+		t.Errorf("Invalid random selection: %v", err)
+	}
+
+	_, err = bc.SelectCoins(w2, 76, 0, SELECT_BNB)
+	if err == nil {
+		t.Error("Selected more than funds.")
+	}
+
+	_, err = bc.SelectCoins(w2, 10, 0, "unknown")
+	if err == nil {
+		t.Error("Unknown strategy accepted.")
+	}
+
+	// Exact match leaves no change output
+	txnOrder := &TxnOrder{Addr: GetPublicKeyHash(w1.PrivateKeys[0].PublicKey), Amount: 35, Strategy: SELECT_BNB}
+
+	txn, err := bc.CreateTransfertTransaction(w2, txnOrder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bc.QueueTransaction(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Funds of queued transaction are not chosen again
+	selection, err = bc.SelectCoins(w2, 35, 0, SELECT_BNB)
+	if err != nil || len(selection.funds) != 1 || selection.funds[0].amount() != 40 {
+		t.Errorf("Queued funds selected: %v", selection)
+	}
+
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	ControlFunds(t, w2, bc, 40)
+}
+
+// Sum of funds matches amount up to rounding.
+func TestBranchAndBoundRounding(t *testing.T) {
+	amounts := []float64{0.1, 0.2, 0.3}
+
+	funds := []*OutputFund{}
+	target := 0.0
+	for _, amount := range amounts {
+		txn := CreateTransaction()
+		txn.AddOutput(CreateTxOutput(new(Script), amount))
+		funds = append(funds, &OutputFund{txn, 0, nil})
+
+		// Not summed in search order
+		target += amount
+	}
+
+	selected, total, ok := branchAndBound(funds, target)
+	if !ok || len(selected) != 3 || math.Abs(total-target) > AMOUNT_TOLERANCE {
+		t.Errorf("Invalid selection: %d funds, %f", len(selected), total)
+	}
+}
+
+// Change and copies count in transaction outputs.
+func TestBuildTransactionOutputs(t *testing.T) {
+	w1 := CreateTestingWallet()
+	w2 := CreateTestingWallet()
+	miner := CreateTestingWallet()
+
+	bc := CreateBlockchain()
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	TransferFund(bc, w1, w2, 30)
+	bc.MineBlock(miner.PrivateKeys[0].PublicKey)
+
+	// Payment output of w2 comes with w1 change
+	txnOrder := new(TxnOrder)
+	addr := GetPublicKeyHash(miner.PrivateKeys[0].PublicKey)
+	for i := 0; i < MAX_TXN_OUTPUTS-1; i++ {
+		txnOrder.Destinations = append(txnOrder.Destinations, TxnDestination{addr, 0.001})
+	}
+
+	_, err := bc.CreateTransfertTransaction(w2, txnOrder)
+	if err == nil || !strings.Contains(err.Error(), "with change and copies") {
+		t.Errorf("Transaction over %d outputs built: %v", MAX_TXN_OUTPUTS, err)
+	}
+}
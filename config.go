@@ -3,6 +3,8 @@ package main
 import (
 	"crypto/ecdsa"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 )
 
@@ -12,15 +14,27 @@ type Config struct {
 	key           ecdsa.PublicKey
 	MiningAddr    string `json:"mining-addr"`
 	WebListenAddr string `json:"listen-addr"`
+	Network       string `json:"network"`
+	Store         string `json:"store"`
+	TxIndex       bool   `json:"txindex"`
+	Prune         uint64 `json:"prune"`
+
+	// Store holding blocks of an imported snapshot, to check it
+	SnapshotHistory string `json:"snapshot-history"`
 }
 
+// Recent blocks always kept when pruning.
+const MIN_PRUNE_BLOCKS = 100
+
 func LoadConfiguration(path string) (Config, error) {
 	var config Config
 
 	// Default values...
-	config.Blockchain = ".blocks.dat"
+	config.Blockchain = ".blocks"
 	config.Wallet = "wallet.key"
 	config.WebListenAddr = ":8080"
+	config.Network = MainNetParams.Name
+	config.Store = STORE_FILE
 
 	content, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -32,5 +46,27 @@ func LoadConfiguration(path string) (Config, error) {
 		return config, err
 	}
 
+	params, err := GetNetworkParams(config.Network)
+	if err != nil {
+		return config, err
+	}
+
+	// Coinbases would pay an address of another network
+	if config.MiningAddr != "" {
+		_, err = DecodeAddress(config.MiningAddr, params)
+		if err != nil {
+			return config, errors.New(fmt.Sprintf("mining-addr: %s", err))
+		}
+	}
+
+	if config.Prune > 0 && config.Prune < MIN_PRUNE_BLOCKS {
+		return config, errors.New(fmt.Sprintf("prune must keep at least %d blocks", MIN_PRUNE_BLOCKS))
+	}
+
+	// Index would point to pruned blocks
+	if config.Prune > 0 && config.TxIndex {
+		return config, errors.New("prune and txindex can't be both set")
+	}
+
 	return config, nil
 }
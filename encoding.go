@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Canonical binary encoding, used on disk and over the network. Integers
+// are unsigned varints (LEB128) in their shortest form, byte strings are
+// prefixed by their varint length, and every length or count is bounded
+// before anything is allocated.
+const (
+	MAX_HASH_SIZE    = 64
+	MAX_BLOCK_TXNS   = 100000
+	MAX_TXN_INPUTS   = 10000
+	MAX_TXN_OUTPUTS  = 10000
+	MAX_KEY_INT_SIZE = 66
+)
+
+// Types with a canonical encoding.
+type Encoder interface {
+	Encode(w io.Writer) error
+}
+
+type Decoder interface {
+	Decode(r io.Reader) error
+}
+
+// Decoder from a function, to decode older formats.
+type decoderFunc func(r io.Reader) error
+
+func (fn decoderFunc) Decode(r io.Reader) error {
+	return fn(r)
+}
+
+func WriteVarInt(w io.Writer, value uint64) error {
+	buffer := make([]byte, binary.MaxVarintLen64)
+	size := binary.PutUvarint(buffer, value)
+
+	_, err := w.Write(buffer[:size])
+
+	return err
+}
+
+// Returns io.EOF if nothing is left, io.ErrUnexpectedEOF if value is
+// truncated. Values not in their shortest form are rejected.
+func ReadVarInt(r io.Reader) (uint64, error) {
+	var value uint64
+	buffer := make([]byte, 1)
+
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		_, err := io.ReadFull(r, buffer)
+		if err == io.EOF && i > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		b := buffer[0]
+		if i == binary.MaxVarintLen64-1 && b > 1 {
+			return 0, errors.New("Varint overflows 64 bits")
+		}
+
+		value |= uint64(b&0x7f) << (7 * uint(i))
+
+		if b&0x80 == 0 {
+			if b == 0 && i > 0 {
+				return 0, errors.New("Non canonical varint")
+			}
+
+			return value, nil
+		}
+	}
+
+	return 0, errors.New("Varint overflows 64 bits")
+}
+
+// Read varint, failing if over max.
+func ReadBoundedVarInt(r io.Reader, max uint64, name string) (uint64, error) {
+	value, err := ReadVarInt(r)
+	if err != nil {
+		return 0, err
+	}
+
+	if value > max {
+		return 0, errors.New(fmt.Sprintf("%s: %d is over %d", name, value, max))
+	}
+
+	return value, nil
+}
+
+func WriteVarBytes(w io.Writer, data []byte) error {
+	err := WriteVarInt(w, uint64(len(data)))
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+
+	return err
+}
+
+func ReadVarBytes(r io.Reader, max int, name string) ([]byte, error) {
+	size, err := ReadBoundedVarInt(r, uint64(max), name+" size")
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, size)
+
+	_, err = io.ReadFull(r, data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func WriteAmount(w io.Writer, amount float64) error {
+	buffer := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buffer, math.Float64bits(amount))
+
+	_, err := w.Write(buffer)
+
+	return err
+}
+
+// Amounts are float64, NaN and infinite values are rejected.
+func ReadAmount(r io.Reader) (float64, error) {
+	buffer := make([]byte, 8)
+
+	_, err := io.ReadFull(r, buffer)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	amount := math.Float64frombits(binary.LittleEndian.Uint64(buffer))
+	if math.IsNaN(amount) || math.IsInf(amount, 0) {
+		return 0, errors.New(fmt.Sprintf("Invalid amount: %f", amount))
+	}
+
+	return amount, nil
+}
+
+func marshalBinary(e Encoder) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+
+	err := e.Encode(buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// Data must hold exactly one encoded value.
+func unmarshalBinary(d Decoder, data []byte) error {
+	reader := bytes.NewReader(data)
+
+	err := d.Decode(reader)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+
+	if reader.Len() != 0 {
+		return errors.New(fmt.Sprintf("%d trailing bytes", reader.Len()))
+	}
+
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+
+	"bytes"
+	"testing"
+)
+
+func TestVarInt(t *testing.T) {
+	values := []uint64{0, 1, 127, 128, 300, 1 << 32, 1<<64 - 1}
+
+	for _, value := range values {
+		buffer := new(bytes.Buffer)
+		WriteVarInt(buffer, value)
+
+		res, err := ReadVarInt(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res != value || buffer.Len() != 0 {
+			t.Errorf("Invalid varint %d, got %d", value, res)
+		}
+	}
+
+	// Non canonical, overflow, truncated
+	invalid := [][]byte{
+		{0x80, 0x00},
+		{0xff, 0x80, 0x00},
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02},
+		{0x80},
+	}
+
+	for _, data := range invalid {
+		_, err := ReadVarInt(bytes.NewReader(data))
+		if err == nil {
+			t.Errorf("Invalid varint %x accepted", data)
+		}
+	}
+}
+
+func TestVarBytesBounded(t *testing.T) {
+	// Announces 4GB
+	buffer := new(bytes.Buffer)
+	WriteVarInt(buffer, 1<<32)
+	buffer.Write([]byte("short"))
+
+	_, err := ReadVarBytes(buffer, MAX_SCRIPT_SIZE, "Script")
+	if err == nil {
+		t.Error("Oversized data accepted")
+	}
+
+	// Short read
+	buffer = new(bytes.Buffer)
+	WriteVarInt(buffer, 10)
+	buffer.Write([]byte("short"))
+
+	_, err = ReadVarBytes(buffer, MAX_SCRIPT_SIZE, "Script")
+	if err == nil {
+		t.Error("Truncated data accepted")
+	}
+}
+
+func TestEncodeBlock(t *testing.T) {
+	bc := CreateBlockchain()
+	w1 := CreateTestingWallet()
+	w2 := CreateTestingWallet()
+
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	TransferFund(bc, w1, w2, 30)
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	b := bc.blocks[1]
+
+	data, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b2 := new(Block)
+	err = b2.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b.hash, b2.hash) || len(b2.txns) != 2 {
+		t.Errorf("Invalid decoded block %x", b2.hash)
+	}
+
+	// Same bytes again
+	data2, _ := b2.MarshalBinary()
+	if !bytes.Equal(data, data2) {
+		t.Error("Encoding is not canonical")
+	}
+
+	// Every truncation fails
+	for i := 0; i < len(data); i++ {
+		if new(Block).UnmarshalBinary(data[:i]) == nil {
+			t.Fatalf("Truncated block (%d/%d bytes) accepted", i, len(data))
+		}
+	}
+
+	if new(Block).UnmarshalBinary(append(data, 0)) == nil {
+		t.Error("Trailing bytes accepted")
+	}
+
+	// Transaction on its own
+	txn := b.txns[1]
+	data, err = txn.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txn2 := new(Transaction)
+	err = txn2.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(txn.hash, txn2.hash) || txn2.inputs[0].sequence != txn.inputs[0].sequence {
+		t.Error("Invalid decoded transaction")
+	}
+
+	// Hash is the one of encoding
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(txn.hash, sum[:]) {
+		t.Error("Transaction hash is not the one of its encoding")
+	}
+
+	// Fields are delimited: same digits, other values
+	txn1 := CreateTransaction()
+	txn1.timestamp, txn1.locktime = 1, 23
+	txn2 = CreateTransaction()
+	txn2.timestamp, txn2.locktime = 12, 3
+
+	if bytes.Equal(txn1.ComputeHash(false), txn2.ComputeHash(false)) {
+		t.Error("Different transactions have same hash")
+	}
+
+	// Defaults are hashed too
+	txn2.timestamp, txn2.locktime = 1, 0
+	if bytes.Equal(txn1.ComputeHash(false), txn2.ComputeHash(false)) {
+		t.Error("Lock time is not hashed")
+	}
+
+	data, _ = txn.outputs[0].script.MarshalBinary()
+	script := new(Script)
+	err = script.UnmarshalBinary(data)
+	if err != nil || !bytes.Equal(script.data, txn.outputs[0].script.data) {
+		t.Error("Invalid decoded script")
+	}
+}
+
+func TestEncodeKeys(t *testing.T) {
+	key, err := CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := (*PrivateKey)(key).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	priv := new(PrivateKey)
+	err = priv.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if priv.D.Cmp(key.D) != 0 || priv.X.Cmp(key.X) != 0 {
+		t.Error("Invalid decoded private key")
+	}
+
+	data, err = (*PublicKey)(&key.PublicKey).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub := new(PublicKey)
+	err = pub.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if GetPublicKeyHash(ecdsa.PublicKey(*pub)) != GetPublicKeyHash(key.PublicKey) {
+		t.Error("Invalid decoded public key")
+	}
+
+	// Point not on curve
+	data[len(data)-1] ^= 1
+	if new(PublicKey).UnmarshalBinary(data) == nil {
+		t.Error("Invalid public key accepted")
+	}
+}
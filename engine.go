@@ -1,21 +1,51 @@
 package main
 
 import (
-	"crypto/md5"
-	"encoding/base64"
-	"encoding/binary"
 	"errors"
 	"fmt"
 )
 
+// Consensus limits, enforced by the VM.
+const (
+	MAX_SCRIPT_SIZE   = 10000
+	MAX_SCRIPT_OPS    = 201
+	MAX_STACK_SIZE    = 1000
+	MAX_ELEMENT_SIZE  = 520
+	MAX_MULTISIG_KEYS = 20
+)
+
 type Stack struct {
 	data [][]byte
 }
 
+// A VM only holds the context of the checked input, so it can be shared to
+// run many scripts at once.
 type VM struct {
+	// Network rules, main network when not set.
+	params *NetworkParams
+
+	// Called after each instruction when set. Returns false to abort.
+	tracer func(step *TraceStep) bool
+
+	// Spending transaction context, used by timelock instructions.
+	txn       *Transaction
+	input_idx int
+}
+
+// State of a script being run.
+type execution struct {
+	vm          *VM
 	script      *Script
 	stack       *Stack
 	current_idx int
+	ops_count   int
+
+	// Locking script, signed by OP_CHECKSIG
+	message []byte
+	output  bool
+
+	// Conditional branches being run; false when skipped.
+	conditions []bool
 }
 
 func NewStack() *Stack {
@@ -41,179 +71,194 @@ func (stack *Stack) Pop() ([]byte, error) {
 	return elem, nil
 }
 
+// Numbers are stored in stack as big endian unsigned integers.
+func StackElemToUint64(elem []byte) (uint64, error) {
+	if len(elem) == 0 || len(elem) > 8 {
+		return 0, errors.New(fmt.Sprintf("Invalid number size: %d", len(elem)))
+	}
+
+	var value uint64
+	for _, b := range elem {
+		value = value<<8 | uint64(b)
+	}
+
+	return value, nil
+}
+
+// An element is true if any of its bytes is not zero.
+func StackElemToBool(elem []byte) bool {
+	for _, b := range elem {
+		if b != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (stack *Stack) Copy() [][]byte {
+	data := make([][]byte, len(stack.data))
+	copy(data, stack.data)
+
+	return data
+}
+
 func (stack *Stack) Empty() bool {
 	return len(stack.data) == 0
 }
 
-func (vm *VM) hasEnough(bytes int) bool {
-	return len(vm.script.data) >= (vm.current_idx + bytes)
+// Create a VM to check inputs of given transaction.
+func NewVM(txn *Transaction, input_idx int) *VM {
+	vm := new(VM)
+	vm.txn = txn
+	vm.input_idx = input_idx
+
+	return vm
 }
 
-func (vm *VM) runInputOutput(input Script, output Script) (bool, error) {
-	vm.stack = NewStack()
-	vm.script = &input
-	vm.script.data = append(vm.script.data, output.data...)
+// Instructions are only run when all enclosing branches are taken.
+func (ex *execution) isExecuting() bool {
+	for _, cond := range ex.conditions {
+		if !cond {
+			return false
+		}
+	}
 
-	for vm.current_idx = 0; vm.current_idx < len(vm.script.data); {
-		// pick instruction
-		inst := Instruction(vm.script.data[vm.current_idx])
-		vm.current_idx++
+	return true
+}
 
-		switch inst {
-		case OP_NOP:
-			// Do nothing
-			continue
-		case OP_PUSH_BYTE:
-			// Push one byte to stack
-			if !vm.hasEnough(1) {
-				return false, errors.New("Not enough bytes in script")
-			}
-			vm.stack.Push(vm.script.data[vm.current_idx : vm.current_idx+1])
-			vm.current_idx++
+// Check stack after an instruction. New elements are always on top.
+func (ex *execution) checkLimits() error {
+	if len(ex.stack.data) > MAX_STACK_SIZE {
+		return errors.New(fmt.Sprintf("Stack size limit exceeded (%d elements)", MAX_STACK_SIZE))
+	}
 
-		case OP_PUSH_WORD:
-			// Push 2 bytes to stack
-			if !vm.hasEnough(2) {
-				return false, errors.New("Not enough bytes in script")
-			}
-			vm.stack.Push(vm.script.data[vm.current_idx : vm.current_idx+2])
-			vm.current_idx += 2
+	if !ex.stack.Empty() && len(ex.stack.data[len(ex.stack.data)-1]) > MAX_ELEMENT_SIZE {
+		return errors.New(fmt.Sprintf("Element size limit exceeded (%d bytes)", MAX_ELEMENT_SIZE))
+	}
 
-		case OP_PUSH_DWORD:
-			// Push 4 bytes to stack
-			if !vm.hasEnough(4) {
-				return false, errors.New("Not enough bytes in script")
-			}
-			vm.stack.Push(vm.script.data[vm.current_idx : vm.current_idx+4])
-			vm.current_idx += 4
+	if ex.ops_count > MAX_SCRIPT_OPS {
+		return errors.New(fmt.Sprintf("Instruction count limit exceeded (%d)", MAX_SCRIPT_OPS))
+	}
 
-		case OP_PUSH_BYTES:
-			// Get number of bytes to push
-			if !vm.hasEnough(2) {
-				return false, errors.New("Not enough bytes in script")
-			}
-			size_bytes := vm.script.data[vm.current_idx : vm.current_idx+2]
-			vm.current_idx += 2
-			size := binary.BigEndian.Uint16(size_bytes)
+	return nil
+}
 
-			if !vm.hasEnough(int(size)) {
-				return false, errors.New("Not enough bytes in script")
-			}
+// Run input script, which may only push data, then output script over the
+// resulting stack. Output script is unlocked if stack is empty at the end.
+func (vm *VM) runInputOutput(input Script, output Script) (bool, error) {
+	if len(input.data) > MAX_SCRIPT_SIZE || len(output.data) > MAX_SCRIPT_SIZE {
+		return false, errors.New(fmt.Sprintf("Script size limit exceeded (%d bytes)", MAX_SCRIPT_SIZE))
+	}
 
-			vm.stack.Push(vm.script.data[vm.current_idx : vm.current_idx+int(size)])
-			vm.current_idx += int(size)
-		case OP_DUP:
-			elem1, err := vm.stack.Pop()
-			if err != nil {
-				return false, errors.New("Not enough elements in stack")
-			}
+	if !input.IsPushOnly() {
+		return false, errors.New("Input script must only push data")
+	}
 
-			vm.stack.Push(elem1)
-			vm.stack.Push(elem1)
-		case OP_SWAP:
-			elem1, err := vm.stack.Pop()
-			if err != nil {
-				return false, errors.New("Not enough elements in stack")
-			}
-			elem2, err := vm.stack.Pop()
-			if err != nil {
-				return false, errors.New("Not enough elements in stack")
-			}
+	stack := NewStack()
 
-			vm.stack.Push(elem1)
-			vm.stack.Push(elem2)
+	err := vm.runScript(&input, output.data, stack, false)
+	if err != nil {
+		return false, err
+	}
 
-		case OP_EQUAL:
-			// Picks 2 elements in stack, if not equal, fail.
-			elem1, err := vm.stack.Pop()
-			if err != nil {
-				return false, errors.New("Not enough elements in stack")
-			}
-			elem2, err := vm.stack.Pop()
-			if err != nil {
-				return false, errors.New("Not enough elements in stack")
-			}
+	err = vm.runScript(&output, output.data, stack, true)
+	if err != nil {
+		return false, err
+	}
 
-			if len(elem1) != len(elem2) {
-				return false, errors.New("OP_EQUAL: Can't compare elements: Invalid sizes")
-			}
+	if !stack.Empty() {
+		return false, errors.New(fmt.Sprintf("Remaining elements in stack."))
+	}
 
-			for j := 0; j < len(elem1); j++ {
-				if elem1[j] != elem2[j] {
-					return false, errors.New(fmt.Sprintf("OP_EQUAL: Elements are not equal (%s / %s)", string(elem1), string(elem2)))
-				}
-			}
+	return true, nil
+}
 
-		case OP_HASH_BASE64:
-			elem1, err := vm.stack.Pop()
-			if err != nil {
-				return false, errors.New("Not enough elements in stack")
-			}
+func (vm *VM) runScript(script *Script, message []byte, stack *Stack, is_output bool) error {
+	ex := new(execution)
+	ex.vm = vm
+	ex.script = script
+	ex.stack = stack
+	ex.message = message
+	ex.output = is_output
 
-			str := base64.StdEncoding.EncodeToString(elem1)
-			vm.stack.Push([]byte(str))
+	for ex.current_idx = 0; ex.current_idx < len(ex.script.data); {
+		// pick instruction
+		pc := ex.current_idx
+		inst := Instruction(ex.script.data[ex.current_idx])
+		ex.current_idx++
 
-		case OP_HASH_TOHEX:
-			elem1, err := vm.stack.Pop()
+		if !inst.isPush() {
+			ex.ops_count++
+		}
+
+		if vm.tracer == nil {
+			err := ex.runInstruction(inst)
+			if err == nil {
+				err = ex.checkLimits()
+			}
 			if err != nil {
-				return false, errors.New("Not enough elements in stack")
+				return err
 			}
+			continue
+		}
 
-			str := fmt.Sprintf("%x", elem1)
-			vm.stack.Push([]byte(str))
+		step := new(TraceStep)
+		step.pc = pc
+		step.inst = inst
+		step.output = ex.output
+		step.executed = ex.isExecuting() || inst.isConditional()
+		step.before = ex.stack.Copy()
 
-		case OP_HASH_MD5:
-			elem1, err := vm.stack.Pop()
-			if err != nil {
-				return false, errors.New("Not enough elements in stack")
-			}
+		step.err = ex.runInstruction(inst)
+		if step.err == nil {
+			step.err = ex.checkLimits()
+		}
 
-			hash := md5.Sum(elem1)
-			vm.stack.Push(hash[:])
+		step.code = ex.script.data[pc:ex.current_idx]
+		step.after = ex.stack.Copy()
 
-		case OP_HASH_KEY:
-			elem1, err := vm.stack.Pop()
-			if err != nil {
-				return false, errors.New("Not enough elements in stack")
-			}
+		if !vm.tracer(step) {
+			return errors.New("Execution aborted")
+		}
 
-			// Recreate key
-			pk := GetPublicKeyFromBytes(elem1)
+		if step.err != nil {
+			return step.err
+		}
+	}
 
-			// Get hash
-			hash := GetPublicKeyHash(pk)
+	if len(ex.conditions) != 0 {
+		return errors.New("Unbalanced conditional: missing OP_ENDIF")
+	}
 
-			vm.stack.Push([]byte(hash))
+	return nil
+}
 
-		case OP_CHECKSIG:
-			// Pop public key
-			key, err := vm.stack.Pop()
-			if err != nil {
-				return false, errors.New("Not enough elements in stack")
-			}
-			// Pop signature
-			sign, err := vm.stack.Pop()
-			if err != nil {
-				return false, errors.New("Not enough elements in stack")
-			}
+// Run one instruction, script index pointing after it.
+func (ex *execution) runInstruction(inst Instruction) error {
+	op := GetOpcode(inst)
+	if op == nil {
+		return errors.New(fmt.Sprintf("Invalid instruction: 0x%x", inst))
+	}
 
-			// Rebuild key
-			pbkey := GetPublicKeyFromBytes(key)
+	if op.experimental && (ex.vm.params == nil || !ex.vm.params.ExperimentalOpcodes) {
+		return errors.New(fmt.Sprintf("%s: Experimental instruction is disabled", op.name))
+	}
 
-			// Check signature over script
-			ret := SignVerify(pbkey, output.data, sign)
-			if ret != true {
-				return false, errors.New("Invalid signature")
-			}
+	var operand []byte
+	if op.parse != nil {
+		var ok bool
 
-		default:
-			return false, errors.New(fmt.Sprintf("Invalid instruction: 0x%x", inst))
+		operand, ex.current_idx, ok = op.parse(ex.script.data, ex.current_idx)
+		if !ok {
+			return errors.New("Not enough bytes in script")
 		}
 	}
 
-	if !vm.stack.Empty() {
-		return false, errors.New(fmt.Sprintf("Remaining elements in stack."))
+	// Skipped branch: only read operands & track nested branches.
+	if !ex.isExecuting() && !op.conditional {
+		return nil
 	}
 
-	return true, nil
+	return op.run(ex, operand)
 }
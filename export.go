@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Chain export for analysis, block by block: newline delimited JSON (one
+// block per line), or CSV tables (blocks, transactions, inputs, outputs)
+// linked by block height and transaction hash.
+const (
+	EXPORT_JSON = "json"
+	EXPORT_CSV  = "csv"
+)
+
+// Blocks from height to height (included), and transactions paying or
+// spending from address if set.
+type ExportFilter struct {
+	From    uint64
+	To      uint64
+	Address string
+}
+
+type ExportBlock struct {
+	Height    uint64      `json:"height"`
+	Hash      string      `json:"hash"`
+	LastHash  string      `json:"last_hash"`
+	Timestamp uint64      `json:"timestamp"`
+	Pruned    bool        `json:"pruned,omitempty"`
+	Txns      []ExportTxn `json:"txns"`
+}
+
+type ExportTxn struct {
+	Hash      string         `json:"hash"`
+	Position  int            `json:"position"`
+	Timestamp uint64         `json:"timestamp"`
+	Locktime  uint64         `json:"locktime"`
+	Inputs    []ExportInput  `json:"inputs"`
+	Outputs   []ExportOutput `json:"outputs"`
+}
+
+// Amount and addresses come from spent output, they are unknown if it is
+// pruned.
+type ExportInput struct {
+	Id           int      `json:"id"`
+	PrevTxHash   string   `json:"prev_txhash"`
+	PrevOutputId uint32   `json:"prev_output_id"`
+	Sequence     uint32   `json:"sequence"`
+	Script       string   `json:"script"`
+	Amount       *float64 `json:"amount"`
+	Addresses    []string `json:"addresses"`
+}
+
+type ExportOutput struct {
+	Id        int      `json:"id"`
+	Type      string   `json:"type"`
+	Script    string   `json:"script"`
+	Amount    float64  `json:"amount"`
+	Addresses []string `json:"addresses"`
+}
+
+// Disassembled script, hex if it can't be.
+func exportScript(script *Script) string {
+	str, err := script.Disassemble()
+	if err != nil {
+		return hex.EncodeToString(script.data)
+	}
+
+	return str
+}
+
+func (bc *Blockchain) exportTransaction(txn *Transaction, position int) ExportTxn {
+	e := ExportTxn{
+		Hash:      hex.EncodeToString(txn.hash),
+		Position:  position,
+		Timestamp: txn.timestamp,
+		Locktime:  txn.locktime,
+		Inputs:    []ExportInput{},
+		Outputs:   []ExportOutput{},
+	}
+
+	for i, input := range txn.inputs {
+		ei := ExportInput{
+			Id:           i,
+			PrevTxHash:   hex.EncodeToString(input.txhash),
+			PrevOutputId: input.output_id,
+			Sequence:     input.sequence,
+			Script:       exportScript(input.script),
+			Addresses:    []string{},
+		}
+
+		prev, _, err := bc.FindTransaction(input.txhash)
+		if err == nil {
+			if outputs, ok := input.spentOutputs(prev); ok {
+				amount := 0.0
+				for _, output := range outputs {
+					amount += output.amount
+					ei.Addresses = append(ei.Addresses, GetScriptAddresses(output.script, bc.params)...)
+				}
+
+				ei.Amount = &amount
+			}
+		}
+
+		e.Inputs = append(e.Inputs, ei)
+	}
+
+	for i, output := range txn.outputs {
+		e.Outputs = append(e.Outputs, ExportOutput{
+			Id:        i,
+			Type:      GetScriptTemplate(output.script),
+			Script:    exportScript(output.script),
+			Amount:    output.amount,
+			Addresses: append([]string{}, GetScriptAddresses(output.script, bc.params)...),
+		})
+	}
+
+	return e
+}
+
+func (e *ExportTxn) hasAddress(address string) bool {
+	for _, input := range e.Inputs {
+		for _, a := range input.Addresses {
+			if a == address {
+				return true
+			}
+		}
+	}
+
+	for _, output := range e.Outputs {
+		for _, a := range output.Addresses {
+			if a == address {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Call fn for each block matching filter, in height order. With an
+// address, pruned blocks and blocks without matching transaction are
+// skipped.
+func (bc *Blockchain) ExportBlocks(filter ExportFilter, fn func(e *ExportBlock) error) error {
+	to := filter.To
+	if to >= uint64(len(bc.blocks)) {
+		to = uint64(len(bc.blocks)) - 1
+	}
+
+	for height := filter.From; height <= to && height < uint64(len(bc.blocks)); height++ {
+		b := bc.blocks[height]
+
+		e := &ExportBlock{
+			Height:    b.index,
+			Hash:      hex.EncodeToString(b.hash),
+			LastHash:  hex.EncodeToString(b.last_hash),
+			Timestamp: b.timestamp,
+			Pruned:    height < bc.pruned,
+			Txns:      []ExportTxn{},
+		}
+
+		for i, txn := range b.txns {
+			etxn := bc.exportTransaction(txn, i)
+			if filter.Address != "" && !etxn.hasAddress(filter.Address) {
+				continue
+			}
+
+			e.Txns = append(e.Txns, etxn)
+		}
+
+		if filter.Address != "" && len(e.Txns) == 0 {
+			continue
+		}
+
+		err := fn(e)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (bc *Blockchain) ExportJSON(w io.Writer, filter ExportFilter) error {
+	encoder := json.NewEncoder(w)
+
+	return bc.ExportBlocks(filter, func(e *ExportBlock) error {
+		return encoder.Encode(e)
+	})
+}
+
+// Write blocks.csv, transactions.csv, inputs.csv and outputs.csv in dir.
+// Addresses are separated by spaces, unknown amounts are empty.
+func (bc *Blockchain) ExportCSV(dir string, filter ExportFilter) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	tables := []struct {
+		name    string
+		columns []string
+	}{
+		{"blocks", []string{"height", "hash", "last_hash", "timestamp", "pruned", "txns"}},
+		{"transactions", []string{"txhash", "height", "position", "timestamp", "locktime", "inputs", "outputs"}},
+		{"inputs", []string{"txhash", "input_id", "prev_txhash", "prev_output_id", "sequence", "amount", "addresses", "script"}},
+		{"outputs", []string{"txhash", "output_id", "type", "amount", "addresses", "script"}},
+	}
+
+	writers := make([]*csv.Writer, len(tables))
+	for i, table := range tables {
+		fd, err := os.Create(filepath.Join(dir, table.name+".csv"))
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+
+		writers[i] = csv.NewWriter(fd)
+		writers[i].Write(table.columns)
+	}
+
+	blocks, txns, inputs, outputs := writers[0], writers[1], writers[2], writers[3]
+
+	u := func(value uint64) string {
+		return strconv.FormatUint(value, 10)
+	}
+	f := func(value float64) string {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+
+	err = bc.ExportBlocks(filter, func(e *ExportBlock) error {
+		err := blocks.Write([]string{u(e.Height), e.Hash, e.LastHash, u(e.Timestamp), strconv.FormatBool(e.Pruned), strconv.Itoa(len(e.Txns))})
+		if err != nil {
+			return err
+		}
+
+		for _, txn := range e.Txns {
+			err = txns.Write([]string{txn.Hash, u(e.Height), strconv.Itoa(txn.Position), u(txn.Timestamp), u(txn.Locktime), strconv.Itoa(len(txn.Inputs)), strconv.Itoa(len(txn.Outputs))})
+			if err != nil {
+				return err
+			}
+
+			for _, input := range txn.Inputs {
+				amount := ""
+				if input.Amount != nil {
+					amount = f(*input.Amount)
+				}
+
+				err = inputs.Write([]string{txn.Hash, strconv.Itoa(input.Id), input.PrevTxHash, u(uint64(input.PrevOutputId)), u(uint64(input.Sequence)), amount, strings.Join(input.Addresses, " "), input.Script})
+				if err != nil {
+					return err
+				}
+			}
+
+			for _, output := range txn.Outputs {
+				err = outputs.Write([]string{txn.Hash, strconv.Itoa(output.Id), output.Type, f(output.Amount), strings.Join(output.Addresses, " "), output.Script})
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, writer := range writers {
+		writer.Flush()
+
+		err = writer.Error()
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s.csv: %s", tables[i].name, err))
+		}
+	}
+
+	return nil
+}
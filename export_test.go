@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportJSON(t *testing.T) {
+	bc := CreateBlockchain()
+	w1 := CreateTestingWallet()
+	w2 := CreateTestingWallet()
+	addr2 := GetPublicKeyHash(w2.PrivateKeys[0].PublicKey)
+
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	TransferFund(bc, w1, w2, 30)
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	buffer := new(bytes.Buffer)
+
+	err := bc.ExportJSON(buffer, ExportFilter{To: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := json.NewDecoder(buffer)
+	blocks := []ExportBlock{}
+	for decoder.More() {
+		var e ExportBlock
+
+		err = decoder.Decode(&e)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		blocks = append(blocks, e)
+	}
+
+	if len(blocks) != 3 {
+		t.Fatalf("Invalid exported blocks: %d", len(blocks))
+	}
+
+	transfer := blocks[1].Txns[1]
+	if transfer.Hash != hex.EncodeToString(bc.blocks[1].txns[1].hash) {
+		t.Errorf("Invalid transaction: %s", transfer.Hash)
+	}
+
+	// Spent amount is resolved
+	if transfer.Inputs[0].Amount == nil || *transfer.Inputs[0].Amount != 100 {
+		t.Errorf("Input amount not resolved: %v", transfer.Inputs[0].Amount)
+	}
+
+	if transfer.Outputs[0].Type != SCRIPT_P2PKH || transfer.Outputs[0].Addresses[0] != addr2 || transfer.Outputs[0].Amount != 30 {
+		t.Errorf("Invalid output: %v", transfer.Outputs[0])
+	}
+
+	// Only transfer pays address 2
+	buffer.Reset()
+
+	err = bc.ExportJSON(buffer, ExportFilter{To: 10, Address: addr2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var e ExportBlock
+	err = json.NewDecoder(buffer).Decode(&e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Height != 1 || len(e.Txns) != 1 || buffer.Len() > 1 {
+		t.Errorf("Invalid address filter: block %d, %d transactions", e.Height, len(e.Txns))
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	bc := CreateBlockchain()
+	w1 := CreateTestingWallet()
+	w2 := CreateTestingWallet()
+
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	TransferFund(bc, w1, w2, 30)
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	dir := t.TempDir()
+
+	err := bc.ExportCSV(dir, ExportFilter{From: 1, To: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Header, then rows of block 1
+	for name, rows := range map[string]int{"blocks": 2, "transactions": 3, "inputs": 2, "outputs": 4} {
+		fd, err := os.Open(filepath.Join(dir, name+".csv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		records, err := csv.NewReader(fd).ReadAll()
+		fd.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(records) != rows {
+			t.Errorf("%s: %d rows, expected %d", name, len(records), rows)
+		}
+	}
+}
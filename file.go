@@ -2,11 +2,79 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"math"
 	"os"
+	"path/filepath"
 )
 
-func WriteUint32ToFd(fd *os.File, i uint32) error {
+// Records start with magic, payload size and payload checksum.
+const (
+	RECORD_MAGIC       = 0x53544331 // "STC1"
+	RECORD_HEADER_SIZE = 12
+	MAX_RECORD_SIZE    = 32 * 1024 * 1024
+)
+
+var ErrTruncatedRecord = errors.New("Truncated record")
+
+// Chain formats. First one is a single .blocks.dat file without header,
+// with fixed size integers. Later files start with a magic and the format
+// version they were written with. Since version 2, index entries hold
+// block headers, so blocks can be pruned. Since version 3, transactions
+// start with their version.
+const (
+	CHAIN_FORMAT_LEGACY      = 0
+	CHAIN_FORMAT_HEADERS     = 2
+	CHAIN_FORMAT_TXN_VERSION = 3
+	CHAIN_FORMAT_VERSION     = 3
+
+	FILE_HEADER_SIZE = 8
+	BLOCK_FILE_MAGIC = 0x53544342 // "STCB"
+	INDEX_FILE_MAGIC = 0x53544349 // "STCI"
+	META_FILE_MAGIC  = 0x5354434d // "STCM"
+	UTXO_FILE_MAGIC  = 0x53544355 // "STCU"
+	TXIDX_FILE_MAGIC = 0x53544358 // "STCX"
+)
+
+func WriteFileHeader(fd io.Writer, magic uint32) error {
+	err := WriteUint32ToFd(fd, magic)
+	if err != nil {
+		return err
+	}
+
+	return WriteUint32ToFd(fd, CHAIN_FORMAT_VERSION)
+}
+
+// Returns format version. Files written by a newer version are rejected.
+func ReadFileHeader(fd io.Reader, magic uint32) (uint32, error) {
+	value, err := ReadUint32FromFd(fd)
+	if err != nil {
+		return 0, err
+	}
+
+	if value != magic {
+		return 0, errors.New(fmt.Sprintf("Invalid file magic 0x%08x", value))
+	}
+
+	version, err := ReadUint32FromFd(fd)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if version > CHAIN_FORMAT_VERSION {
+		return 0, errors.New(fmt.Sprintf("Format version %d is newer than supported one (%d)", version, CHAIN_FORMAT_VERSION))
+	}
+
+	return version, nil
+}
+
+func WriteUint32ToFd(fd io.Writer, i uint32) error {
 	buffer := make([]byte, 4)
 
 	// Write last_index
@@ -16,7 +84,7 @@ func WriteUint32ToFd(fd *os.File, i uint32) error {
 	return err
 }
 
-func WriteUint64ToFd(fd *os.File, i uint64) error {
+func WriteUint64ToFd(fd io.Writer, i uint64) error {
 	buffer := make([]byte, 8)
 
 	// Write last_index
@@ -26,17 +94,20 @@ func WriteUint64ToFd(fd *os.File, i uint64) error {
 	return err
 }
 
-func WriteBytesToFd(fd *os.File, bytes []byte) error {
+func WriteBytesToFd(fd io.Writer, bytes []byte) error {
 	// Write size of bytes
-	WriteUint32ToFd(fd, uint32(len(bytes)))
+	err := WriteUint32ToFd(fd, uint32(len(bytes)))
+	if err != nil {
+		return err
+	}
 
 	// Writes bytes
-	_, err := fd.Write(bytes)
+	_, err = fd.Write(bytes)
 
 	return err
 }
 
-func WriteFloat64ToFd(fd *os.File, f float64) error {
+func WriteFloat64ToFd(fd io.Writer, f float64) error {
 	bits := math.Float64bits(f)
 	buffer := make([]byte, 8)
 	binary.LittleEndian.PutUint64(buffer, bits)
@@ -46,10 +117,12 @@ func WriteFloat64ToFd(fd *os.File, f float64) error {
 	return err
 }
 
-func ReadUint64FromFd(fd *os.File) (uint64, error) {
+// Returns io.EOF if nothing is left, io.ErrUnexpectedEOF if value is
+// truncated.
+func ReadUint64FromFd(fd io.Reader) (uint64, error) {
 	buffer := make([]byte, 8)
 
-	_, err := fd.Read(buffer)
+	_, err := io.ReadFull(fd, buffer)
 	if err != nil {
 		return 0, err
 	}
@@ -57,10 +130,10 @@ func ReadUint64FromFd(fd *os.File) (uint64, error) {
 	return binary.LittleEndian.Uint64(buffer), nil
 }
 
-func ReadUint32FromFd(fd *os.File) (uint32, error) {
+func ReadUint32FromFd(fd io.Reader) (uint32, error) {
 	buffer := make([]byte, 4)
 
-	_, err := fd.Read(buffer)
+	_, err := io.ReadFull(fd, buffer)
 	if err != nil {
 		return 0, err
 	}
@@ -68,15 +141,22 @@ func ReadUint32FromFd(fd *os.File) (uint32, error) {
 	return binary.LittleEndian.Uint32(buffer), nil
 }
 
-func ReadBytesFromFd(fd *os.File) ([]byte, error) {
+func ReadBytesFromFd(fd io.Reader) ([]byte, error) {
 	i, err := ReadUint32FromFd(fd)
 	if err != nil {
 		return nil, err
 	}
 
+	if i > MAX_RECORD_SIZE {
+		return nil, errors.New(fmt.Sprintf("Data too large (%d bytes)", i))
+	}
+
 	buffer := make([]byte, i)
 
-	_, err = fd.Read(buffer)
+	_, err = io.ReadFull(fd, buffer)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -84,7 +164,7 @@ func ReadBytesFromFd(fd *os.File) ([]byte, error) {
 	return buffer, nil
 }
 
-func ReadFloat64FromFd(fd *os.File) (float64, error) {
+func ReadFloat64FromFd(fd io.Reader) (float64, error) {
 	i, err := ReadUint64FromFd(fd)
 	if err != nil {
 		return 0, err
@@ -94,3 +174,94 @@ func ReadFloat64FromFd(fd *os.File) (float64, error) {
 
 	return f, nil
 }
+
+// Write record in a single call.
+func WriteRecord(fd io.Writer, payload []byte) error {
+	buffer := make([]byte, RECORD_HEADER_SIZE+len(payload))
+
+	binary.LittleEndian.PutUint32(buffer[0:4], RECORD_MAGIC)
+	binary.LittleEndian.PutUint32(buffer[4:8], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buffer[8:12], crc32.ChecksumIEEE(payload))
+	copy(buffer[RECORD_HEADER_SIZE:], payload)
+
+	_, err := fd.Write(buffer)
+
+	return err
+}
+
+// Read record payload. Returns io.EOF if nothing is left,
+// ErrTruncatedRecord if record is incomplete.
+func ReadRecord(fd io.Reader) ([]byte, error) {
+	header := make([]byte, RECORD_HEADER_SIZE)
+
+	_, err := io.ReadFull(fd, header)
+	if err == io.ErrUnexpectedEOF {
+		return nil, ErrTruncatedRecord
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint32(header[0:4]) != RECORD_MAGIC {
+		return nil, errors.New("Invalid record magic")
+	}
+
+	size := binary.LittleEndian.Uint32(header[4:8])
+	if size > MAX_RECORD_SIZE {
+		return nil, errors.New(fmt.Sprintf("Record too large (%d bytes)", size))
+	}
+
+	payload := make([]byte, size)
+
+	_, err = io.ReadFull(fd, payload)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrTruncatedRecord
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[8:12]) {
+		return nil, errors.New("Invalid record checksum")
+	}
+
+	return payload, nil
+}
+
+// Make a created, renamed or removed file entry durable.
+func SyncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	return fd.Sync()
+}
+
+// Replace file content: either old or new content is found after a crash.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+
+	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = fd.Write(data)
+	if err == nil {
+		err = fd.Sync()
+	}
+	fd.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+
+	return SyncDir(filepath.Dir(path))
+}
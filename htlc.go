@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Hash time-locked contract: funds can be claimed by recipient revealing
+// the preimage of hash, or refunded to sender once locktime is reached.
+type HTLC struct {
+	hash      []byte
+	recipient []byte
+	refund    []byte
+	locktime  uint64
+}
+
+// Output script, recipient and refund branches end with a P2PKH script:
+// OP_IF OP_HASH_SHA256 <hash> OP_EQUAL OP_DUP OP_HASH_KEY <recipient> OP_EQUAL OP_CHECKSIG
+// OP_ELSE <locktime> OP_CHECKLOCKTIMEVERIFY OP_DUP OP_HASH_KEY <refund> OP_EQUAL OP_CHECKSIG
+// OP_ENDIF
+func BuildHTLCScript(hash []byte, recipient []byte, refund []byte, locktime uint32) *Script {
+	s := new(Script)
+
+	s.addInstruction(OP_IF)
+	s.addInstruction(OP_HASH_SHA256)
+	s.addPushBytes(hash)
+	s.addInstruction(OP_EQUAL)
+	s.addBytes(BuildP2PKHScript(recipient).data)
+
+	s.addInstruction(OP_ELSE)
+	s.addPushNumber(locktime)
+	s.addInstruction(OP_CHECKLOCKTIMEVERIFY)
+	s.addBytes(BuildP2PKHScript(refund).data)
+
+	s.addInstruction(OP_ENDIF)
+
+	return s
+}
+
+func ParseHTLCScript(script *Script) (*HTLC, bool) {
+	var ok bool
+	var idx int
+	var locktime []byte
+	htlc := new(HTLC)
+
+	// OP_IF OP_HASH_SHA256
+	htlc.hash, idx, ok = script.readPush(2)
+	if !ok {
+		return nil, false
+	}
+
+	// OP_EQUAL OP_DUP OP_HASH_KEY
+	htlc.recipient, idx, ok = script.readPush(idx + 3)
+	if !ok {
+		return nil, false
+	}
+
+	// OP_EQUAL OP_CHECKSIG OP_ELSE
+	locktime, idx, ok = script.readPush(idx + 3)
+	if !ok {
+		return nil, false
+	}
+
+	// OP_CHECKLOCKTIMEVERIFY OP_DUP OP_HASH_KEY
+	htlc.refund, _, ok = script.readPush(idx + 3)
+	if !ok {
+		return nil, false
+	}
+
+	value, err := StackElemToUint64(locktime)
+	if err != nil || value > 0xffffffff {
+		return nil, false
+	}
+	htlc.locktime = value
+
+	// Check every other instruction
+	control := BuildHTLCScript(htlc.hash, htlc.recipient, htlc.refund, uint32(value))
+	if !bytes.Equal(control.data, script.data) {
+		return nil, false
+	}
+
+	return htlc, true
+}
+
+// Input script: <sig> <pubkey> <preimage> 1
+func BuildHTLCClaimScript(key ecdsa.PrivateKey, output *Script, preimage []byte) (*Script, error) {
+	sign, err := SignMessage(key, output.data)
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(Script)
+	s.addPushBytes(sign)
+	s.addPushBytes(PublicKeyToBytes(key.PublicKey))
+	s.addPushBytes(preimage)
+	s.addPushNumber(1)
+
+	return s, nil
+}
+
+// Input script: <sig> <pubkey> 0
+func BuildHTLCRefundScript(key ecdsa.PrivateKey, output *Script) (*Script, error) {
+	sign, err := SignMessage(key, output.data)
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(Script)
+	s.addPushBytes(sign)
+	s.addPushBytes(PublicKeyToBytes(key.PublicKey))
+	s.addPushNumber(0)
+
+	return s, nil
+}
+
+// Look for the unspent output locked by a HTLC with given hash. Outputs of
+// pruned blocks are read from unspent set.
+func (bc *Blockchain) FindHTLC(hash []byte) (*OutputFund, *HTLC, error) {
+	used_inputs := make(map[string]bool)
+
+	for j := len(bc.blocks) - 1; j >= 0; j-- {
+		for _, tx := range bc.blocks[j].txns {
+			for _, input := range tx.inputs {
+				used_inputs[string(input.txhash)] = true
+			}
+			if _, ok := used_inputs[string(tx.hash)]; ok {
+				continue
+			}
+			for k, output := range tx.outputs {
+				htlc, ok := ParseHTLCScript(output.script)
+				if !ok || !bytes.Equal(htlc.hash, hash) {
+					continue
+				}
+
+				of := new(OutputFund)
+				of.output_id = k
+				of.txn = tx
+
+				return of, htlc, nil
+			}
+		}
+	}
+
+	pruned, err := bc.getPrunedTransactions()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, tx := range pruned {
+		if _, ok := used_inputs[string(tx.hash)]; ok {
+			continue
+		}
+		for k, output := range tx.outputs {
+			if output == nil {
+				continue
+			}
+
+			htlc, ok := ParseHTLCScript(output.script)
+			if !ok || !bytes.Equal(htlc.hash, hash) {
+				continue
+			}
+
+			of := new(OutputFund)
+			of.output_id = k
+			of.txn = tx
+
+			return of, htlc, nil
+		}
+	}
+
+	return nil, nil, errors.New(fmt.Sprintf("No unspent HTLC for hash %x", hash))
+}
+
+// Look for a HTLC claim in chain, returning the revealed preimage of hash.
+func (bc *Blockchain) FindHTLCPreimage(hash []byte) ([]byte, error) {
+	for _, b := range bc.blocks {
+		for _, tx := range b.txns {
+			for _, input := range tx.inputs {
+				for idx := 0; idx < len(input.script.data); {
+					elem, next, ok := input.script.readPush(idx)
+					if !ok {
+						break
+					}
+					idx = next
+
+					h := sha256.Sum256(elem)
+					if bytes.Equal(h[:], hash) {
+						return elem, nil
+					}
+				}
+			}
+		}
+	}
+
+	return nil, errors.New(fmt.Sprintf("No preimage revealed for hash %x%s", hash, bc.prunedNote()))
+}
+
+// Claim HTLC funds locked with sha256(preimage), using wallet recipient key.
+func (bc *Blockchain) CreateHTLCClaimTransaction(wallet *Wallet, preimage []byte) (*Transaction, error) {
+	hash := sha256.Sum256(preimage)
+
+	fund, htlc, err := bc.FindHTLC(hash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := wallet.GetPrivateKeyByHash(string(htlc.recipient))
+	if err != nil {
+		return nil, err
+	}
+
+	script, err := BuildHTLCClaimScript(key, fund.txn.outputs[fund.output_id].script, preimage)
+	if err != nil {
+		return nil, err
+	}
+
+	return createHTLCSpendTransaction(wallet, fund, key, CreateTxInput(fund.txn.hash, uint32(fund.output_id), script), 0), nil
+}
+
+// Get HTLC funds back once its lock time is reached, using wallet refund key.
+func (bc *Blockchain) CreateHTLCRefundTransaction(wallet *Wallet, hash []byte) (*Transaction, error) {
+	fund, htlc, err := bc.FindHTLC(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := wallet.GetPrivateKeyByHash(string(htlc.refund))
+	if err != nil {
+		return nil, err
+	}
+
+	script, err := BuildHTLCRefundScript(key, fund.txn.outputs[fund.output_id].script)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lock time must be enforced for OP_CHECKLOCKTIMEVERIFY to pass
+	input := CreateTxInput(fund.txn.hash, uint32(fund.output_id), script)
+	input.sequence = 0
+
+	return createHTLCSpendTransaction(wallet, fund, key, input, htlc.locktime), nil
+}
+
+func createHTLCSpendTransaction(wallet *Wallet, fund *OutputFund, key ecdsa.PrivateKey, input *TxInput, locktime uint64) *Transaction {
+	txn := CreateTransaction()
+	txn.locktime = locktime
+	txn.AddInput(input)
+
+	amount := fund.txn.outputs[fund.output_id].amount
+	txn.AddOutput(CreateTxOutput(BuildP2PKHScript([]byte(wallet.Address(key.PublicKey))), amount))
+
+	// Copy other outputs
+	for i, output := range fund.txn.outputs {
+		if fund.output_id != i && output != nil && !output.script.IsUnspendable() {
+			txn.AddOutput(output)
+		}
+	}
+
+	txn.ComputeHash(true)
+
+	return txn
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+
+	"bytes"
+	"testing"
+)
+
+func HasFund(bc *Blockchain, wallet *Wallet, txn *Transaction, amount float64) bool {
+	funds, err := bc.GetFunds(wallet)
+	if err != nil {
+		return false
+	}
+
+	for _, fund := range funds {
+		if bytes.Equal(fund.txn.hash, txn.hash) && fund.txn.outputs[fund.output_id].amount == amount {
+			return true
+		}
+	}
+
+	return false
+}
+
+func LockHTLC(t *testing.T, bc *Blockchain, from *Wallet, to *Wallet, hash []byte, amount float64, locktime uint32) {
+	script := BuildHTLCScript(hash,
+		[]byte(GetPublicKeyHash(to.PrivateKeys[0].PublicKey)),
+		[]byte(GetPublicKeyHash(from.PrivateKeys[0].PublicKey)),
+		locktime)
+
+	txn, err := bc.CreateScriptTransaction(from, script, amount)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bc.QueueTransaction(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc.MineBlock(from.PrivateKeys[0].PublicKey)
+}
+
+func TestHTLCScript(t *testing.T) {
+	hash := sha256.Sum256([]byte("secret"))
+	script := BuildHTLCScript(hash[:], []byte("recipient"), []byte("refund"), 1000)
+
+	htlc, ok := ParseHTLCScript(script)
+	if !ok {
+		t.Fatal("Could not parse HTLC script")
+	}
+
+	if !bytes.Equal(htlc.hash, hash[:]) || string(htlc.recipient) != "recipient" || string(htlc.refund) != "refund" || htlc.locktime != 1000 {
+		t.Error("Invalid HTLC parsed")
+	}
+
+	_, ok = ParseHTLCScript(BuildP2PKHScript([]byte("recipient")))
+	if ok {
+		t.Error("P2PKH script should not be parsed as HTLC")
+	}
+}
+
+// Alice swaps 30 coins on chain A against 20 coins of Bob on chain B.
+func TestHTLCAtomicSwap(t *testing.T) {
+	alice := CreateTestingWallet()
+	bob := CreateTestingWallet()
+
+	chainA := CreateBlockchain()
+	chainA.MineBlock(alice.PrivateKeys[0].PublicKey)
+
+	chainB := CreateBlockchain()
+	chainB.MineBlock(bob.PrivateKeys[0].PublicKey)
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	hash := sha256.Sum256(secret)
+
+	// Alice locks first, with the longest timeout
+	LockHTLC(t, chainA, alice, bob, hash[:], 30, 20)
+
+	_, htlc, err := chainA.FindHTLC(hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(htlc.recipient) != GetPublicKeyHash(bob.PrivateKeys[0].PublicKey) {
+		t.Error("Invalid HTLC recipient")
+	}
+
+	LockHTLC(t, chainB, bob, alice, hash[:], 20, 10)
+
+	// A wrong preimage can't unlock funds
+	_, err = chainB.CreateHTLCClaimTransaction(alice, []byte("wrong"))
+	if err == nil {
+		t.Error("Claim with wrong preimage should fail")
+	}
+
+	// Alice claims on chain B, revealing secret
+	txn, err := chainB.CreateHTLCClaimTransaction(alice, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = chainB.QueueTransaction(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainB.MineBlock(bob.PrivateKeys[0].PublicKey)
+
+	if !HasFund(chainB, alice, txn, 20) {
+		t.Error("Alice did not get her funds on chain B")
+	}
+
+	// Bob learns secret from chain B, and claims on chain A
+	preimage, err := chainB.FindHTLCPreimage(hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txn, err = chainA.CreateHTLCClaimTransaction(bob, preimage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = chainA.QueueTransaction(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainA.MineBlock(alice.PrivateKeys[0].PublicKey)
+
+	if !HasFund(chainA, bob, txn, 30) {
+		t.Error("Bob did not get his funds on chain A")
+	}
+
+	// Contracts are spent
+	_, _, err = chainA.FindHTLC(hash[:])
+	if err == nil {
+		t.Error("HTLC on chain A should be spent")
+	}
+
+	_, err = chainB.CreateHTLCRefundTransaction(bob, hash[:])
+	if err == nil {
+		t.Error("HTLC on chain B should be spent")
+	}
+}
+
+// Bob never locks his side: Alice gets her funds back after timeout.
+func TestHTLCRefund(t *testing.T) {
+	alice := CreateTestingWallet()
+	bob := CreateTestingWallet()
+
+	chainA := CreateBlockchain()
+	chainA.MineBlock(alice.PrivateKeys[0].PublicKey)
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	hash := sha256.Sum256(secret)
+
+	LockHTLC(t, chainA, alice, bob, hash[:], 30, 4)
+
+	// Only recipient can claim
+	_, err := chainA.CreateHTLCClaimTransaction(alice, secret)
+	if err == nil {
+		t.Error("Claim without recipient key should fail")
+	}
+
+	txn, err := chainA.CreateHTLCRefundTransaction(alice, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Too early
+	err = chainA.QueueTransaction(txn)
+	if err == nil {
+		t.Error("Refund should be locked")
+	}
+
+	for len(chainA.blocks) <= 4 {
+		chainA.MineBlock(alice.PrivateKeys[0].PublicKey)
+	}
+
+	err = chainA.QueueTransaction(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainA.MineBlock(alice.PrivateKeys[0].PublicKey)
+
+	if !HasFund(chainA, alice, txn, 30) {
+		t.Error("Alice did not get her funds back")
+	}
+
+	// Bob can't claim anymore
+	_, err = chainA.CreateHTLCClaimTransaction(bob, secret)
+	if err == nil {
+		t.Error("Claim after refund should fail")
+	}
+}
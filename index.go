@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Optional chain indexes, enabled by `txindex` in configuration: transaction
+// hash to its block and position, and address to outputs paying it and
+// inputs spending them. Indexes follow blocks as they are connected and
+// disconnected, and are saved as store index records.
+type TxLocation struct {
+	height   uint64
+	position uint32
+}
+
+// Payment to an address, or spend of one of its outputs.
+type AddressEntry struct {
+	height uint64
+	txhash []byte
+	id     uint32 // Output id, or input id of a spend
+	amount float64
+	spend  bool
+}
+
+type ChainIndex struct {
+	count     uint64 // Indexed blocks
+	tip       []byte
+	txs       map[string]TxLocation
+	addresses map[string][]*AddressEntry
+	params    *NetworkParams // Network of addresses, main if nil
+
+	// Records to write on next save
+	changed_txs       map[string]bool
+	changed_addresses map[string]bool
+	saved             bool // Stored records are this index ones
+}
+
+func CreateChainIndex() *ChainIndex {
+	index := new(ChainIndex)
+	index.txs = make(map[string]TxLocation)
+	index.addresses = make(map[string][]*AddressEntry)
+	index.changed_txs = make(map[string]bool)
+	index.changed_addresses = make(map[string]bool)
+
+	return index
+}
+
+// Addresses an output script pays to. Data carriers and non standard
+// scripts have none.
+func GetScriptAddresses(script *Script, params *NetworkParams) []string {
+	switch GetScriptTemplate(script) {
+	case SCRIPT_P2PK:
+		key, _, _ := script.readPush(0)
+		pk, err := GetPublicKeyFromBytes(key)
+		if err != nil {
+			return nil
+		}
+
+		return []string{GetAddress(pk, params)}
+
+	case SCRIPT_P2PKH:
+		// OP_DUP OP_HASH_KEY
+		hash, _, _ := script.readPush(2)
+		return []string{string(hash)}
+
+	case SCRIPT_MULTISIG:
+		addresses := []string{}
+
+		// m, keys, n
+		_, idx, _ := script.readPush(0)
+		for {
+			key, next, _ := script.readPush(idx)
+			_, _, ok := script.readPush(next)
+			if !ok {
+				break
+			}
+
+			pk, err := GetPublicKeyFromBytes(key)
+			if err != nil {
+				return nil
+			}
+
+			addresses = append(addresses, GetAddress(pk, params))
+			idx = next
+		}
+
+		return addresses
+
+	case SCRIPT_HTLC:
+		htlc, _ := ParseHTLCScript(script)
+		return []string{string(htlc.recipient), string(htlc.refund)}
+	}
+
+	return nil
+}
+
+// Index next block. Spent transactions are found with find, they are
+// either in previous blocks or earlier in this one.
+func (index *ChainIndex) ConnectBlock(b *Block, find func(hash []byte) (*Transaction, error)) error {
+	if b.index != index.count {
+		return errors.New(fmt.Sprintf("Block %d is not next indexed block (%d)", b.index, index.count))
+	}
+
+	for position, txn := range b.txns {
+		index.txs[string(txn.hash)] = TxLocation{height: b.index, position: uint32(position)}
+		index.changed_txs[string(txn.hash)] = true
+
+		for i, input := range txn.inputs {
+			prev, err := find(input.txhash)
+			if err != nil {
+				return err
+			}
+
+			outputs, ok := input.spentOutputs(prev)
+			if !ok {
+				return errors.New(fmt.Sprintf("Invalid output %d for transaction %x", input.output_id, input.txhash))
+			}
+
+			for _, output := range outputs {
+				for _, address := range GetScriptAddresses(output.script, index.params) {
+					index.addresses[address] = append(index.addresses[address], &AddressEntry{
+						height: b.index,
+						txhash: txn.hash,
+						id:     uint32(i),
+						amount: output.amount,
+						spend:  true,
+					})
+					index.changed_addresses[address] = true
+				}
+			}
+		}
+
+		for i, output := range txn.outputs {
+			for _, address := range GetScriptAddresses(output.script, index.params) {
+				index.addresses[address] = append(index.addresses[address], &AddressEntry{
+					height: b.index,
+					txhash: txn.hash,
+					id:     uint32(i),
+					amount: output.amount,
+				})
+				index.changed_addresses[address] = true
+			}
+		}
+	}
+
+	index.count++
+	index.tip = b.hash
+
+	return nil
+}
+
+// Remove last indexed block.
+func (index *ChainIndex) DisconnectBlock(b *Block, find func(hash []byte) (*Transaction, error)) error {
+	if index.count == 0 || !bytes.Equal(b.hash, index.tip) {
+		return errors.New(fmt.Sprintf("Block %x is not last indexed block", b.hash))
+	}
+
+	// Addresses this block may have touched
+	touched := make(map[string]bool)
+
+	for _, txn := range b.txns {
+		// Same hash may be indexed by a later block
+		location, ok := index.txs[string(txn.hash)]
+		if ok && location.height == b.index {
+			delete(index.txs, string(txn.hash))
+			index.changed_txs[string(txn.hash)] = true
+		}
+
+		for _, output := range txn.outputs {
+			for _, address := range GetScriptAddresses(output.script, index.params) {
+				touched[address] = true
+			}
+		}
+	}
+
+	for _, txn := range b.txns {
+		for _, input := range txn.inputs {
+			prev, err := find(input.txhash)
+			if err != nil {
+				continue
+			}
+
+			outputs, _ := input.spentOutputs(prev)
+			for _, output := range outputs {
+				for _, address := range GetScriptAddresses(output.script, index.params) {
+					touched[address] = true
+				}
+			}
+		}
+	}
+
+	for address := range touched {
+		index.changed_addresses[address] = true
+
+		entries := []*AddressEntry{}
+		for _, entry := range index.addresses[address] {
+			if entry.height != b.index {
+				entries = append(entries, entry)
+			}
+		}
+
+		if len(entries) == 0 {
+			delete(index.addresses, address)
+		} else {
+			index.addresses[address] = entries
+		}
+	}
+
+	index.count--
+	index.tip = b.last_hash
+
+	return nil
+}
+
+// Index transaction at an earlier location, once its later copy is
+// disconnected.
+func (index *ChainIndex) relocateTransaction(hash []byte, location TxLocation) {
+	index.txs[string(hash)] = location
+	index.changed_txs[string(hash)] = true
+}
+
+func (index *ChainIndex) FindTransaction(hash []byte) (TxLocation, bool) {
+	location, ok := index.txs[string(hash)]
+
+	return location, ok
+}
+
+// Entries of an address, by block.
+func (index *ChainIndex) GetAddressHistory(address string) []*AddressEntry {
+	return index.addresses[address]
+}
+
+// Index records, by key: one per transaction, giving its location, and
+// one per address, giving its entries.
+const (
+	INDEX_TX_PREFIX      = "tx:"
+	INDEX_ADDRESS_PREFIX = "addr:"
+)
+
+// Write records changed since last save, replacing all stored ones for a
+// new index, then indexed blocks count in metadata. Records of blocks
+// after that count, written by an interrupted save, are ignored when
+// loading.
+func (index *ChainIndex) Save(store ChainStore) error {
+	records := make(map[string][]byte)
+
+	// Records of disconnected entries are removed
+	for hash := range index.changed_txs {
+		location, ok := index.txs[hash]
+		if !ok {
+			records[INDEX_TX_PREFIX+hash] = nil
+			continue
+		}
+
+		records[INDEX_TX_PREFIX+hash] = encodeTxLocation(location)
+	}
+
+	for address := range index.changed_addresses {
+		if _, ok := index.addresses[address]; !ok {
+			records[INDEX_ADDRESS_PREFIX+address] = nil
+			continue
+		}
+
+		data := new(bytes.Buffer)
+
+		err := encodeAddressEntries(data, index.addresses[address])
+		if err != nil {
+			return err
+		}
+
+		records[INDEX_ADDRESS_PREFIX+address] = data.Bytes()
+	}
+
+	err := store.PutIndexRecords(records, !index.saved)
+	if err != nil {
+		return err
+	}
+
+	data, err := index.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	err = store.PutMeta("txindex", data)
+	if err != nil {
+		return err
+	}
+
+	index.changed_txs = make(map[string]bool)
+	index.changed_addresses = make(map[string]bool)
+	index.saved = true
+
+	return nil
+}
+
+// Returns nil if no index was saved.
+func LoadChainIndex(store ChainStore, params *NetworkParams) (*ChainIndex, error) {
+	data, err := store.GetMeta("txindex")
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	index := CreateChainIndex()
+	index.params = params
+	index.saved = true
+
+	err = index.UnmarshalBinary(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.ForEachIndexRecord(func(key string, value []byte) error {
+		switch {
+		case strings.HasPrefix(key, INDEX_TX_PREFIX):
+			location, err := decodeTxLocation(value)
+			if err != nil {
+				return err
+			}
+
+			if location.height < index.count {
+				index.txs[key[len(INDEX_TX_PREFIX):]] = location
+			}
+
+		case strings.HasPrefix(key, INDEX_ADDRESS_PREFIX):
+			entries, err := decodeAddressEntries(bytes.NewReader(value))
+			if err != nil {
+				return err
+			}
+
+			kept := []*AddressEntry{}
+			for _, entry := range entries {
+				if entry.height < index.count {
+					kept = append(kept, entry)
+				}
+			}
+
+			if len(kept) > 0 {
+				index.addresses[key[len(INDEX_ADDRESS_PREFIX):]] = kept
+			}
+
+		default:
+			return errors.New(fmt.Sprintf("Unknown index record %x", key))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return index, nil
+}
+
+// Indexed blocks count and tip, records are apart.
+func (index *ChainIndex) Encode(w io.Writer) error {
+	err := WriteVarInt(w, index.count)
+	if err != nil {
+		return err
+	}
+
+	return WriteVarBytes(w, index.tip)
+}
+
+func (index *ChainIndex) Decode(r io.Reader) error {
+	var err error
+
+	index.count, err = ReadVarInt(r)
+	if err != nil {
+		return err
+	}
+
+	index.tip, err = ReadVarBytes(r, MAX_HASH_SIZE, "Index tip")
+
+	return err
+}
+
+func (index *ChainIndex) MarshalBinary() ([]byte, error) {
+	return marshalBinary(index)
+}
+
+func (index *ChainIndex) UnmarshalBinary(data []byte) error {
+	return unmarshalBinary(index, data)
+}
+
+func encodeTxLocation(location TxLocation) []byte {
+	data := new(bytes.Buffer)
+	WriteVarInt(data, location.height)
+	WriteVarInt(data, uint64(location.position))
+
+	return data.Bytes()
+}
+
+func decodeTxLocation(data []byte) (TxLocation, error) {
+	var location TxLocation
+	var err error
+
+	r := bytes.NewReader(data)
+
+	location.height, err = ReadVarInt(r)
+	if err != nil {
+		return location, err
+	}
+
+	position, err := ReadBoundedVarInt(r, MAX_BLOCK_TXNS, "Transaction position")
+	if err != nil {
+		return location, err
+	}
+	location.position = uint32(position)
+
+	return location, nil
+}
+
+func encodeAddressEntries(w io.Writer, entries []*AddressEntry) error {
+	err := WriteVarInt(w, uint64(len(entries)))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		err = entry.Encode(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Count is bounded by record size: each entry takes at least a byte.
+func decodeAddressEntries(r io.Reader) ([]*AddressEntry, error) {
+	count, err := ReadBoundedVarInt(r, MAX_RECORD_SIZE, "Address entries")
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*AddressEntry{}
+	for i := uint64(0); i < count; i++ {
+		entry := new(AddressEntry)
+
+		err = entry.Decode(r)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (entry *AddressEntry) Encode(w io.Writer) error {
+	err := WriteVarInt(w, entry.height)
+	if err != nil {
+		return err
+	}
+
+	err = WriteVarBytes(w, entry.txhash)
+	if err != nil {
+		return err
+	}
+
+	err = WriteVarInt(w, uint64(entry.id))
+	if err != nil {
+		return err
+	}
+
+	err = WriteAmount(w, entry.amount)
+	if err != nil {
+		return err
+	}
+
+	spend := uint64(0)
+	if entry.spend {
+		spend = 1
+	}
+
+	return WriteVarInt(w, spend)
+}
+
+func (entry *AddressEntry) Decode(r io.Reader) error {
+	var err error
+
+	entry.height, err = ReadVarInt(r)
+	if err != nil {
+		return err
+	}
+
+	entry.txhash, err = ReadVarBytes(r, MAX_HASH_SIZE, "Transaction hash")
+	if err != nil {
+		return err
+	}
+
+	id, err := ReadBoundedVarInt(r, MAX_TXN_OUTPUTS, "Entry id")
+	if err != nil {
+		return err
+	}
+	entry.id = uint32(id)
+
+	entry.amount, err = ReadAmount(r)
+	if err != nil {
+		return err
+	}
+
+	spend, err := ReadBoundedVarInt(r, 1, "Entry spend flag")
+	if err != nil {
+		return err
+	}
+	entry.spend = spend == 1
+
+	return nil
+}
+
+func (entry *AddressEntry) String() string {
+	if entry.spend {
+		return fmt.Sprintf("%d %x %d -%f", entry.height, entry.txhash, entry.id, entry.amount)
+	}
+
+	return fmt.Sprintf("%d %x %d +%f", entry.height, entry.txhash, entry.id, entry.amount)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestChainIndex(t *testing.T) {
+	w1 := CreateTestingWallet()
+	w2 := CreateTestingWallet()
+	addr1 := GetPublicKeyHash(w1.PrivateKeys[0].PublicKey)
+	addr2 := GetPublicKeyHash(w2.PrivateKeys[0].PublicKey)
+
+	bc := CreateBlockchain()
+	bc.index = CreateChainIndex()
+
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	TransferFund(bc, w1, w2, 40)
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	transfer := bc.blocks[1].txns[1]
+
+	txn, b, err := bc.FindTransaction(transfer.hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if txn != transfer || b.index != 1 {
+		t.Errorf("Invalid transaction found in block %d", b.index)
+	}
+
+	// Received 40 from transfer
+	history, _ := bc.GetAddressHistory(addr2)
+	if len(history) != 1 || history[0].spend || history[0].amount != 40 || !bytes.Equal(history[0].txhash, transfer.hash) {
+		t.Fatalf("Invalid history: %v", history)
+	}
+
+	// Mined two coinbases, spent first one, got change
+	history, _ = bc.GetAddressHistory(addr1)
+	spends := 0
+	for _, entry := range history {
+		if entry.spend {
+			spends++
+		}
+	}
+
+	if spends != 1 {
+		t.Errorf("Invalid spends number: %d", spends)
+	}
+	entries := len(history)
+
+	// Save, then load with index
+	c := Config{Blockchain: t.Name(), Store: STORE_MEMORY, TxIndex: true}
+
+	err = bc.SaveBlockchain(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc2, err := LoadBlockchain(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history, _ = bc2.GetAddressHistory(addr2)
+	if len(history) != 1 || bc2.index.count != 2 {
+		t.Errorf("Invalid loaded index: %d blocks, %v", bc2.index.count, history)
+	}
+
+	// Interrupted save: records of last block are written, not its count
+	behind := &ChainIndex{count: 1, tip: bc.blocks[0].hash}
+	data, _ := behind.MarshalBinary()
+	OpenMemoryStore(c.Blockchain).PutMeta("txindex", data)
+
+	bc2, err = LoadBlockchain(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bc2.index.count != 2 || len(bc2.index.GetAddressHistory(addr2)) != 1 || len(bc2.index.GetAddressHistory(addr1)) != entries {
+		t.Errorf("Index not updated: %d blocks", bc2.index.count)
+	}
+
+	// Only changed records are written
+	key, _ := CreateKeyPair()
+	bc2.MineBlock(key.PublicKey)
+	bc2.SaveBlockchain(c)
+
+	records := 0
+	bc2.store.ForEachIndexRecord(func(key string, value []byte) error {
+		records++
+		return nil
+	})
+
+	if len(bc2.index.changed_txs) != 0 || len(bc2.index.changed_addresses) != 0 || records != len(bc2.index.txs)+len(bc2.index.addresses) {
+		t.Errorf("Invalid saved records: %d", records)
+	}
+
+	// Index of another chain
+	bc2.index.tip = bc2.blocks[0].hash
+	bc2.SaveBlockchain(c)
+
+	_, err = LoadBlockchain(c)
+	if err == nil {
+		t.Error("Stale index loaded.")
+	}
+
+	// Rebuild it
+	c.TxIndex = false
+	bc3, err := LoadBlockchain(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = bc3.GetAddressHistory(addr2)
+	if err == nil {
+		t.Error("Disabled index used.")
+	}
+
+	err = bc3.Reindex()
+	if err == nil {
+		err = bc3.SaveBlockchain(c)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.TxIndex = true
+	bc4, err := LoadBlockchain(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history, _ = bc4.GetAddressHistory(addr2)
+	if len(history) != 1 {
+		t.Errorf("Invalid rebuilt index: %v", history)
+	}
+}
+
+func TestScriptAddresses(t *testing.T) {
+	w1 := CreateTestingWallet()
+	w2 := CreateTestingWallet()
+	addr1 := GetPublicKeyHash(w1.PrivateKeys[0].PublicKey)
+	addr2 := GetPublicKeyHash(w2.PrivateKeys[0].PublicKey)
+	key1 := PublicKeyToBytes(w1.PrivateKeys[0].PublicKey)
+	key2 := PublicKeyToBytes(w2.PrivateKeys[0].PublicKey)
+
+	tests := []struct {
+		script    *Script
+		addresses []string
+	}{
+		{BuildP2PKScript(key1), []string{addr1}},
+		{BuildP2PKHScript([]byte(addr2)), []string{addr2}},
+		{BuildMultisigScript(1, [][]byte{key1, key2}), []string{addr1, addr2}},
+		{BuildHTLCScript(make([]byte, 32), []byte(addr1), []byte(addr2), 10), []string{addr1, addr2}},
+		{BuildDataScript([]byte("data")), nil},
+		// Keys which don't decode
+		{BuildP2PKScript([]byte{0x01, 0x02}), nil},
+		{BuildMultisigScript(1, [][]byte{key1, {0xff, 0xff, 0xff, 0xff}}), nil},
+	}
+
+	for i, test := range tests {
+		addresses := GetScriptAddresses(test.script, nil)
+		if len(addresses) != len(test.addresses) {
+			t.Errorf("%d: Invalid addresses: %v", i, addresses)
+			continue
+		}
+
+		for j := range addresses {
+			if addresses[j] != test.addresses[j] {
+				t.Errorf("%d: Invalid address %d: %s", i, j, addresses[j])
+			}
+		}
+	}
+}
+
+// Outputs with keys which don't decode are not indexed.
+func TestIndexJunkKeys(t *testing.T) {
+	w1 := CreateTestingWallet()
+
+	bc := CreateBlockchain()
+	bc.index = CreateChainIndex()
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	txn := CreateTransaction()
+	txn.AddOutput(CreateTxOutput(BuildP2PKScript([]byte{0x01, 0x02}), 1))
+	txn.AddOutput(CreateTxOutput(BuildMultisigScript(1, [][]byte{{0xff, 0xff, 0xff, 0xff}}), 1))
+	txn.ComputeHash(true)
+	bc.txnQueue = append(bc.txnQueue, txn)
+
+	err := bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := bc.index.FindTransaction(txn.hash); !ok {
+		t.Error("Transaction with junk keys not indexed.")
+	}
+
+	if len(bc.GetLedger(w1)) != 2 {
+		t.Errorf("Invalid ledger: %d entries", len(bc.GetLedger(w1)))
+	}
+}
+
+func TestIndexDisconnectBlock(t *testing.T) {
+	w1 := CreateTestingWallet()
+	w2 := CreateTestingWallet()
+	addr2 := GetPublicKeyHash(w2.PrivateKeys[0].PublicKey)
+
+	records := func(store ChainStore) map[string]string {
+		list := make(map[string]string)
+		store.ForEachIndexRecord(func(key string, value []byte) error {
+			list[key] = string(value)
+			return nil
+		})
+		return list
+	}
+
+	dir := t.TempDir()
+	for _, backend := range []string{STORE_FILE, STORE_KV, STORE_MEMORY} {
+		c := Config{Blockchain: filepath.Join(dir, backend), Store: backend, TxIndex: true}
+
+		bc := CreateBlockchain()
+		bc.index = CreateChainIndex()
+		bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+		err := bc.SaveBlockchain(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved := records(bc.store)
+
+		TransferFund(bc, w1, w2, 40)
+		bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+		transfer := bc.blocks[1].txns[1]
+
+		// Records written ahead of block are removed too
+		err = bc.index.Save(bc.store)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = bc.DisconnectBlock()
+		if err != nil {
+			t.Fatalf("%s: %s", backend, err)
+		}
+
+		if len(bc.blocks) != 1 || bc.last_index != 0 || bc.index.count != 1 || !bytes.Equal(bc.index.tip, bc.blocks[0].hash) {
+			t.Errorf("%s: Block not disconnected: %d blocks", backend, len(bc.blocks))
+		}
+
+		if _, ok := bc.index.FindTransaction(transfer.hash); ok || len(bc.index.GetAddressHistory(addr2)) != 0 {
+			t.Errorf("%s: Disconnected transaction still indexed", backend)
+		}
+
+		if len(bc.txnQueue) != 1 || bc.txnQueue[0] != transfer {
+			t.Errorf("%s: Transaction not queued again", backend)
+		}
+
+		err = bc.SaveBlockchain(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		after := records(bc.store)
+		if len(after) != len(saved) {
+			t.Errorf("%s: %d records, expected %d", backend, len(after), len(saved))
+		}
+		for key, value := range saved {
+			if after[key] != value {
+				t.Errorf("%s: Record %s not restored", backend, key)
+			}
+		}
+
+		// Stored blocks stay
+		err = bc.DisconnectBlock()
+		if err == nil {
+			t.Errorf("%s: Stored block disconnected", backend)
+		}
+		bc.Close()
+
+		bc2, err := LoadBlockchain(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(bc2.blocks) != 1 || bc2.index.count != 1 || len(bc2.index.GetAddressHistory(addr2)) != 0 {
+			t.Errorf("%s: Invalid loaded index: %d blocks", backend, bc2.index.count)
+		}
+
+		// Connected again
+		bc2.txnQueue = bc.txnQueue
+		bc2.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+		if _, ok := bc2.index.FindTransaction(transfer.hash); !ok || len(bc2.index.GetAddressHistory(addr2)) != 1 {
+			t.Errorf("%s: Transaction not indexed again", backend)
+		}
+		bc2.Close()
+	}
+}
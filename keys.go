@@ -6,8 +6,10 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 
+	"bytes"
 	"encoding/binary"
-	// "fmt"
+	"errors"
+	"fmt"
 	"io"
 	"math/big"
 	"os"
@@ -32,9 +34,20 @@ func CreateKeyPairInt(reader io.Reader) (*ecdsa.PrivateKey, error) {
 	return key, nil
 }
 
+// Main network address of key.
 func GetPublicKeyHash(key ecdsa.PublicKey) string {
+	return GetAddress(key, &MainNetParams)
+}
+
+// Address of key on network (main if nil): base58 of version byte, key
+// hash and checksum.
+func GetAddress(key ecdsa.PublicKey, params *NetworkParams) string {
 	var pk []byte
 
+	if params == nil {
+		params = &MainNetParams
+	}
+
 	pk = append(pk, 0x04)
 
 	pk = append(pk, key.X.Bytes()...)
@@ -46,7 +59,7 @@ func GetPublicKeyHash(key ecdsa.PublicKey) string {
 	h.Write(s[:])
 	r := h.Sum(nil)
 
-	pk = []byte{16}
+	pk = []byte{params.AddressVersion}
 	pk = append(pk, r...)
 
 	s = sha256.Sum256(pk)
@@ -58,6 +71,37 @@ func GetPublicKeyHash(key ecdsa.PublicKey) string {
 	return base58.Encode(pk)
 }
 
+// Key hash of address, checking its checksum and that it belongs to
+// network (main if nil).
+func DecodeAddress(address string, params *NetworkParams) ([]byte, error) {
+	if params == nil {
+		params = &MainNetParams
+	}
+
+	pk := base58.Decode(address)
+	if len(pk) != 1+ripemd160.Size+4 {
+		return nil, errors.New(fmt.Sprintf("Invalid address %q: not a base58 key hash", address))
+	}
+
+	s := sha256.Sum256(pk[:len(pk)-4])
+	s = sha256.Sum256(s[:])
+	if !bytes.Equal(s[0:4], pk[len(pk)-4:]) {
+		return nil, errors.New(fmt.Sprintf("Invalid address %q: bad checksum", address))
+	}
+
+	if pk[0] != params.AddressVersion {
+		for _, other := range []*NetworkParams{&MainNetParams, &TestNetParams, &RegTestParams} {
+			if pk[0] == other.AddressVersion {
+				return nil, errors.New(fmt.Sprintf("Invalid address %q: %s network address, not %s", address, other.Name, params.Name))
+			}
+		}
+
+		return nil, errors.New(fmt.Sprintf("Invalid address %q: unknown version %d", address, pk[0]))
+	}
+
+	return pk[1 : len(pk)-4], nil
+}
+
 // Key will be encoded like this:
 // type + len(D) + D + len(x) + X + len(y) + y + hash
 // type is 1 for private key, 2 for public key
@@ -83,16 +127,30 @@ func BytesToPrivateKey(b []byte) (ecdsa.PrivateKey, int, error) {
 	key.Curve = elliptic.P256()
 	idx := 0
 
+	var err error
+
 	// Read Key.D
-	key.D, idx = BytesToBigInt(b, idx)
+	key.D, idx, err = BytesToBigInt(b, idx)
+	if err != nil {
+		return key, 0, err
+	}
 
 	// Read Key.X
-	key.X, idx = BytesToBigInt(b, idx)
+	key.X, idx, err = BytesToBigInt(b, idx)
+	if err != nil {
+		return key, 0, err
+	}
 
 	// Read Key.Y
-	key.Y, idx = BytesToBigInt(b, idx)
+	key.Y, idx, err = BytesToBigInt(b, idx)
+	if err != nil {
+		return key, 0, err
+	}
 
 	// Read hash
+	if len(b)-idx < 4 {
+		return key, 0, errors.New("Truncated private key")
+	}
 	hash := make([]byte, 4)
 	copy(hash, b[idx:idx+4])
 
@@ -115,14 +173,23 @@ func BigIntToBytes(bigInt big.Int) []byte {
 	return append(bs, bigInt.Bytes()...)
 }
 
-func BytesToBigInt(b []byte, idx int) (*big.Int, int) {
+// Read integer at idx, returns it with index after it. Data comes from
+// scripts, so size is checked before slicing.
+func BytesToBigInt(b []byte, idx int) (*big.Int, int, error) {
 	intsize := 4
 	i := new(big.Int)
 
+	if len(b)-idx < intsize {
+		return nil, idx, errors.New("Truncated integer")
+	}
+
 	size := int(binary.LittleEndian.Uint32(b[idx : idx+intsize]))
+	if size > MAX_KEY_INT_SIZE || len(b)-idx-intsize < size {
+		return nil, idx, errors.New(fmt.Sprintf("Invalid integer size %d", size))
+	}
 	i.SetBytes(b[idx+intsize : idx+intsize+size])
 
-	return i, idx + intsize + size
+	return i, idx + intsize + size, nil
 }
 
 func ReadBigIntFromFile(fd *os.File) (*big.Int, error) {
@@ -163,9 +230,14 @@ func SignMessage(key ecdsa.PrivateKey, message []byte) ([]byte, error) {
 	return bytes, nil
 }
 
+// Malformed signatures don't verify.
 func SignVerify(key ecdsa.PublicKey, message []byte, signature []byte) bool {
-	r, idx := BytesToBigInt(signature, 0)
-	s, _ := BytesToBigInt(signature, idx)
+	if checkSignatureEncoding(signature) != nil {
+		return false
+	}
+
+	r, idx, _ := BytesToBigInt(signature, 0)
+	s, _, _ := BytesToBigInt(signature, idx)
 
 	return ecdsa.Verify(&key, message, r, s)
 }
@@ -178,13 +250,114 @@ func PublicKeyToBytes(key ecdsa.PublicKey) []byte {
 	return bytes
 }
 
-func GetPublicKeyFromBytes(bytes []byte) ecdsa.PublicKey {
+// Key must fill bytes, as PublicKeyToBytes writes it.
+func GetPublicKeyFromBytes(bytes []byte) (ecdsa.PublicKey, error) {
 	var idx int
+	var err error
 	var key ecdsa.PublicKey
 
 	key.Curve = elliptic.P256()
-	key.X, idx = BytesToBigInt(bytes, 0)
-	key.Y, idx = BytesToBigInt(bytes, idx)
+	key.X, idx, err = BytesToBigInt(bytes, 0)
+	if err != nil {
+		return ecdsa.PublicKey{}, errors.New(fmt.Sprintf("Invalid public key: %s", err))
+	}
+
+	key.Y, idx, err = BytesToBigInt(bytes, idx)
+	if err != nil {
+		return ecdsa.PublicKey{}, errors.New(fmt.Sprintf("Invalid public key: %s", err))
+	}
+
+	if idx != len(bytes) {
+		return ecdsa.PublicKey{}, errors.New(fmt.Sprintf("Invalid public key: %d trailing bytes", len(bytes)-idx))
+	}
+
+	return key, nil
+}
+
+// Keys with a canonical encoding: integers as big endian byte strings.
+// Public key: X, Y. Private key: D, X, Y.
+type PublicKey ecdsa.PublicKey
+type PrivateKey ecdsa.PrivateKey
+
+func (key *PublicKey) Encode(w io.Writer) error {
+	err := WriteVarBytes(w, key.X.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return WriteVarBytes(w, key.Y.Bytes())
+}
+
+// Point must be on P256 curve.
+func (key *PublicKey) Decode(r io.Reader) error {
+	x, err := ReadVarBytes(r, MAX_KEY_INT_SIZE, "Key X")
+	if err != nil {
+		return err
+	}
+
+	y, err := ReadVarBytes(r, MAX_KEY_INT_SIZE, "Key Y")
+	if err != nil {
+		return err
+	}
+
+	key.Curve = elliptic.P256()
+	key.X = new(big.Int).SetBytes(x)
+	key.Y = new(big.Int).SetBytes(y)
+
+	if !key.Curve.IsOnCurve(key.X, key.Y) {
+		return errors.New("Invalid public key: not on curve")
+	}
+
+	return nil
+}
+
+func (key *PublicKey) MarshalBinary() ([]byte, error) {
+	return marshalBinary(key)
+}
+
+func (key *PublicKey) UnmarshalBinary(data []byte) error {
+	return unmarshalBinary(key, data)
+}
+
+func (key *PrivateKey) Encode(w io.Writer) error {
+	err := WriteVarBytes(w, key.D.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return (*PublicKey)(&key.PublicKey).Encode(w)
+}
+
+// Public key must match private one.
+func (key *PrivateKey) Decode(r io.Reader) error {
+	d, err := ReadVarBytes(r, MAX_KEY_INT_SIZE, "Key D")
+	if err != nil {
+		return err
+	}
+
+	err = (*PublicKey)(&key.PublicKey).Decode(r)
+	if err != nil {
+		return err
+	}
+
+	key.D = new(big.Int).SetBytes(d)
+
+	if key.D.Sign() == 0 || key.D.Cmp(key.Curve.Params().N) >= 0 {
+		return errors.New("Invalid private key")
+	}
+
+	x, y := key.Curve.ScalarBaseMult(d)
+	if x.Cmp(key.X) != 0 || y.Cmp(key.Y) != 0 {
+		return errors.New("Invalid private key: public key mismatch")
+	}
+
+	return nil
+}
+
+func (key *PrivateKey) MarshalBinary() ([]byte, error) {
+	return marshalBinary(key)
+}
 
-	return key
+func (key *PrivateKey) UnmarshalBinary(data []byte) error {
+	return unmarshalBinary(key, data)
 }
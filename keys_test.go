@@ -1,6 +1,9 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -28,3 +31,67 @@ func TestGetPublicKeyHash(t *testing.T) {
 		t.Errorf("GetPublicKeyHash: Invalid control hash: %s != %s", hashControl, hash)
 	}
 }
+
+func TestDecodeAddress(t *testing.T) {
+	key, _ := CreateKeyPair()
+
+	if GetAddress(key.PublicKey, &MainNetParams) != GetPublicKeyHash(key.PublicKey) || GetAddress(key.PublicKey, nil) != GetPublicKeyHash(key.PublicKey) {
+		t.Error("Main network address differs from key hash")
+	}
+
+	networks := []*NetworkParams{&MainNetParams, &TestNetParams, &RegTestParams}
+	for _, params := range networks {
+		address := GetAddress(key.PublicKey, params)
+
+		for _, other := range networks {
+			hash, err := DecodeAddress(address, other)
+			if other == params && (err != nil || len(hash) != 20) {
+				t.Errorf("%s address rejected: %v", params.Name, err)
+			}
+			if other != params && err == nil {
+				t.Errorf("%s address accepted on %s network", params.Name, other.Name)
+			}
+		}
+	}
+
+	address := GetPublicKeyHash(key.PublicKey)
+	typo := []byte(address)
+	if typo[10] == 'a' {
+		typo[10] = 'b'
+	} else {
+		typo[10] = 'a'
+	}
+
+	for _, invalid := range []string{string(typo), address[:len(address)-1], "", "0OIl", "hello"} {
+		_, err := DecodeAddress(invalid, &MainNetParams)
+		if err == nil {
+			t.Errorf("Invalid address %q accepted", invalid)
+		}
+	}
+}
+
+// Mining address is checked against configured network.
+func TestMiningAddrConfig(t *testing.T) {
+	key, _ := CreateKeyPair()
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	tests := []struct {
+		network string
+		address string
+		valid   bool
+	}{
+		{"main", GetAddress(key.PublicKey, &MainNetParams), true},
+		{"test", GetAddress(key.PublicKey, &TestNetParams), true},
+		{"test", GetAddress(key.PublicKey, &MainNetParams), false},
+		{"main", "hello", false},
+	}
+
+	for _, test := range tests {
+		os.WriteFile(path, []byte(fmt.Sprintf(`{"network": %q, "mining-addr": %q}`, test.network, test.address)), 0644)
+
+		_, err := LoadConfiguration(path)
+		if (err == nil) != test.valid {
+			t.Errorf("%s %s: %v", test.network, test.address, err)
+		}
+	}
+}
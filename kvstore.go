@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketBlocks  = []byte("blocks")
+	bucketHeaders = []byte("headers")
+	bucketHashes  = []byte("hashes")
+	bucketUTXOs   = []byte("utxos")
+	bucketMeta    = []byte("meta")
+	bucketIndex   = []byte("txindex")
+)
+
+// Chain state in an embedded key-value database (chain.db). Each block is
+// written with its header, index and unspent outputs changes in one
+// transaction.
+type KVStore struct {
+	db     *bolt.DB
+	count  uint64
+	pruned uint64
+}
+
+func OpenKVStore(dir string) (*KVStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	// Database is locked by its user, don't wait forever
+	db, err := bolt.Open(filepath.Join(dir, "chain.db"), 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	store := new(KVStore)
+	store.db = db
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketBlocks, bucketHeaders, bucketHashes, bucketUTXOs, bucketMeta, bucketIndex} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Format version is set when database is created
+		meta := tx.Bucket(bucketMeta)
+		version := meta.Get([]byte("format"))
+		if version != nil && binary.BigEndian.Uint64(version) > CHAIN_FORMAT_VERSION {
+			return errors.New(fmt.Sprintf("Format version %d is newer than supported one (%d)", binary.BigEndian.Uint64(version), CHAIN_FORMAT_VERSION))
+		}
+
+		// Blocks are written again in current format. Headers were not
+		// stored before CHAIN_FORMAT_HEADERS, no block is pruned then.
+		if version != nil && binary.BigEndian.Uint64(version) < CHAIN_FORMAT_TXN_VERSION {
+			format := uint32(binary.BigEndian.Uint64(version))
+			blocks := tx.Bucket(bucketBlocks)
+
+			upgraded := make(map[string][]byte)
+			err := blocks.ForEach(func(key []byte, data []byte) error {
+				b, err := unmarshalBlock(data, format)
+				if err != nil {
+					return err
+				}
+
+				if format < CHAIN_FORMAT_HEADERS {
+					err = putHeader(tx, b)
+					if err != nil {
+						return err
+					}
+				}
+
+				upgraded[string(key)], err = b.MarshalBinary()
+				return err
+			})
+			if err != nil {
+				return err
+			}
+
+			for key, data := range upgraded {
+				err = blocks.Put([]byte(key), data)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if version == nil || binary.BigEndian.Uint64(version) < CHAIN_FORMAT_VERSION {
+			version = make([]byte, 8)
+			binary.BigEndian.PutUint64(version, CHAIN_FORMAT_VERSION)
+
+			err := meta.Put([]byte("format"), version)
+			if err != nil {
+				return err
+			}
+		}
+
+		store.count = uint64(tx.Bucket(bucketHeaders).Stats().KeyN)
+
+		pruned := meta.Get([]byte("pruned"))
+		if pruned != nil {
+			store.pruned = binary.BigEndian.Uint64(pruned)
+		}
+
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func heightKey(height uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, height)
+
+	return key
+}
+
+func putHeader(tx *bolt.Tx, b *Block) error {
+	header := new(bytes.Buffer)
+
+	err := b.EncodeHeader(header)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(bucketHeaders).Put(heightKey(b.index), header.Bytes())
+}
+
+func (store *KVStore) PutBlock(b *Block) error {
+	if b.index != store.count {
+		return errors.New(fmt.Sprintf("Block %d is not next block (%d)", b.index, store.count))
+	}
+
+	data, err := b.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(bucketBlocks).Put(heightKey(b.index), data)
+		if err != nil {
+			return err
+		}
+
+		err = putHeader(tx, b)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(bucketHashes).Put(b.hash, heightKey(b.index))
+		if err != nil {
+			return err
+		}
+
+		utxos := tx.Bucket(bucketUTXOs)
+
+		return applyBlockOutputs(b, func(txhash []byte) error {
+			// Keys are only deleted once cursor is done with them
+			var keys [][]byte
+			c := utxos.Cursor()
+			for key, _ := c.Seek(txhash); key != nil && bytes.HasPrefix(key, txhash); key, _ = c.Next() {
+				if len(key) == len(txhash)+4 {
+					keys = append(keys, append([]byte(nil), key...))
+				}
+			}
+
+			for _, key := range keys {
+				err := utxos.Delete(key)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}, func(key []byte, output *TxOutput) error {
+			return utxos.Put(key, encodeTxOutput(output))
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	store.count++
+
+	return nil
+}
+
+func (store *KVStore) GetBlock(height uint64) (*Block, error) {
+	var b *Block
+
+	if height < store.pruned {
+		return nil, ErrPrunedBlock
+	}
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketBlocks).Get(heightKey(height))
+		if data == nil {
+			return errors.New(fmt.Sprintf("Block %d not found", height))
+		}
+
+		b = new(Block)
+
+		return b.UnmarshalBinary(data)
+	})
+
+	return b, err
+}
+
+func (store *KVStore) FindBlock(hash []byte) (*Block, error) {
+	var height uint64
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		key := tx.Bucket(bucketHashes).Get(hash)
+		if key == nil {
+			return errors.New(fmt.Sprintf("Block %x not found", hash))
+		}
+
+		height = binary.BigEndian.Uint64(key)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return store.GetBlock(height)
+}
+
+func (store *KVStore) BlockCount() uint64 {
+	return store.count
+}
+
+func (store *KVStore) GetHeader(height uint64) (*Block, error) {
+	var b *Block
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketHeaders).Get(heightKey(height))
+		if data == nil {
+			return errors.New(fmt.Sprintf("Block %d not found", height))
+		}
+
+		b = new(Block)
+
+		return b.DecodeHeader(bytes.NewReader(data))
+	})
+
+	return b, err
+}
+
+// Unspent outputs are kept up to date by each block, bodies can be
+// deleted.
+func (store *KVStore) PruneBlocks(height uint64) error {
+	if height > store.count {
+		height = store.count
+	}
+
+	if height <= store.pruned {
+		return nil
+	}
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		blocks := tx.Bucket(bucketBlocks)
+
+		for i := store.pruned; i < height; i++ {
+			err := blocks.Delete(heightKey(i))
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket(bucketMeta).Put([]byte("pruned"), heightKey(height))
+	})
+	if err != nil {
+		return err
+	}
+
+	store.pruned = height
+
+	return nil
+}
+
+func (store *KVStore) PrunedHeight() uint64 {
+	return store.pruned
+}
+
+func (store *KVStore) ImportSnapshot(headers []*Block, utxos map[string]*TxOutput) error {
+	if store.count > 0 {
+		return errors.New(fmt.Sprintf("Store already holds %d blocks", store.count))
+	}
+
+	count := uint64(len(headers))
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		for _, header := range headers {
+			err := putHeader(tx, header)
+			if err != nil {
+				return err
+			}
+
+			err = tx.Bucket(bucketHashes).Put(header.hash, heightKey(header.index))
+			if err != nil {
+				return err
+			}
+		}
+
+		for key, output := range utxos {
+			err := tx.Bucket(bucketUTXOs).Put([]byte(key), encodeTxOutput(output))
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket(bucketMeta).Put([]byte("pruned"), heightKey(count))
+	})
+	if err != nil {
+		return err
+	}
+
+	store.count = count
+	store.pruned = count
+
+	return nil
+}
+
+func (store *KVStore) GetUnspent(txhash []byte, output_id uint32) (*TxOutput, error) {
+	var output *TxOutput
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketUTXOs).Get(outpointKey(txhash, output_id))
+		if data == nil {
+			return errors.New(fmt.Sprintf("Output %d of transaction %x is not unspent", output_id, txhash))
+		}
+
+		var err error
+		output, err = decodeTxOutput(data)
+
+		return err
+	})
+
+	return output, err
+}
+
+func (store *KVStore) ForEachUnspent(fn func(txhash []byte, output_id uint32, output *TxOutput) error) error {
+	return store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketUTXOs).ForEach(func(key []byte, data []byte) error {
+			output, err := decodeTxOutput(data)
+			if err != nil {
+				return err
+			}
+
+			// Key is only valid during transaction
+			txhash, output_id := parseOutpointKey(key)
+
+			return fn(append([]byte{}, txhash...), output_id, output)
+		})
+	})
+}
+
+func (store *KVStore) GetMeta(key string) ([]byte, error) {
+	var value []byte
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketMeta).Get([]byte(key))
+		if data != nil {
+			value = append([]byte{}, data...)
+		}
+
+		return nil
+	})
+
+	return value, err
+}
+
+func (store *KVStore) PutMeta(key string, value []byte) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMeta).Put([]byte(key), value)
+	})
+}
+
+func (store *KVStore) PutIndexRecords(records map[string][]byte, replace bool) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		if replace {
+			err := tx.DeleteBucket(bucketIndex)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.CreateBucket(bucketIndex)
+			if err != nil {
+				return err
+			}
+		}
+
+		index := tx.Bucket(bucketIndex)
+		for key, value := range records {
+			var err error
+			if len(value) == 0 {
+				err = index.Delete([]byte(key))
+			} else {
+				err = index.Put([]byte(key), value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (store *KVStore) ForEachIndexRecord(fn func(key string, value []byte) error) error {
+	return store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketIndex).ForEach(func(key []byte, data []byte) error {
+			// Value is only valid during transaction
+			return fn(string(key), append([]byte{}, data...))
+		})
+	})
+}
+
+func (store *KVStore) Close() error {
+	return store.db.Close()
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Wallet ledger: transactions of blocks kept touching wallet keys. Funds
+// follow GetFunds: an input spends all outputs of its transaction, the
+// other ones being copied to the spending transaction, so copies cancel
+// out.
+const (
+	LEDGER_IN   = "in"
+	LEDGER_OUT  = "out"
+	LEDGER_SELF = "self" // Paid to our own keys only
+)
+
+type LedgerEntry struct {
+	height         uint64
+	txhash         []byte
+	direction      string
+	amount         float64 // Received, or paid to others
+	fee            float64 // Paid by us
+	counterparties []string
+	confirmations  uint64
+	label          string
+}
+
+func ledgerOutputKey(output *TxOutput) string {
+	return fmt.Sprintf("%x %f", output.script.data, output.amount)
+}
+
+func appendAddresses(addresses []string, script *Script, params *NetworkParams, skip map[string]bool) []string {
+	for _, address := range GetScriptAddresses(script, params) {
+		if skip[address] {
+			continue
+		}
+
+		found := false
+		for _, a := range addresses {
+			found = found || a == address
+		}
+
+		if !found {
+			addresses = append(addresses, address)
+		}
+	}
+
+	return addresses
+}
+
+// Wallet history, oldest first. Transactions spending outputs of pruned
+// blocks only count what is known. Daemon callers hold chain lock, which is
+// taken before wallet lock.
+func (bc *Blockchain) GetLedger(wallet *Wallet) []*LedgerEntry {
+	wallet.lock.Lock()
+	defer wallet.lock.Unlock()
+
+	keys := make(map[string]bool)
+	for _, key := range wallet.PrivateKeys {
+		keys[wallet.Address(key.PublicKey)] = true
+	}
+	for _, key := range wallet.PublicKeys {
+		keys[wallet.Address(key)] = true
+	}
+
+	// Outputs paying wallet keys, watch-only ones included
+	ours := func(script *Script) (string, bool) {
+		template := GetScriptTemplate(script)
+		if template != SCRIPT_P2PK && template != SCRIPT_P2PKH {
+			return "", false
+		}
+
+		addresses := GetScriptAddresses(script, bc.params)
+		if len(addresses) == 0 {
+			return "", false
+		}
+
+		return addresses[0], keys[addresses[0]]
+	}
+
+	txns := make(map[string]*Transaction)
+	entries := make([]*LedgerEntry, 0)
+
+	for height := bc.pruned; height < uint64(len(bc.blocks)); height++ {
+		for _, txn := range bc.blocks[height].txns {
+			txns[string(txn.hash)] = txn
+
+			outputs := make(map[string]bool)
+			for _, output := range txn.outputs {
+				outputs[ledgerOutputKey(output)] = true
+			}
+
+			spent := make(map[string]bool)
+			prevs := make([]*Transaction, 0)
+			for _, input := range txn.inputs {
+				spent[string(outpointKey(input.txhash, input.output_id))] = true
+
+				prev, ok := txns[string(input.txhash)]
+				if !ok {
+					continue
+				}
+
+				// Legacy input, outputs which are not copied are spent
+				if input.output_id == OUTPUT_ID_ALL {
+					for i, output := range prev.outputs {
+						if output != nil && !outputs[ledgerOutputKey(output)] {
+							spent[string(outpointKey(prev.hash, uint32(i)))] = true
+						}
+					}
+				}
+
+				found := false
+				for _, p := range prevs {
+					found = found || p == prev
+				}
+
+				if !found {
+					prevs = append(prevs, prev)
+				}
+			}
+
+			entry := new(LedgerEntry)
+			entry.height = height
+			entry.txhash = txn.hash
+			entry.confirmations = uint64(len(bc.blocks)) - height
+
+			from_us := false
+			debit, credit, consumed, produced := 0.0, 0.0, 0.0, 0.0
+			copied := make(map[string]int)
+			senders := []string{}
+			labelled := []string{}
+
+			for _, prev := range prevs {
+				for i, output := range prev.outputs {
+					if output == nil {
+						continue
+					}
+
+					consumed += output.amount
+					is_spent := spent[string(outpointKey(prev.hash, uint32(i)))]
+
+					if _, ok := ours(output.script); ok {
+						debit += output.amount
+						from_us = from_us || is_spent
+					} else if is_spent {
+						senders = appendAddresses(senders, output.script, bc.params, keys)
+					}
+
+					if !is_spent {
+						copied[ledgerOutputKey(output)]++
+					}
+				}
+			}
+
+			for _, output := range txn.outputs {
+				produced += output.amount
+
+				if address, ok := ours(output.script); ok {
+					credit += output.amount
+					labelled = append(labelled, address)
+					continue
+				}
+
+				if copied[ledgerOutputKey(output)] > 0 {
+					copied[ledgerOutputKey(output)]--
+					continue
+				}
+
+				entry.counterparties = appendAddresses(entry.counterparties, output.script, bc.params, keys)
+			}
+
+			if from_us {
+				entry.fee = consumed - produced
+				entry.amount = debit - credit - entry.fee
+
+				entry.direction = LEDGER_OUT
+				if len(entry.counterparties) == 0 {
+					entry.direction = LEDGER_SELF
+				}
+			} else {
+				// Only copies of our outputs
+				if credit-debit <= 0 {
+					continue
+				}
+
+				entry.amount = credit - debit
+				entry.direction = LEDGER_IN
+				entry.counterparties = senders
+			}
+
+			entry.label = wallet.txn_labels[hex.EncodeToString(txn.hash)]
+			for _, address := range append(append([]string{}, entry.counterparties...), labelled...) {
+				if entry.label == "" {
+					entry.label = wallet.addr_labels[address]
+				}
+			}
+
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// Height, confirmations, transaction, direction, amount, fee,
+// counterparties (- if none) and label.
+func (entry *LedgerEntry) String() string {
+	counterparties := "-"
+	if len(entry.counterparties) > 0 {
+		counterparties = strings.Join(entry.counterparties, ",")
+	}
+
+	line := fmt.Sprintf("%d %d %s %s %f %f %s", entry.height, entry.confirmations, hex.EncodeToString(entry.txhash),
+		entry.direction, entry.amount, entry.fee, counterparties)
+
+	if entry.label != "" {
+		line += fmt.Sprintf(" %q", entry.label)
+	}
+
+	return line
+}
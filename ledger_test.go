@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func TestLedger(t *testing.T) {
+	// One key per block, so coinbase transactions differ
+	w1 := new(Wallet)
+	for i := 0; i < 3; i++ {
+		key, _ := CreateKeyPair()
+		w1.AddPrivateKey(*key)
+	}
+	w2 := CreateTestingWallet()
+	w3 := CreateTestingWallet()
+	addr3 := GetPublicKeyHash(w3.PrivateKeys[0].PublicKey)
+
+	bc := CreateBlockchain()
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	TransferFund(bc, w1, w2, 30)
+	bc.MineBlock(w1.PrivateKeys[1].PublicKey)
+
+	// Spends transaction holding w1 change, which is copied
+	txn, err := bc.CreateTransfertTransaction(w2, &TxnOrder{Addr: addr3, Amount: 10, Fee: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.QueueTransaction(txn)
+	bc.MineBlock(w1.PrivateKeys[2].PublicKey)
+
+	config := Config{Wallet: filepath.Join(t.TempDir(), "wallet.key")}
+	w2.SetTransactionLabel(bc.blocks[1].txns[1].hash, "salary")
+	w2.SetAddressLabel(addr3, "shop")
+
+	err = w2.WriteWallet(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w2, err = LoadWallet(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		wallet  *Wallet
+		entries []LedgerEntry
+	}{
+		{w1, []LedgerEntry{
+			{height: 0, direction: LEDGER_IN, amount: 100, confirmations: 3},
+			{height: 1, direction: LEDGER_IN, amount: 100, confirmations: 2},
+			{height: 1, direction: LEDGER_OUT, amount: 30, counterparties: []string{GetPublicKeyHash(w2.PrivateKeys[0].PublicKey)}},
+			{height: 2, direction: LEDGER_IN, amount: 100, confirmations: 1},
+		}},
+		{w2, []LedgerEntry{
+			{height: 1, direction: LEDGER_IN, amount: 30, counterparties: []string{GetPublicKeyHash(w1.PrivateKeys[0].PublicKey)}, label: "salary"},
+			{height: 2, direction: LEDGER_OUT, amount: 10, fee: 1, counterparties: []string{addr3}, label: "shop"},
+		}},
+	}
+
+	for i, test := range tests {
+		entries := bc.GetLedger(test.wallet)
+		if len(entries) != len(test.entries) {
+			t.Fatalf("Wallet %d: %d entries, expected %d", i, len(entries), len(test.entries))
+		}
+
+		balance := 0.0
+		for j, entry := range entries {
+			expected := test.entries[j]
+			if entry.height != expected.height || entry.direction != expected.direction || entry.amount != expected.amount ||
+				entry.fee != expected.fee || entry.label != expected.label || len(entry.counterparties) != len(expected.counterparties) {
+				t.Errorf("Wallet %d: Invalid entry %d: %s", i, j, entry)
+				continue
+			}
+
+			if expected.confirmations != 0 && entry.confirmations != expected.confirmations {
+				t.Errorf("Wallet %d: Invalid confirmations of entry %d: %d", i, j, entry.confirmations)
+			}
+
+			for k, address := range expected.counterparties {
+				if entry.counterparties[k] != address {
+					t.Errorf("Wallet %d: Invalid counterparty of entry %d: %s", i, j, entry.counterparties[k])
+				}
+			}
+
+			if entry.direction == LEDGER_IN {
+				balance += entry.amount
+			} else {
+				balance -= entry.amount + entry.fee
+			}
+		}
+
+		// History adds up to funds
+		if math.Abs(balance-CheckFunds(bc, test.wallet)) > 1e-9 {
+			t.Errorf("Wallet %d: History balance %f, funds %f", i, balance, CheckFunds(bc, test.wallet))
+		}
+	}
+
+	// Label removal
+	w2.SetAddressLabel(addr3, "")
+	entries := bc.GetLedger(w2)
+	if entries[1].label != "" {
+		t.Errorf("Label not removed: %s", entries[1].label)
+	}
+}
+
+// Labels are set while history is read (run with -race).
+func TestLedgerConcurrentLabels(t *testing.T) {
+	w1 := CreateTestingWallet()
+	addr := GetPublicKeyHash(w1.PrivateKeys[0].PublicKey)
+
+	bc := CreateBlockchain()
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			w1.SetAddressLabel(addr, fmt.Sprintf("label %d", i))
+			w1.SetTransactionLabel(bc.blocks[0].txns[0].hash, fmt.Sprintf("label %d", i))
+		}
+		done <- true
+	}()
+
+	for i := 0; i < 100; i++ {
+		bc.GetLedger(w1)
+	}
+	<-done
+
+	entries := bc.GetLedger(w1)
+	if len(entries) != 1 || entries[0].label != "label 99" {
+		t.Errorf("Invalid ledger: %v", entries)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Read a transaction of a single file chain, which has no lock time, and
+// spends inputs without output id & sequence: each one spends all outputs
+// of its transaction. Stored hash is kept, so it can be checked against
+// computed one.
+func readLegacyTransaction(fd io.Reader) (*Transaction, error) {
+	var err error
+	var i uint32
+	txn := new(Transaction)
+
+	txn.hash, err = ReadBytesFromFd(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	txn.timestamp, err = ReadUint64FromFd(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	input_cnt, err := ReadUint32FromFd(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	if input_cnt > MAX_TXN_INPUTS {
+		return nil, errors.New(fmt.Sprintf("Too many inputs: %d", input_cnt))
+	}
+
+	for i = 0; i < input_cnt; i++ {
+		input := CreateTxInput(nil, OUTPUT_ID_ALL, new(Script))
+
+		input.txhash, err = ReadBytesFromFd(fd)
+		if err != nil {
+			return nil, err
+		}
+
+		input.script.data, err = ReadBytesFromFd(fd)
+		if err != nil {
+			return nil, err
+		}
+
+		txn.inputs = append(txn.inputs, input)
+	}
+
+	output_cnt, err := ReadUint32FromFd(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	if output_cnt > MAX_TXN_OUTPUTS {
+		return nil, errors.New(fmt.Sprintf("Too many outputs: %d", output_cnt))
+	}
+
+	for i = 0; i < output_cnt; i++ {
+		output := CreateTxOutput(new(Script), 0)
+
+		output.script.data, err = ReadBytesFromFd(fd)
+		if err != nil {
+			return nil, err
+		}
+
+		output.amount, err = ReadFloat64FromFd(fd)
+		if err != nil {
+			return nil, err
+		}
+
+		txn.outputs = append(txn.outputs, output)
+	}
+
+	return txn, nil
+}
+
+func readLegacyBlock(fd io.Reader) (*Block, error) {
+	var err error
+	var i uint32
+	b := new(Block)
+
+	b.index, err = ReadUint64FromFd(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	b.last_hash, err = ReadBytesFromFd(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	b.timestamp, err = ReadUint64FromFd(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	b.hash, err = ReadBytesFromFd(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	txn_cnt, err := ReadUint32FromFd(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	if txn_cnt > MAX_BLOCK_TXNS {
+		return nil, errors.New(fmt.Sprintf("Too many transactions: %d", txn_cnt))
+	}
+
+	for i = 0; i < txn_cnt; i++ {
+		txn, err := readLegacyTransaction(fd)
+		if err != nil {
+			return nil, err
+		}
+
+		b.txns = append(b.txns, txn)
+	}
+
+	return b, nil
+}
+
+// Check stored hashes against computed ones, and chaining of blocks.
+func checkLegacyBlocks(blocks []*Block) error {
+	for i, b := range blocks {
+		if b.index != uint64(i) {
+			return errors.New(fmt.Sprintf("Block %d found at height %d", b.index, i))
+		}
+
+		if i > 0 && !bytes.Equal(b.last_hash, blocks[i-1].hash) {
+			return errors.New(fmt.Sprintf("Block %d does not follow previous one", i))
+		}
+
+		for j, txn := range b.txns {
+			if !bytes.Equal(txn.hash, txn.ComputeHash(false)) {
+				return errors.New(fmt.Sprintf("Block %d, transaction %d: invalid hash %x", i, j, txn.hash))
+			}
+		}
+
+		if !bytes.Equal(b.hash, b.ComputeHash(false)) {
+			return errors.New(fmt.Sprintf("Block %d: invalid hash %x", i, b.hash))
+		}
+	}
+
+	return nil
+}
+
+// Single file chain, saved next to chain store by first versions.
+const LEGACY_BLOCKCHAIN_FILE = ".blocks.dat"
+
+// Read single file chain (.blocks.dat): last index, then blocks. Stale
+// bytes may follow last block.
+func ReadLegacyChain(path string) ([]*Block, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	reader := bufio.NewReader(fd)
+
+	last_index, err := ReadUint64FromFd(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := []*Block{}
+	for uint64(len(blocks)) <= last_index {
+		b, err := readLegacyBlock(reader)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Block %d: %s", len(blocks), err))
+		}
+
+		blocks = append(blocks, b)
+	}
+
+	err = checkLegacyBlocks(blocks)
+	if err != nil {
+		return nil, err
+	}
+
+	return blocks, nil
+}
+
+// Rewrite single file chain into configured store, which must be empty.
+// Each block is read back from store, and must keep its hash.
+func MigrateLegacyChain(path string, config Config) (int, error) {
+	blocks, err := ReadLegacyChain(path)
+	if err != nil {
+		return 0, err
+	}
+
+	params, err := GetNetworkParams(config.Network)
+	if err != nil {
+		return 0, err
+	}
+
+	store, err := OpenChainStore(config)
+	if err != nil {
+		return 0, err
+	}
+	defer store.Close()
+
+	if store.BlockCount() != 0 {
+		return 0, errors.New(fmt.Sprintf("Store %s is not empty (%d blocks)", config.Blockchain, store.BlockCount()))
+	}
+
+	err = store.PutMeta("network", []byte(params.Name))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, b := range blocks {
+		err = store.PutBlock(b)
+		if err != nil {
+			return 0, err
+		}
+
+		stored, err := store.GetBlock(b.index)
+		if err != nil {
+			return 0, err
+		}
+
+		if !bytes.Equal(stored.hash, b.hash) {
+			return 0, errors.New(fmt.Sprintf("Block %d: hash %x changed to %x", b.index, b.hash, stored.hash))
+		}
+
+		for j, txn := range stored.txns {
+			if !bytes.Equal(txn.hash, b.txns[j].hash) {
+				return 0, errors.New(fmt.Sprintf("Block %d, transaction %d: hash %x changed to %x", b.index, j, b.txns[j].hash, txn.hash))
+			}
+		}
+	}
+
+	return len(blocks), nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write chain as first versions did.
+func writeLegacyChain(t *testing.T, path string, blocks []*Block) {
+	fd, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	WriteUint64ToFd(fd, uint64(len(blocks)-1))
+
+	for _, b := range blocks {
+		WriteUint64ToFd(fd, b.index)
+		WriteBytesToFd(fd, b.last_hash)
+		WriteUint64ToFd(fd, b.timestamp)
+		WriteBytesToFd(fd, b.hash)
+		WriteUint32ToFd(fd, uint32(len(b.txns)))
+
+		for _, txn := range b.txns {
+			WriteBytesToFd(fd, txn.hash)
+			WriteUint64ToFd(fd, txn.timestamp)
+
+			WriteUint32ToFd(fd, uint32(len(txn.inputs)))
+			for _, input := range txn.inputs {
+				WriteBytesToFd(fd, input.txhash)
+				WriteBytesToFd(fd, input.script.data)
+			}
+
+			WriteUint32ToFd(fd, uint32(len(txn.outputs)))
+			for _, output := range txn.outputs {
+				WriteBytesToFd(fd, output.script.data)
+				WriteFloat64ToFd(fd, output.amount)
+			}
+		}
+	}
+
+	// Stale bytes of a longer chain
+	fd.Write([]byte("stale"))
+}
+
+// Give transactions and blocks their first versions hashes.
+func makeLegacyBlocks(blocks []*Block) {
+	hashes := make(map[string][]byte)
+
+	for i, b := range blocks {
+		for _, txn := range b.txns {
+			txn.version = TXN_VERSION_LEGACY
+			for _, input := range txn.inputs {
+				input.txhash = hashes[string(input.txhash)]
+			}
+
+			hash := txn.hash
+			txn.ComputeHash(true)
+			hashes[string(hash)] = txn.hash
+		}
+
+		if i > 0 {
+			b.last_hash = blocks[i-1].hash
+		}
+		b.ComputeHash(true)
+	}
+}
+
+func TestMigrateLegacyChain(t *testing.T) {
+	bc := CreateBlockchain()
+	w1 := CreateTestingWallet()
+	w2 := CreateTestingWallet()
+
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	TransferFund(bc, w1, w2, 30)
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	makeLegacyBlocks(bc.blocks)
+
+	dir := t.TempDir()
+	legacy := filepath.Join(dir, ".blocks.dat")
+	writeLegacyChain(t, legacy, bc.blocks)
+
+	// Single file can't be loaded as is
+	_, err := LoadBlockchain(Config{Blockchain: legacy})
+	if err == nil {
+		t.Error("Single file chain loaded without migration.")
+	}
+
+	// Nor ignored by a new store next to it
+	_, err = LoadBlockchain(Config{Blockchain: filepath.Join(dir, ".blocks"), Store: STORE_FILE})
+	if err == nil || !strings.Contains(err.Error(), "-migrate") {
+		t.Errorf("Single file chain ignored: %v", err)
+	}
+
+	for _, backend := range []string{STORE_FILE, STORE_KV} {
+		c := Config{Blockchain: filepath.Join(dir, backend), Store: backend}
+
+		count, err := MigrateLegacyChain(legacy, c)
+		if err != nil {
+			t.Fatalf("%s: %s", backend, err)
+		}
+
+		if count != 3 {
+			t.Errorf("%s: %d blocks migrated", backend, count)
+		}
+
+		// Store must be empty
+		_, err = MigrateLegacyChain(legacy, c)
+		if err == nil {
+			t.Errorf("%s: Chain migrated twice", backend)
+		}
+
+		bc2, err := LoadBlockchain(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range bc.blocks {
+			if !bytes.Equal(bc.blocks[i].hash, bc2.blocks[i].hash) {
+				t.Errorf("%s: Block %d hash changed", backend, i)
+			}
+		}
+
+		// Legacy inputs spend whole transaction
+		input := bc2.blocks[1].txns[1].inputs[0]
+		if input.output_id != OUTPUT_ID_ALL {
+			t.Errorf("%s: Legacy input spends output %d", backend, input.output_id)
+		}
+
+		err = bc2.VerifyBlock(bc2.blocks[1])
+		if err != nil {
+			t.Errorf("%s: Migrated block rejected: %s", backend, err)
+		}
+
+		if CheckFunds(bc2, w2) != 30 {
+			t.Errorf("%s: Invalid funds %f", backend, CheckFunds(bc2, w2))
+		}
+		bc2.Close()
+	}
+
+	// Altered content does not match stored hashes
+	bc.blocks[1].txns[1].outputs[0].amount = 1000
+	writeLegacyChain(t, legacy, bc.blocks)
+
+	_, err = ReadLegacyChain(legacy)
+	if err == nil {
+		t.Error("Altered chain read.")
+	}
+}
+
+func TestChainFormatVersion(t *testing.T) {
+	bc := CreateBlockchain()
+	w1 := CreateTestingWallet()
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	c := Config{Blockchain: t.TempDir()}
+
+	err := bc.SaveBlockchain(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Written by a newer version
+	path := filepath.Join(c.Blockchain, "index.dat")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := new(bytes.Buffer)
+	WriteUint32ToFd(buffer, INDEX_FILE_MAGIC)
+	WriteUint32ToFd(buffer, CHAIN_FORMAT_VERSION+1)
+	copy(data, buffer.Bytes())
+	os.WriteFile(path, data, 0644)
+
+	_, err = LoadBlockchain(c)
+	if err == nil {
+		t.Error("Newer format loaded.")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Chain state kept in memory, for tests. Stores opened with the same name
+// are shared, so a chain can be saved then loaded again.
+type MemoryStore struct {
+	blocks []*Block
+	pruned uint64
+	hashes map[string]uint64
+	utxos  *unspentSet
+	meta   map[string][]byte
+	index  map[string][]byte
+}
+
+var memoryStores = make(map[string]*MemoryStore)
+var memoryStoresLock sync.Mutex
+
+func CreateMemoryStore() *MemoryStore {
+	store := new(MemoryStore)
+	store.hashes = make(map[string]uint64)
+	store.utxos = createUnspentSet(nil)
+	store.meta = make(map[string][]byte)
+	store.index = make(map[string][]byte)
+
+	return store
+}
+
+func OpenMemoryStore(name string) *MemoryStore {
+	memoryStoresLock.Lock()
+	defer memoryStoresLock.Unlock()
+
+	store, ok := memoryStores[name]
+	if !ok {
+		store = CreateMemoryStore()
+		memoryStores[name] = store
+	}
+
+	return store
+}
+
+func (store *MemoryStore) PutBlock(b *Block) error {
+	if b.index != store.BlockCount() {
+		return errors.New(fmt.Sprintf("Block %d is not next block (%d)", b.index, store.BlockCount()))
+	}
+
+	store.blocks = append(store.blocks, b)
+	store.hashes[string(b.hash)] = b.index
+
+	return store.utxos.applyBlock(b)
+}
+
+func (store *MemoryStore) GetBlock(height uint64) (*Block, error) {
+	if height >= store.BlockCount() {
+		return nil, errors.New(fmt.Sprintf("Block %d not found", height))
+	}
+
+	if height < store.pruned {
+		return nil, ErrPrunedBlock
+	}
+
+	return store.blocks[height], nil
+}
+
+func (store *MemoryStore) FindBlock(hash []byte) (*Block, error) {
+	height, ok := store.hashes[string(hash)]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Block %x not found", hash))
+	}
+
+	return store.GetBlock(height)
+}
+
+func (store *MemoryStore) GetHeader(height uint64) (*Block, error) {
+	if height >= store.BlockCount() {
+		return nil, errors.New(fmt.Sprintf("Block %d not found", height))
+	}
+
+	return store.blocks[height].Header(), nil
+}
+
+// Blocks are shared with chain, they are replaced by their header.
+func (store *MemoryStore) PruneBlocks(height uint64) error {
+	for ; store.pruned < height && store.pruned < store.BlockCount(); store.pruned++ {
+		store.blocks[store.pruned] = store.blocks[store.pruned].Header()
+	}
+
+	return nil
+}
+
+func (store *MemoryStore) PrunedHeight() uint64 {
+	return store.pruned
+}
+
+func (store *MemoryStore) ImportSnapshot(headers []*Block, utxos map[string]*TxOutput) error {
+	if store.BlockCount() > 0 {
+		return errors.New(fmt.Sprintf("Store already holds %d blocks", store.BlockCount()))
+	}
+
+	for _, header := range headers {
+		store.blocks = append(store.blocks, header)
+		store.hashes[string(header.hash)] = header.index
+	}
+
+	for key, output := range utxos {
+		store.utxos.add([]byte(key), output)
+	}
+
+	store.pruned = store.BlockCount()
+
+	return nil
+}
+
+func (store *MemoryStore) BlockCount() uint64 {
+	return uint64(len(store.blocks))
+}
+
+func (store *MemoryStore) GetUnspent(txhash []byte, output_id uint32) (*TxOutput, error) {
+	return store.utxos.get(txhash, output_id)
+}
+
+func (store *MemoryStore) ForEachUnspent(fn func(txhash []byte, output_id uint32, output *TxOutput) error) error {
+	return store.utxos.forEach(fn)
+}
+
+func (store *MemoryStore) GetMeta(key string) ([]byte, error) {
+	return store.meta[key], nil
+}
+
+func (store *MemoryStore) PutMeta(key string, value []byte) error {
+	store.meta[key] = value
+
+	return nil
+}
+
+func (store *MemoryStore) PutIndexRecords(records map[string][]byte, replace bool) error {
+	if replace {
+		store.index = make(map[string][]byte)
+	}
+
+	for key, value := range records {
+		if len(value) == 0 {
+			delete(store.index, key)
+			continue
+		}
+
+		store.index[key] = value
+	}
+
+	return nil
+}
+
+func (store *MemoryStore) ForEachIndexRecord(fn func(key string, value []byte) error) error {
+	for key, value := range store.index {
+		err := fn(key, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Content is kept until process exits.
+func (store *MemoryStore) Close() error {
+	return nil
+}
+
+// Unspent outputs kept in memory, by outpoint key, with output ids of each
+// transaction so it can be spent as a whole.
+type unspentSet struct {
+	outputs map[string]*TxOutput
+	ids     map[string][]uint32 // By transaction hash
+}
+
+func createUnspentSet(utxos map[string]*TxOutput) *unspentSet {
+	set := new(unspentSet)
+	set.outputs = make(map[string]*TxOutput)
+	set.ids = make(map[string][]uint32)
+
+	for key, output := range utxos {
+		set.add([]byte(key), output)
+	}
+
+	return set
+}
+
+func (set *unspentSet) add(key []byte, output *TxOutput) {
+	if _, ok := set.outputs[string(key)]; !ok {
+		txhash, output_id := parseOutpointKey(key)
+		set.ids[string(txhash)] = append(set.ids[string(txhash)], output_id)
+	}
+
+	set.outputs[string(key)] = output
+}
+
+// Remove all outputs of transaction.
+func (set *unspentSet) spend(txhash []byte) {
+	for _, output_id := range set.ids[string(txhash)] {
+		delete(set.outputs, string(outpointKey(txhash, output_id)))
+	}
+
+	delete(set.ids, string(txhash))
+}
+
+func (set *unspentSet) applyBlock(b *Block) error {
+	return applyBlockOutputs(b, func(txhash []byte) error {
+		set.spend(txhash)
+		return nil
+	}, func(key []byte, output *TxOutput) error {
+		set.add(key, output)
+		return nil
+	})
+}
+
+func (set *unspentSet) get(txhash []byte, output_id uint32) (*TxOutput, error) {
+	output, ok := set.outputs[string(outpointKey(txhash, output_id))]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Output %d of transaction %x is not unspent", output_id, txhash))
+	}
+
+	return output, nil
+}
+
+func (set *unspentSet) forEach(fn func(txhash []byte, output_id uint32, output *TxOutput) error) error {
+	for key, output := range set.outputs {
+		txhash, output_id := parseOutpointKey([]byte(key))
+
+		err := fn(txhash, output_id, output)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Signed messages prove ownership of an address. The message is hashed
+// with a prefix, so its signature can't spend an output (transaction
+// signatures cover output scripts as they are).
+//
+// Signature is base64 of: public key (X, Y), then signature (r, s) as
+// variable length bytes. Verifiers check the key hashes to the address.
+const MESSAGE_PREFIX = "Stupidcoin Signed Message:\n"
+
+func messageHash(message string) []byte {
+	buffer := bytes.NewBufferString(MESSAGE_PREFIX)
+	WriteVarBytes(buffer, []byte(message))
+
+	hash := sha256.Sum256(buffer.Bytes())
+
+	return hash[:]
+}
+
+// Sign message with wallet key of address.
+func (w *Wallet) SignAddressMessage(address string, message string) (string, error) {
+	key, err := w.GetPrivateKeyByHash(address)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("No private key for address %s", address))
+	}
+
+	sign, err := SignMessage(key, messageHash(message))
+	if err != nil {
+		return "", err
+	}
+
+	buffer := new(bytes.Buffer)
+	(*PublicKey)(&key.PublicKey).Encode(buffer)
+	WriteVarBytes(buffer, sign)
+
+	return base64.StdEncoding.EncodeToString(buffer.Bytes()), nil
+}
+
+// Check both integers of a signature fit in it, as SignVerify doesn't.
+func checkSignatureEncoding(sign []byte) error {
+	idx := 0
+	for i := 0; i < 2; i++ {
+		if len(sign)-idx < 4 {
+			return errors.New("Invalid signature encoding")
+		}
+
+		size := int(binary.LittleEndian.Uint32(sign[idx:]))
+		if size > MAX_KEY_INT_SIZE || len(sign)-idx-4 < size {
+			return errors.New("Invalid signature encoding")
+		}
+
+		idx += 4 + size
+	}
+
+	if idx != len(sign) {
+		return errors.New("Invalid signature encoding")
+	}
+
+	return nil
+}
+
+// Address must belong to network.
+func VerifyAddressMessage(address string, message string, signature string, params *NetworkParams) error {
+	_, err := DecodeAddress(address, params)
+	if err != nil {
+		return err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return err
+	}
+
+	reader := bytes.NewReader(data)
+
+	key := new(PublicKey)
+	err = key.Decode(reader)
+	if err != nil {
+		return err
+	}
+
+	sign, err := ReadVarBytes(reader, 2*MAX_KEY_INT_SIZE+8, "Signature")
+	if err != nil {
+		return err
+	}
+
+	if reader.Len() > 0 {
+		return errors.New("Invalid signature: trailing data")
+	}
+
+	err = checkSignatureEncoding(sign)
+	if err != nil {
+		return err
+	}
+
+	if GetAddress(ecdsa.PublicKey(*key), params) != address {
+		return errors.New(fmt.Sprintf("Signature key is not the one of address %s", address))
+	}
+
+	if !SignVerify(ecdsa.PublicKey(*key), messageHash(message), sign) {
+		return errors.New("Invalid signature")
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestSignAddressMessage(t *testing.T) {
+	w1 := CreateTestingWallet()
+	w2 := CreateTestingWallet()
+	addr1 := GetPublicKeyHash(w1.PrivateKeys[0].PublicKey)
+	addr2 := GetPublicKeyHash(w2.PrivateKeys[0].PublicKey)
+
+	signature, err := w1.SignAddressMessage(addr1, "I own this address")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w1.SignAddressMessage(addr2, "I own this address")
+	if err == nil {
+		t.Error("Message signed without key.")
+	}
+
+	err = VerifyAddressMessage(addr1, "I own this address", signature, &MainNetParams)
+	if err != nil {
+		t.Errorf("Valid signature rejected: %s", err)
+	}
+
+	data, _ := base64.StdEncoding.DecodeString(signature)
+	truncated := base64.StdEncoding.EncodeToString(data[:len(data)-3])
+
+	tests := []struct {
+		address   string
+		message   string
+		signature string
+	}{
+		{addr1, "I own this address.", signature},
+		{addr2, "I own this address", signature},
+		{addr1, "I own this address", truncated},
+		{addr1, "I own this address", "not base64"},
+		{addr1, "I own this address", ""},
+	}
+
+	for i, test := range tests {
+		err = VerifyAddressMessage(test.address, test.message, test.signature, &MainNetParams)
+		if err == nil {
+			t.Errorf("Invalid signature %d accepted", i)
+		}
+	}
+}
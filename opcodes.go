@@ -0,0 +1,540 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/md5"
+	"crypto/sha256"
+
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcutil/base58"
+)
+
+// An instruction of the VM. Assembler, disassembler and VM all read their
+// instructions from the registry.
+type Opcode struct {
+	inst Instruction
+	name string
+
+	// Read operand following instruction, idx pointing after instruction.
+	// Returns operand and index of next instruction. nil without operand.
+	parse func(data []byte, idx int) ([]byte, int, bool)
+
+	// Add instruction and its operand to script. Used by assembler.
+	encode func(script *Script, operand []byte) error
+
+	// Run instruction with its operand.
+	run func(ex *execution, operand []byte) error
+
+	// Instruction only pushes its operand to stack.
+	push bool
+
+	// Instruction is run even in skipped branches, to track them.
+	conditional bool
+
+	// Only enabled on networks allowing experimental instructions.
+	experimental bool
+}
+
+var opcodes = make(map[Instruction]*Opcode)
+
+func RegisterOpcode(op *Opcode) error {
+	if _, ok := opcodes[op.inst]; ok {
+		return errors.New(fmt.Sprintf("Instruction 0x%02x already registered", byte(op.inst)))
+	}
+
+	if GetOpcodeByName(op.name) != nil {
+		return errors.New(fmt.Sprintf("Instruction %s already registered", op.name))
+	}
+
+	if op.run == nil || (op.parse == nil) != (op.encode == nil) {
+		return errors.New(fmt.Sprintf("Instruction %s is incomplete", op.name))
+	}
+
+	// Pushed data is its operand
+	if op.push && op.parse == nil {
+		return errors.New(fmt.Sprintf("Push instruction %s has no operand", op.name))
+	}
+
+	opcodes[op.inst] = op
+
+	return nil
+}
+
+func GetOpcode(inst Instruction) *Opcode {
+	return opcodes[inst]
+}
+
+func GetOpcodeByName(name string) *Opcode {
+	for _, op := range opcodes {
+		if op.name == name {
+			return op
+		}
+	}
+
+	return nil
+}
+
+// Operand of given size.
+func parseFixedOperand(size int) func(data []byte, idx int) ([]byte, int, bool) {
+	return func(data []byte, idx int) ([]byte, int, bool) {
+		if idx+size > len(data) {
+			return nil, idx, false
+		}
+
+		return data[idx : idx+size], idx + size, true
+	}
+}
+
+func encodeFixedOperand(inst Instruction, size int) func(script *Script, operand []byte) error {
+	return func(script *Script, operand []byte) error {
+		if len(operand) != size {
+			return errors.New(fmt.Sprintf("Requires %d bytes, got %d", size, len(operand)))
+		}
+
+		script.addInstruction(inst)
+		script.addBytes(operand)
+
+		return nil
+	}
+}
+
+// Operand prefixed by its size, on 2 bytes.
+func parseSizedOperand(data []byte, idx int) ([]byte, int, bool) {
+	if idx+2 > len(data) {
+		return nil, idx, false
+	}
+
+	size := int(binary.BigEndian.Uint16(data[idx : idx+2]))
+
+	return parseFixedOperand(size)(data, idx+2)
+}
+
+func encodeSizedOperand(inst Instruction) func(script *Script, operand []byte) error {
+	return func(script *Script, operand []byte) error {
+		if len(operand) > 0xffff {
+			return errors.New(fmt.Sprintf("Data too long (%d bytes)", len(operand)))
+		}
+
+		script.addInstruction(inst)
+		script.addWord(uint16(len(operand)))
+		script.addBytes(operand)
+
+		return nil
+	}
+}
+
+func registerPushOpcode(inst Instruction, name string, size int) {
+	op := &Opcode{inst: inst, name: name, push: true, run: runPush}
+
+	if size > 0 {
+		op.parse = parseFixedOperand(size)
+		op.encode = encodeFixedOperand(inst, size)
+	} else {
+		op.parse = parseSizedOperand
+		op.encode = encodeSizedOperand(inst)
+	}
+
+	mustRegisterOpcode(op)
+}
+
+func registerOpcode(inst Instruction, name string, run func(ex *execution, operand []byte) error) {
+	mustRegisterOpcode(&Opcode{inst: inst, name: name, run: run})
+}
+
+func mustRegisterOpcode(op *Opcode) {
+	err := RegisterOpcode(op)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Built-in instructions
+func init() {
+	registerOpcode(OP_NOP, "OP_NOP", runNop)
+
+	registerPushOpcode(OP_PUSH_BYTE, "OP_PUSH_BYTE", 1)
+	registerPushOpcode(OP_PUSH_WORD, "OP_PUSH_WORD", 2)
+	registerPushOpcode(OP_PUSH_DWORD, "OP_PUSH_DWORD", 4)
+	registerPushOpcode(OP_PUSH_BYTES, "OP_PUSH_BYTES", 0)
+
+	registerOpcode(OP_DUP, "OP_DUP", runDup)
+	registerOpcode(OP_SWAP, "OP_SWAP", runSwap)
+	registerOpcode(OP_EQUAL, "OP_EQUAL", runEqual)
+
+	registerOpcode(OP_HASH_BASE64, "OP_HASH_BASE64", runHashBase64)
+	registerOpcode(OP_HASH_TOHEX, "OP_HASH_TOHEX", runHashToHex)
+	registerOpcode(OP_HASH_MD5, "OP_HASH_MD5", runHashMD5)
+	registerOpcode(OP_HASH_KEY, "OP_HASH_KEY", runHashKey)
+	registerOpcode(OP_HASH_SHA256, "OP_HASH_SHA256", runHashSHA256)
+
+	registerOpcode(OP_CHECKSIG, "OP_CHECKSIG", runCheckSig)
+	registerOpcode(OP_CHECKMULTISIG, "OP_CHECKMULTISIG", runCheckMultiSig)
+	registerOpcode(OP_CHECKLOCKTIMEVERIFY, "OP_CHECKLOCKTIMEVERIFY", runCheckLockTime)
+	registerOpcode(OP_CHECKSEQUENCEVERIFY, "OP_CHECKSEQUENCEVERIFY", runCheckSequence)
+
+	mustRegisterOpcode(&Opcode{inst: OP_IF, name: "OP_IF", run: runIf, conditional: true})
+	mustRegisterOpcode(&Opcode{inst: OP_ELSE, name: "OP_ELSE", run: runElse, conditional: true})
+	mustRegisterOpcode(&Opcode{inst: OP_ENDIF, name: "OP_ENDIF", run: runEndIf, conditional: true})
+
+	registerOpcode(OP_RETURN, "OP_RETURN", runReturn)
+
+	// Experimental
+	mustRegisterOpcode(&Opcode{inst: OP_HASH_BASE58, name: "OP_HASH_BASE58", run: runHashBase58, experimental: true})
+}
+
+func runNop(ex *execution, operand []byte) error {
+	// Do nothing
+	return nil
+}
+
+func runPush(ex *execution, operand []byte) error {
+	ex.stack.Push(operand)
+
+	return nil
+}
+
+func runDup(ex *execution, operand []byte) error {
+	elem1, err := ex.stack.Pop()
+	if err != nil {
+		return errors.New("Not enough elements in stack")
+	}
+
+	ex.stack.Push(elem1)
+	ex.stack.Push(elem1)
+
+	return nil
+}
+
+func runSwap(ex *execution, operand []byte) error {
+	elem1, err := ex.stack.Pop()
+	if err != nil {
+		return errors.New("Not enough elements in stack")
+	}
+	elem2, err := ex.stack.Pop()
+	if err != nil {
+		return errors.New("Not enough elements in stack")
+	}
+
+	ex.stack.Push(elem1)
+	ex.stack.Push(elem2)
+
+	return nil
+}
+
+func runEqual(ex *execution, operand []byte) error {
+	// Picks 2 elements in stack, if not equal, fail.
+	elem1, err := ex.stack.Pop()
+	if err != nil {
+		return errors.New("Not enough elements in stack")
+	}
+	elem2, err := ex.stack.Pop()
+	if err != nil {
+		return errors.New("Not enough elements in stack")
+	}
+
+	if len(elem1) != len(elem2) {
+		return errors.New("OP_EQUAL: Can't compare elements: Invalid sizes")
+	}
+
+	for j := 0; j < len(elem1); j++ {
+		if elem1[j] != elem2[j] {
+			return errors.New(fmt.Sprintf("OP_EQUAL: Elements are not equal (%s / %s)", string(elem1), string(elem2)))
+		}
+	}
+
+	return nil
+}
+
+// Replace top element by its transformation.
+func runTransform(ex *execution, transform func([]byte) []byte) error {
+	elem1, err := ex.stack.Pop()
+	if err != nil {
+		return errors.New("Not enough elements in stack")
+	}
+
+	ex.stack.Push(transform(elem1))
+
+	return nil
+}
+
+func runHashBase58(ex *execution, operand []byte) error {
+	return runTransform(ex, func(elem []byte) []byte {
+		return []byte(base58.Encode(elem))
+	})
+}
+
+func runHashBase64(ex *execution, operand []byte) error {
+	return runTransform(ex, func(elem []byte) []byte {
+		return []byte(base64.StdEncoding.EncodeToString(elem))
+	})
+}
+
+func runHashToHex(ex *execution, operand []byte) error {
+	return runTransform(ex, func(elem []byte) []byte {
+		return []byte(fmt.Sprintf("%x", elem))
+	})
+}
+
+func runHashMD5(ex *execution, operand []byte) error {
+	return runTransform(ex, func(elem []byte) []byte {
+		hash := md5.Sum(elem)
+		return hash[:]
+	})
+}
+
+func runHashSHA256(ex *execution, operand []byte) error {
+	return runTransform(ex, func(elem []byte) []byte {
+		hash := sha256.Sum256(elem)
+		return hash[:]
+	})
+}
+
+func runHashKey(ex *execution, operand []byte) error {
+	elem, err := ex.stack.Pop()
+	if err != nil {
+		return errors.New("Not enough elements in stack")
+	}
+
+	// Recreate key
+	pk, err := GetPublicKeyFromBytes(elem)
+	if err != nil {
+		return err
+	}
+
+	// Get hash
+	ex.stack.Push([]byte(GetAddress(pk, ex.vm.params)))
+
+	return nil
+}
+
+func runCheckSig(ex *execution, operand []byte) error {
+	// Pop public key
+	key, err := ex.stack.Pop()
+	if err != nil {
+		return errors.New("Not enough elements in stack")
+	}
+	// Pop signature
+	sign, err := ex.stack.Pop()
+	if err != nil {
+		return errors.New("Not enough elements in stack")
+	}
+
+	// Rebuild key
+	pbkey, err := GetPublicKeyFromBytes(key)
+	if err != nil {
+		return err
+	}
+
+	err = checkSignatureEncoding(sign)
+	if err != nil {
+		return err
+	}
+
+	// Check signature over script
+	ret := SignVerify(pbkey, ex.message, sign)
+	if ret != true {
+		return errors.New("Invalid signature")
+	}
+
+	return nil
+}
+
+func (ex *execution) popNumber(max uint64) (int, error) {
+	elem, err := ex.stack.Pop()
+	if err != nil {
+		return 0, errors.New("Not enough elements in stack")
+	}
+
+	value, err := StackElemToUint64(elem)
+	if err != nil {
+		return 0, err
+	}
+
+	if value > max {
+		return 0, errors.New(fmt.Sprintf("Number %d is over %d", value, max))
+	}
+
+	return int(value), nil
+}
+
+// <sig1> ... <sigm> <m> <key1> ... <keyn> <n> OP_CHECKMULTISIG
+// Signatures must be in the same order as the keys they match.
+func runCheckMultiSig(ex *execution, operand []byte) error {
+	n, err := ex.popNumber(MAX_MULTISIG_KEYS)
+	if err != nil {
+		return errors.New(fmt.Sprintf("OP_CHECKMULTISIG: %s", err))
+	}
+
+	// Each key counts as an instruction
+	ex.ops_count += n
+
+	keys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		keys[i], err = ex.stack.Pop()
+		if err != nil {
+			return errors.New("Not enough elements in stack")
+		}
+	}
+
+	m, err := ex.popNumber(uint64(n))
+	if err != nil {
+		return errors.New(fmt.Sprintf("OP_CHECKMULTISIG: %s", err))
+	}
+
+	signs := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
+		signs[i], err = ex.stack.Pop()
+		if err != nil {
+			return errors.New("Not enough elements in stack")
+		}
+	}
+
+	pbkeys := make([]ecdsa.PublicKey, n)
+	for i, key := range keys {
+		pbkeys[i], err = GetPublicKeyFromBytes(key)
+		if err != nil {
+			return errors.New(fmt.Sprintf("OP_CHECKMULTISIG: %s", err))
+		}
+	}
+
+	for _, sign := range signs {
+		err = checkSignatureEncoding(sign)
+		if err != nil {
+			return errors.New(fmt.Sprintf("OP_CHECKMULTISIG: %s", err))
+		}
+	}
+
+	k := 0
+	for _, sign := range signs {
+		for k < n && !SignVerify(pbkeys[k], ex.message, sign) {
+			k++
+		}
+
+		if k == n {
+			return errors.New("OP_CHECKMULTISIG: Invalid signature")
+		}
+		k++
+	}
+
+	return nil
+}
+
+// Pop lock time, fails if transaction can be mined before it.
+func runCheckLockTime(ex *execution, operand []byte) error {
+	elem, err := ex.stack.Pop()
+	if err != nil {
+		return errors.New("Not enough elements in stack")
+	}
+
+	if ex.vm.txn == nil || ex.vm.input_idx >= len(ex.vm.txn.inputs) {
+		return errors.New("OP_CHECKLOCKTIMEVERIFY: No transaction context")
+	}
+
+	locktime, err := StackElemToUint64(elem)
+	if err != nil {
+		return err
+	}
+
+	// Both lock times must be heights, or timestamps.
+	if (locktime < LOCKTIME_THRESHOLD) != (ex.vm.txn.locktime < LOCKTIME_THRESHOLD) {
+		return errors.New("OP_CHECKLOCKTIMEVERIFY: Lock time type mismatch")
+	}
+
+	if locktime > ex.vm.txn.locktime {
+		return errors.New(fmt.Sprintf("OP_CHECKLOCKTIMEVERIFY: Locked until %d", locktime))
+	}
+
+	// A final input would disable transaction lock time.
+	if ex.vm.txn.inputs[ex.vm.input_idx].sequence == SEQUENCE_FINAL {
+		return errors.New("OP_CHECKLOCKTIMEVERIFY: Input is final")
+	}
+
+	return nil
+}
+
+// Pop relative lock, fails if input sequence is lower.
+func runCheckSequence(ex *execution, operand []byte) error {
+	elem, err := ex.stack.Pop()
+	if err != nil {
+		return errors.New("Not enough elements in stack")
+	}
+
+	if ex.vm.txn == nil || ex.vm.input_idx >= len(ex.vm.txn.inputs) {
+		return errors.New("OP_CHECKSEQUENCEVERIFY: No transaction context")
+	}
+
+	value, err := StackElemToUint64(elem)
+	if err != nil {
+		return err
+	}
+
+	if value > uint64(SEQUENCE_FINAL) {
+		return errors.New("OP_CHECKSEQUENCEVERIFY: Invalid sequence")
+	}
+
+	required := uint32(value)
+	if required&SEQUENCE_DISABLE_FLAG != 0 {
+		// Relative lock disabled, behaves like OP_NOP
+		return nil
+	}
+
+	sequence := ex.vm.txn.inputs[ex.vm.input_idx].sequence
+	if sequence&SEQUENCE_DISABLE_FLAG != 0 {
+		return errors.New("OP_CHECKSEQUENCEVERIFY: Input relative lock is disabled")
+	}
+
+	if required&SEQUENCE_TYPE_FLAG != sequence&SEQUENCE_TYPE_FLAG {
+		return errors.New("OP_CHECKSEQUENCEVERIFY: Relative lock type mismatch")
+	}
+
+	if required&SEQUENCE_MASK > sequence&SEQUENCE_MASK {
+		return errors.New(fmt.Sprintf("OP_CHECKSEQUENCEVERIFY: Locked for %d", required&SEQUENCE_MASK))
+	}
+
+	return nil
+}
+
+func runReturn(ex *execution, operand []byte) error {
+	return errors.New("OP_RETURN: Output is unspendable")
+}
+
+// Pop condition if branch is run, else just track nesting.
+func runIf(ex *execution, operand []byte) error {
+	cond := false
+	if ex.isExecuting() {
+		elem1, err := ex.stack.Pop()
+		if err != nil {
+			return errors.New("Not enough elements in stack")
+		}
+
+		cond = StackElemToBool(elem1)
+	}
+
+	ex.conditions = append(ex.conditions, cond)
+
+	return nil
+}
+
+func runElse(ex *execution, operand []byte) error {
+	if len(ex.conditions) == 0 {
+		return errors.New("OP_ELSE: No matching OP_IF")
+	}
+
+	ex.conditions[len(ex.conditions)-1] = !ex.conditions[len(ex.conditions)-1]
+
+	return nil
+}
+
+func runEndIf(ex *execution, operand []byte) error {
+	if len(ex.conditions) == 0 {
+		return errors.New("OP_ENDIF: No matching OP_IF")
+	}
+
+	ex.conditions = ex.conditions[:len(ex.conditions)-1]
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Rules which differ between networks.
+type NetworkParams struct {
+	Name string
+
+	// Allow instructions registered as experimental.
+	ExperimentalOpcodes bool
+
+	// First byte of addresses, so they can't be used on another network.
+	AddressVersion byte
+}
+
+var MainNetParams = NetworkParams{
+	Name:                "main",
+	ExperimentalOpcodes: false,
+	AddressVersion:      16, // 7...
+}
+
+var TestNetParams = NetworkParams{
+	Name:                "test",
+	ExperimentalOpcodes: false,
+	AddressVersion:      65, // T...
+}
+
+var RegTestParams = NetworkParams{
+	Name:                "regtest",
+	ExperimentalOpcodes: true,
+	AddressVersion:      60, // R...
+}
+
+// Empty name is main network.
+func GetNetworkParams(name string) (*NetworkParams, error) {
+	switch name {
+	case "", MainNetParams.Name:
+		return &MainNetParams, nil
+	case TestNetParams.Name:
+		return &TestNetParams, nil
+	case RegTestParams.Name:
+		return &RegTestParams, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("Unknown network: %s", name))
+}
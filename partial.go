@@ -0,0 +1,374 @@
+package main
+
+import (
+	"crypto/ecdsa"
+
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Partially signed transaction, for wallets whose keys are kept offline.
+// A watch-only node builds the transaction with empty input scripts, the
+// offline wallet signs inputs it holds keys of, then the online node
+// checks it against chain and queues it.
+//
+// File starts with a header, then one record: network, transaction, and
+// outputs spent by each input, then number of outputs paid, so the signer
+// needs no chain to show what it signs. Later outputs are copies of other
+// outputs of spent transactions.
+const PARTIAL_FILE_MAGIC = 0x53544350 // "STCP"
+
+type PartialTransaction struct {
+	network string
+	txn     *Transaction
+	spent   []*TxOutput
+	paid    int
+}
+
+// Build an unsigned transaction paying order from wallet funds, which may
+// be watch-only. Change goes to given address, as a watch-only wallet
+// cannot create keys.
+func (bc *Blockchain) CreatePartialTransaction(wallet *Wallet, txnOrder *TxnOrder, change string) (*PartialTransaction, error) {
+	destinations, total, err := txnOrder.GetDestinations(bc.params)
+	if err != nil {
+		return nil, err
+	}
+
+	selection, err := bc.SelectCoins(wallet, total, txnOrder.Fee, txnOrder.Strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	if selection.change > 0 && change == "" {
+		return nil, errors.New(fmt.Sprintf("Change of %f needs a change address", selection.change))
+	}
+
+	if change != "" {
+		_, err = DecodeAddress(change, bc.params)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	outputs := make([]*TxOutput, len(destinations))
+	for i, destination := range destinations {
+		outputs[i] = CreateTxOutput(BuildP2PKHScript([]byte(destination.Addr)), destination.Amount)
+	}
+
+	partial := new(PartialTransaction)
+	partial.network = bc.params.Name
+	partial.txn, err = selection.buildTransaction(outputs, BuildP2PKHScript([]byte(change)), true)
+	if err != nil {
+		return nil, err
+	}
+
+	partial.paid = len(outputs)
+	if selection.change > 0 {
+		partial.paid++
+	}
+
+	for _, fund := range selection.funds {
+		partial.spent = append(partial.spent, fund.txn.outputs[fund.output_id])
+	}
+
+	return partial, nil
+}
+
+func (partial *PartialTransaction) Write(path string) error {
+	payload := new(bytes.Buffer)
+	WriteVarBytes(payload, []byte(partial.network))
+
+	err := partial.txn.Encode(payload)
+	if err != nil {
+		return err
+	}
+
+	WriteVarInt(payload, uint64(len(partial.spent)))
+	for _, output := range partial.spent {
+		err = output.Encode(payload)
+		if err != nil {
+			return err
+		}
+	}
+	WriteVarInt(payload, uint64(partial.paid))
+
+	if payload.Len() > MAX_RECORD_SIZE {
+		return errors.New(fmt.Sprintf("Partial transaction is over %d bytes", MAX_RECORD_SIZE))
+	}
+
+	data := new(bytes.Buffer)
+	WriteFileHeader(data, PARTIAL_FILE_MAGIC)
+	WriteRecord(data, payload.Bytes())
+
+	return WriteFileAtomic(path, data.Bytes(), 0644)
+}
+
+func ReadPartialTransaction(path string) (*PartialTransaction, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	reader := bufio.NewReader(fd)
+
+	version, err := ReadFileHeader(reader, PARTIAL_FILE_MAGIC)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := ReadRecord(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bytes.NewReader(payload)
+	partial := new(PartialTransaction)
+
+	network, err := ReadVarBytes(r, MAX_HASH_SIZE, "Network")
+	if err != nil {
+		return nil, err
+	}
+	partial.network = string(network)
+
+	partial.txn = new(Transaction)
+	err = partial.txn.decode(r, version)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := ReadBoundedVarInt(r, MAX_TXN_INPUTS, "Spent outputs")
+	if err != nil {
+		return nil, err
+	}
+
+	if int(count) != len(partial.txn.inputs) {
+		return nil, errors.New(fmt.Sprintf("%d spent outputs for %d inputs", count, len(partial.txn.inputs)))
+	}
+
+	partial.spent = make([]*TxOutput, count)
+	for i := range partial.spent {
+		partial.spent[i] = new(TxOutput)
+
+		err = partial.spent[i].Decode(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	paid, err := ReadBoundedVarInt(r, uint64(len(partial.txn.outputs)), "Paid outputs")
+	if err != nil {
+		return nil, err
+	}
+	partial.paid = int(paid)
+
+	return partial, nil
+}
+
+// Partial transactions only apply to their own network.
+func (partial *PartialTransaction) CheckNetwork(network string) error {
+	if partial.network != network {
+		return errors.New(fmt.Sprintf("Partial transaction is for %s network, not %s", partial.network, network))
+	}
+
+	return nil
+}
+
+// Output pays wallet key (p2pk or p2pkh).
+func paysKey(wallet *Wallet, output *TxOutput, key ecdsa.PublicKey) bool {
+	p2pkh := BuildP2PKHScript([]byte(wallet.Address(key)))
+	p2pk := BuildP2PKScript(PublicKeyToBytes(key))
+
+	return bytes.Equal(output.script.data, p2pkh.data) || bytes.Equal(output.script.data, p2pk.data)
+}
+
+// Wallet key spending output, if any.
+func spendingKey(wallet *Wallet, output *TxOutput) (*ecdsa.PrivateKey, bool) {
+	for i := range wallet.PrivateKeys {
+		if paysKey(wallet, output, wallet.PrivateKeys[i].PublicKey) {
+			return &wallet.PrivateKeys[i], true
+		}
+	}
+
+	return nil, false
+}
+
+func isOurOutput(wallet *Wallet, output *TxOutput) bool {
+	if _, ok := spendingKey(wallet, output); ok {
+		return true
+	}
+
+	for _, key := range wallet.PublicKeys {
+		if paysKey(wallet, output, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Sign unsigned inputs spending wallet keys, checking each script against
+// the output it spends. Returns inputs signed.
+func (partial *PartialTransaction) Sign(wallet *Wallet) (int, error) {
+	params, err := GetNetworkParams(partial.network)
+	if err != nil {
+		return 0, err
+	}
+
+	signed := 0
+	for i, input := range partial.txn.inputs {
+		if len(input.script.data) > 0 {
+			continue
+		}
+
+		key, ok := spendingKey(wallet, partial.spent[i])
+		if !ok {
+			continue
+		}
+
+		script, err := BuildSpendScript(*key, partial.spent[i].script)
+		if err != nil {
+			return signed, err
+		}
+
+		input.script = script
+
+		vm := NewVM(partial.txn, i)
+		vm.params = params
+		_, err = vm.runInputOutput(*input.script, *partial.spent[i].script)
+		if err != nil {
+			input.script = new(Script)
+			return signed, errors.New(fmt.Sprintf("Input %d: %s", i, err))
+		}
+
+		signed++
+	}
+
+	partial.txn.ComputeHash(true)
+
+	return signed, nil
+}
+
+// Transaction to queue, once all inputs are signed, spent outputs match
+// chain and are still unspent, as funds may be spent while it is signed.
+func (partial *PartialTransaction) Finalize(bc *Blockchain) (*Transaction, error) {
+	err := partial.CheckNetwork(bc.params.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Inputs spend all outputs of their transaction
+	queued := make(map[string]bool)
+	for _, txn := range bc.txnQueue {
+		for _, input := range txn.inputs {
+			queued[string(input.txhash)] = true
+		}
+	}
+
+	// Blocks not stored yet are not in unspent set
+	stored := uint64(0)
+	if bc.store != nil && bc.store.BlockCount() <= uint64(len(bc.blocks)) {
+		stored = bc.store.BlockCount()
+	}
+
+	created := make(map[string]bool)
+	spent := make(map[string]bool)
+	for _, b := range bc.blocks[stored:] {
+		for _, txn := range b.txns {
+			created[string(txn.hash)] = true
+			for _, input := range txn.inputs {
+				spent[string(input.txhash)] = true
+			}
+		}
+	}
+
+	for i, input := range partial.txn.inputs {
+		if len(input.script.data) == 0 {
+			return nil, errors.New(fmt.Sprintf("Input %d is not signed", i))
+		}
+
+		output, err := bc.findOutput(input.txhash, input.output_id)
+		if err != nil {
+			return nil, err
+		}
+
+		if output == nil || !bytes.Equal(output.script.data, partial.spent[i].script.data) || output.amount != partial.spent[i].amount {
+			return nil, errors.New(fmt.Sprintf("Input %d: spent output does not match chain", i))
+		}
+
+		if spent[string(input.txhash)] {
+			return nil, errors.New(fmt.Sprintf("Input %d: output %d of transaction %x is already spent", i, input.output_id, input.txhash))
+		}
+
+		if bc.store != nil && !created[string(input.txhash)] {
+			_, err = bc.store.GetUnspent(input.txhash, input.output_id)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Input %d: %s", i, err))
+			}
+		}
+
+		if queued[string(input.txhash)] {
+			return nil, errors.New(fmt.Sprintf("Input %d: output %d of transaction %x is spent by a queued transaction", i, input.output_id, input.txhash))
+		}
+	}
+
+	return partial.txn, nil
+}
+
+// Inputs with amount, address and whether they are signed, outputs with
+// amount and address, then fee. Copies and outputs paying wallet keys are
+// marked.
+func (partial *PartialTransaction) Summary(wallet *Wallet) string {
+	// Unknown network is reported on signing
+	params, _ := GetNetworkParams(partial.network)
+
+	addresses := func(script *Script) string {
+		list := GetScriptAddresses(script, params)
+		if len(list) == 0 {
+			return "-"
+		}
+
+		return strings.Join(list, ",")
+	}
+
+	var dump string
+
+	dump += fmt.Sprintf("Network: %s\n", partial.network)
+	dump += fmt.Sprintf("Transaction: %x\n", partial.txn.hash)
+
+	fee := 0.0
+	for i, input := range partial.txn.inputs {
+		status := "unsigned"
+		if len(input.script.data) > 0 {
+			status = "signed"
+		}
+
+		fee += partial.spent[i].amount
+		dump += fmt.Sprintf("- Input: %x:%d %f %s %s\n", input.txhash, input.output_id, partial.spent[i].amount,
+			addresses(partial.spent[i].script), status)
+	}
+
+	for i, output := range partial.txn.outputs {
+		line := fmt.Sprintf("- Output: %f %s", output.amount, addresses(output.script))
+
+		if i >= partial.paid {
+			line += " (copy)"
+		} else {
+			fee -= output.amount
+		}
+
+		if isOurOutput(wallet, output) {
+			line += " (ours)"
+		}
+
+		dump += line + "\n"
+	}
+
+	dump += fmt.Sprintf("Fee: %f\n", fee)
+
+	return dump
+}
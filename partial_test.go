@@ -0,0 +1,136 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPartialTransaction(t *testing.T) {
+	dir := t.TempDir()
+
+	// Offline wallet, one key per block
+	offline, _ := LoadWallet(Config{Wallet: filepath.Join(dir, "offline.key")})
+	for i := 0; i < 2; i++ {
+		key, _ := CreateKeyPair()
+		offline.AddPrivateKey(*key)
+	}
+
+	err := offline.WatchOnly().write(filepath.Join(dir, "watch.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watch, err := LoadWallet(Config{Wallet: filepath.Join(dir, "watch.key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(watch.PrivateKeys) != 0 || len(watch.PublicKeys) != 2 {
+		t.Fatalf("Invalid watch-only wallet: %d private keys, %d public keys", len(watch.PrivateKeys), len(watch.PublicKeys))
+	}
+
+	w2 := CreateTestingWallet()
+	addr2 := GetPublicKeyHash(w2.PrivateKeys[0].PublicKey)
+
+	bc := CreateBlockchain()
+	bc.MineBlock(offline.PrivateKeys[0].PublicKey)
+	bc.MineBlock(offline.PrivateKeys[1].PublicKey)
+
+	ControlFunds(t, watch, bc, 200)
+
+	// Watch-only funds cannot be spent directly
+	_, err = bc.CreateTransfertTransaction(watch, &TxnOrder{Addr: addr2, Amount: 30})
+	if err == nil {
+		t.Error("Transaction spending watch-only funds created.")
+	}
+
+	order := &TxnOrder{Addr: addr2, Amount: 130, Fee: 1, Strategy: SELECT_LARGEST_FIRST}
+	_, err = bc.CreatePartialTransaction(watch, order, "")
+	if err == nil {
+		t.Error("Partial transaction created without change address.")
+	}
+
+	change := GetPublicKeyHash(offline.PrivateKeys[0].PublicKey)
+	partial, err := bc.CreatePartialTransaction(watch, order, change)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "txn.partial")
+	err = partial.Write(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing signed yet
+	partial, err = ReadPartialTransaction(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = partial.Finalize(bc)
+	if err == nil {
+		t.Error("Unsigned partial transaction finalized.")
+	}
+
+	signed, err := partial.Sign(w2)
+	if err != nil || signed != 0 {
+		t.Errorf("Inputs signed without key: %d, %v", signed, err)
+	}
+
+	// Offline signing
+	signed, err = partial.Sign(offline)
+	if err != nil || signed != 2 {
+		t.Fatalf("Invalid signing: %d inputs, %v", signed, err)
+	}
+
+	err = partial.Write(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	partial, err = ReadPartialTransaction(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if partial.CheckNetwork(TestNetParams.Name) == nil {
+		t.Error("Partial transaction accepted on another network.")
+	}
+
+	txn, err := partial.Finalize(bc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bc.QueueTransaction(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Funds are spent once queued, mined, then stored
+	_, err = partial.Finalize(bc)
+	if err == nil {
+		t.Error("Partial transaction spending queued funds finalized.")
+	}
+
+	bc.MineBlock(w2.PrivateKeys[0].PublicKey)
+
+	ControlFunds(t, watch, bc, 69)
+	ControlFunds(t, w2, bc, 230)
+
+	_, err = partial.Finalize(bc)
+	if err == nil {
+		t.Error("Partial transaction spending mined funds finalized.")
+	}
+
+	err = bc.SaveBlockchain(Config{Blockchain: t.Name(), Store: STORE_MEMORY})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = partial.Finalize(bc)
+	if err == nil {
+		t.Error("Partial transaction spending stored funds finalized.")
+	}
+}
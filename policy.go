@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Standardness policy: transactions relayed and mined by this node must only
+// use known script templates. Blocks from other nodes are only checked
+// against consensus rules.
+const (
+	MAX_STANDARD_INPUT_SIZE    = 1650
+	MAX_STANDARD_MULTISIG_KEYS = 3
+	MAX_DATA_CARRIER_SIZE      = 80
+)
+
+// Known output script templates.
+const (
+	SCRIPT_NONSTANDARD = "nonstandard"
+	SCRIPT_P2PK        = "p2pk"
+	SCRIPT_P2PKH       = "p2pkh"
+	SCRIPT_MULTISIG    = "multisig"
+	SCRIPT_HTLC        = "htlc"
+	SCRIPT_DATA        = "data"
+)
+
+// Keys must decode, so addresses can be derived from them.
+func isP2PKScript(script *Script) bool {
+	key, _, ok := script.readPush(0)
+	if !ok {
+		return false
+	}
+
+	_, err := GetPublicKeyFromBytes(key)
+
+	return err == nil && bytes.Equal(BuildP2PKScript(key).data, script.data)
+}
+
+func isP2PKHScript(script *Script) bool {
+	// OP_DUP OP_HASH_KEY
+	hash, _, ok := script.readPush(2)
+
+	return ok && bytes.Equal(BuildP2PKHScript(hash).data, script.data)
+}
+
+func isMultisigScript(script *Script) bool {
+	pushes := make([][]byte, 0)
+
+	idx := 0
+	for {
+		elem, next, ok := script.readPush(idx)
+		if !ok {
+			break
+		}
+		pushes = append(pushes, elem)
+		idx = next
+	}
+
+	// m, keys, n
+	if len(pushes) < 3 {
+		return false
+	}
+
+	m, err := StackElemToUint64(pushes[0])
+	if err != nil {
+		return false
+	}
+
+	keys := pushes[1 : len(pushes)-1]
+	if m == 0 || m > uint64(len(keys)) || len(keys) > MAX_STANDARD_MULTISIG_KEYS {
+		return false
+	}
+
+	for _, key := range keys {
+		_, err := GetPublicKeyFromBytes(key)
+		if err != nil {
+			return false
+		}
+	}
+
+	return bytes.Equal(BuildMultisigScript(uint32(m), keys).data, script.data)
+}
+
+func isHTLCScript(script *Script) bool {
+	_, ok := ParseHTLCScript(script)
+
+	return ok
+}
+
+func isDataScript(script *Script) bool {
+	// OP_RETURN
+	data, _, ok := script.readPush(1)
+
+	return ok && len(data) <= MAX_DATA_CARRIER_SIZE && bytes.Equal(BuildDataScript(data).data, script.data)
+}
+
+// Get template of an output script.
+func GetScriptTemplate(script *Script) string {
+	switch {
+	case isP2PKScript(script):
+		return SCRIPT_P2PK
+	case isP2PKHScript(script):
+		return SCRIPT_P2PKH
+	case isMultisigScript(script):
+		return SCRIPT_MULTISIG
+	case isHTLCScript(script):
+		return SCRIPT_HTLC
+	case isDataScript(script):
+		return SCRIPT_DATA
+	}
+
+	return SCRIPT_NONSTANDARD
+}
+
+// Check transaction against standardness policy, returning rejection reason.
+func CheckStandardTransaction(txn *Transaction) error {
+	// Version 0 hash does not cover every field
+	if txn.version != TXN_VERSION {
+		return errors.New(fmt.Sprintf("Non standard transaction version %d", txn.version))
+	}
+
+	for i, input := range txn.inputs {
+		if len(input.script.data) > MAX_STANDARD_INPUT_SIZE {
+			return errors.New(fmt.Sprintf("Non standard input %d: script size %d is over %d bytes", i, len(input.script.data), MAX_STANDARD_INPUT_SIZE))
+		}
+
+		if !input.script.IsPushOnly() {
+			return errors.New(fmt.Sprintf("Non standard input %d: script must only push data", i))
+		}
+	}
+
+	data_outputs := 0
+
+	for i, output := range txn.outputs {
+		switch GetScriptTemplate(output.script) {
+		case SCRIPT_NONSTANDARD:
+			if output.script.IsUnspendable() {
+				return errors.New(fmt.Sprintf("Non standard output %d: data carrier over %d bytes", i, MAX_DATA_CARRIER_SIZE))
+			}
+			return errors.New(fmt.Sprintf("Non standard output %d: unknown script template (%s)", i, output.script))
+
+		case SCRIPT_DATA:
+			if output.amount != 0 {
+				return errors.New(fmt.Sprintf("Non standard output %d: data carrier would burn %f", i, output.amount))
+			}
+
+			data_outputs++
+			if data_outputs > 1 {
+				return errors.New(fmt.Sprintf("Non standard output %d: only one data carrier allowed", i))
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScriptTemplate(t *testing.T) {
+	key, err := CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubkey := PublicKeyToBytes(key.PublicKey)
+	hash := []byte(GetPublicKeyHash(key.PublicKey))
+
+	cases := map[string]*Script{
+		SCRIPT_P2PK:        BuildP2PKScript(pubkey),
+		SCRIPT_P2PKH:       BuildP2PKHScript(hash),
+		SCRIPT_MULTISIG:    BuildMultisigScript(1, [][]byte{pubkey, pubkey}),
+		SCRIPT_HTLC:        BuildHTLCScript(hash, hash, hash, 10),
+		SCRIPT_NONSTANDARD: BuildMultisigScript(1, [][]byte{pubkey, pubkey, pubkey, pubkey}),
+	}
+
+	for template, scp := range cases {
+		if GetScriptTemplate(scp) != template {
+			t.Errorf("Invalid template for %s: %s", template, GetScriptTemplate(scp))
+		}
+	}
+
+	nonstandard := []string{
+		"",
+		"OP_NOP",
+		"OP_CHECKSIG",
+		"0xabcd OP_CHECKSIG OP_NOP",
+		"OP_DUP OP_HASH_KEY OP_PUSH_BYTE 0x01 OP_EQUAL OP_CHECKSIG",
+		"0 0xabcd 1 OP_CHECKMULTISIG",
+		// Keys which don't decode
+		"0xabcd OP_CHECKSIG",
+		"1 0xabcd 1 OP_CHECKMULTISIG",
+	}
+
+	for _, text := range nonstandard {
+		scp, err := AssembleScript(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if GetScriptTemplate(scp) != SCRIPT_NONSTANDARD {
+			t.Errorf("Script should be non standard: %s", text)
+		}
+	}
+}
+
+func TestQueueNonStandardTransaction(t *testing.T) {
+	bc := CreateBlockchain()
+	w1 := CreateTestingWallet()
+	w2 := CreateTestingWallet()
+
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	txnOrder := new(TxnOrder)
+	txnOrder.Amount = 50
+	txnOrder.Addr = GetPublicKeyHash(w2.PrivateKeys[0].PublicKey)
+
+	// Unknown output script
+	scp, _ := AssembleScript("0x01 OP_HASH_MD5 OP_DUP OP_EQUAL")
+	txn, err := bc.CreateScriptTransaction(w1, scp, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bc.QueueTransaction(txn)
+	if err == nil || !strings.Contains(err.Error(), "Non standard output 0") {
+		t.Errorf("Non standard output should be rejected: %v", err)
+	}
+
+	// Consensus still accepts it
+	err = bc.VerifyTransaction(txn, uint64(len(bc.blocks)), bc.blocks[0].timestamp)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Input running instructions
+	txn, err = bc.CreateTransfertTransaction(w1, txnOrder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn.inputs[0].script.addInstruction(OP_NOP)
+	txn.ComputeHash(true)
+
+	err = bc.QueueTransaction(txn)
+	if err == nil || !strings.Contains(err.Error(), "Non standard input 0") {
+		t.Errorf("Non push only input should be rejected: %v", err)
+	}
+
+	// Consensus rejects it too
+	err = bc.VerifyTransaction(txn, uint64(len(bc.blocks)), bc.blocks[0].timestamp)
+	if err == nil {
+		t.Error("Non push only input should be invalid")
+	}
+
+	// Version 0 hash does not cover every field
+	txn, err = bc.CreateTransfertTransaction(w1, txnOrder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn.version = TXN_VERSION_LEGACY
+	txn.ComputeHash(true)
+
+	err = bc.QueueTransaction(txn)
+	if err == nil || !strings.Contains(err.Error(), "Non standard transaction version 0") {
+		t.Errorf("Version 0 transaction should be rejected: %v", err)
+	}
+
+	// Only version 0 inputs spend all outputs
+	txn, err = bc.CreateTransfertTransaction(w1, txnOrder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn.inputs[0].output_id = OUTPUT_ID_ALL
+	txn.ComputeHash(true)
+
+	err = bc.VerifyTransaction(txn, uint64(len(bc.blocks)), bc.blocks[0].timestamp)
+	if err == nil {
+		t.Error("Input of version 1 transaction spends all outputs")
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPruneBlocks(t *testing.T) {
+	// One key per block, so coinbase transactions differ
+	w1 := new(Wallet)
+	for i := 0; i < 12; i++ {
+		key, _ := CreateKeyPair()
+		w1.AddPrivateKey(*key)
+	}
+	w2 := CreateTestingWallet()
+
+	bc := CreateBlockchain()
+	for i := 0; i < 12; i++ {
+		if i == 3 {
+			TransferFund(bc, w1, w2, 30)
+		}
+
+		bc.MineBlock(w1.PrivateKeys[i].PublicKey)
+	}
+
+	f1 := CheckFunds(bc, w1)
+	f2 := CheckFunds(bc, w2)
+
+	for _, backend := range []string{STORE_FILE, STORE_KV, STORE_MEMORY} {
+		c := Config{Blockchain: filepath.Join(t.TempDir(), backend), Store: backend, Prune: 4}
+
+		bc2 := CreateBlockchain()
+		bc2.blocks = append([]*Block{}, bc.blocks...)
+		bc2.last_index = bc.last_index
+
+		// One file per block
+		if backend == STORE_FILE {
+			store, err := OpenBlockStore(c.Blockchain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.max_file_size = 1
+			bc2.store = store
+		}
+
+		err := bc2.SaveBlockchain(c)
+		if err != nil {
+			t.Fatalf("%s: %s", backend, err)
+		}
+		bc2.Close()
+
+		bc3, err := LoadBlockchain(c)
+		if err != nil {
+			t.Fatalf("%s: %s", backend, err)
+		}
+
+		if bc3.pruned != 8 || len(bc3.blocks) != 12 {
+			t.Fatalf("%s: %d blocks, pruned before %d", backend, len(bc3.blocks), bc3.pruned)
+		}
+
+		// Headers are kept
+		for i, b := range bc3.blocks {
+			if !bytes.Equal(b.hash, bc.blocks[i].hash) || !bytes.Equal(b.last_hash, bc.blocks[i].last_hash) {
+				t.Errorf("%s: Invalid header %d", backend, i)
+			}
+		}
+
+		_, err = bc3.GetBlock(0)
+		if err != ErrPrunedBlock {
+			t.Errorf("%s: Pruned block read: %v", backend, err)
+		}
+
+		b, err := bc3.GetBlock(11)
+		if err != nil || len(b.txns) != 1 {
+			t.Errorf("%s: Recent block not read: %v", backend, err)
+		}
+
+		// Funds of pruned blocks are read from unspent set
+		if CheckFunds(bc3, w1) != f1 || CheckFunds(bc3, w2) != f2 {
+			t.Errorf("%s: Invalid funds: %f, %f", backend, CheckFunds(bc3, w1), CheckFunds(bc3, w2))
+		}
+
+		// More than recent blocks hold
+		TransferFund(bc3, w1, w2, 450)
+		bc3.MineBlock(w2.PrivateKeys[0].PublicKey)
+
+		if len(bc3.blocks[12].txns) != 2 {
+			t.Errorf("%s: Transfer of pruned outputs not mined", backend)
+		}
+
+		err = bc3.SaveBlockchain(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if CheckFunds(bc3, w2) != f2+450+100 {
+			t.Errorf("%s: Invalid funds after transfer: %f", backend, CheckFunds(bc3, w2))
+		}
+
+		err = bc3.Reindex()
+		if err == nil {
+			t.Errorf("%s: Pruned chain indexed", backend)
+		}
+
+		if backend == STORE_FILE {
+			_, err = os.Stat(filepath.Join(c.Blockchain, "blk00000.dat"))
+			if !os.IsNotExist(err) {
+				t.Error("Pruned block file kept.")
+			}
+		}
+
+		bc3.Close()
+
+		// Unspent set of a pruned store is kept
+		bc4, err := LoadBlockchain(c)
+		if err != nil {
+			t.Fatalf("%s: %s", backend, err)
+		}
+
+		if bc4.pruned != 9 || CheckFunds(bc4, w2) != f2+450+100 {
+			t.Errorf("%s: Invalid reloaded chain: pruned before %d, funds %f", backend, bc4.pruned, CheckFunds(bc4, w2))
+		}
+
+		bc4.Close()
+	}
+}
+
+// Outputs copied along a spend are not counted twice once their blocks are
+// pruned.
+func TestPruneCopiedOutputs(t *testing.T) {
+	w1 := new(Wallet)
+	for i := 0; i < 12; i++ {
+		key, _ := CreateKeyPair()
+		w1.AddPrivateKey(*key)
+	}
+	w2 := CreateTestingWallet()
+	w3 := CreateTestingWallet()
+
+	bc := CreateBlockchain()
+	for i := 0; i < 12; i++ {
+		switch i {
+		case 1:
+			TransferFund(bc, w1, w2, 30)
+		case 2:
+			TransferFund(bc, w2, w3, 10)
+		}
+
+		bc.MineBlock(w1.PrivateKeys[i].PublicKey)
+	}
+
+	wallets := []*Wallet{w1, w2, w3}
+	funds := make([]float64, len(wallets))
+	for i, wallet := range wallets {
+		funds[i] = CheckFunds(bc, wallet)
+	}
+
+	for _, backend := range []string{STORE_FILE, STORE_KV, STORE_MEMORY} {
+		c := Config{Blockchain: filepath.Join(t.TempDir(), backend), Store: backend}
+
+		bc2 := CreateBlockchain()
+		bc2.blocks = append([]*Block{}, bc.blocks...)
+		bc2.last_index = bc.last_index
+
+		// One file per block
+		if backend == STORE_FILE {
+			store, err := OpenBlockStore(c.Blockchain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.max_file_size = 1
+			bc2.store = store
+		}
+
+		err := bc2.SaveBlockchain(c)
+		if err != nil {
+			t.Fatalf("%s: %s", backend, err)
+		}
+
+		err = bc2.PruneBlocks(8)
+		if err != nil {
+			t.Fatalf("%s: %s", backend, err)
+		}
+		bc2.Close()
+
+		bc3, err := LoadBlockchain(c)
+		if err != nil {
+			t.Fatalf("%s: %s", backend, err)
+		}
+
+		if bc3.pruned != 8 {
+			t.Fatalf("%s: Pruned before %d", backend, bc3.pruned)
+		}
+
+		// Scanned again from unspent set
+		for i, wallet := range wallets {
+			wallet.resetScan()
+			if CheckFunds(bc3, wallet) != funds[i] {
+				t.Errorf("%s: Funds of wallet %d are %f after pruning, %f before", backend, i+1, CheckFunds(bc3, wallet), funds[i])
+			}
+		}
+
+		bc3.Close()
+	}
+}
+
+func TestPruneConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	for _, content := range []string{`{"prune": 10}`, `{"prune": 1000, "txindex": true}`} {
+		os.WriteFile(path, []byte(content), 0644)
+
+		_, err := LoadConfiguration(path)
+		if err == nil {
+			t.Errorf("Invalid configuration loaded: %s", content)
+		}
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"crypto/ecdsa"
+
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Incremental wallet scan. Outputs are matched to wallet keys by script
+// (p2pk and p2pkh), and each block is scanned once, from last scanned one.
+// As in GetFunds, an input spends all outputs of its transaction.
+//
+// Last MAX_SCAN_UNDO blocks can be undone when chain changes under the
+// wallet, it is scanned again from start otherwise.
+const MAX_SCAN_UNDO = 100
+
+type walletFund struct {
+	txn       *Transaction
+	output_id int
+	script    *Script // Input script spending it, nil if watch-only
+	height    int64   // -1 if read from unspent set of pruned blocks
+	position  int
+}
+
+// Funds of saved scan, resolved against chain on next scan.
+type savedFund struct {
+	txhash    []byte
+	output_id uint32
+	height    int64
+	position  int
+}
+
+type scanUndo struct {
+	height    int64
+	last_hash []byte
+	removed   map[string][]*walletFund
+	added     [][]byte
+}
+
+// Input script spending output with key.
+func BuildSpendScript(key ecdsa.PrivateKey, output *Script) (*Script, error) {
+	input := new(Script)
+
+	sign, err := SignMessage(key, output.data)
+	if err != nil {
+		return nil, err
+	}
+	input.addPushBytes(sign)
+
+	if isP2PKHScript(output) {
+		input.addPushBytes(PublicKeyToBytes(key.PublicKey))
+	}
+
+	return input, nil
+}
+
+// Add scripts of keys not known yet, public keys (watch-only) without
+// private key. Returns true if a receiving key was added, whose outputs
+// may be in blocks already scanned, or a private key of a public one.
+func (w *Wallet) registerKeys() bool {
+	if w.scripts == nil {
+		w.scripts = make(map[string]*ecdsa.PrivateKey)
+	}
+
+	added := false
+	register := func(public ecdsa.PublicKey, private *ecdsa.PrivateKey) {
+		p2pkh := BuildP2PKHScript([]byte(w.Address(public)))
+		if key, ok := w.scripts[string(p2pkh.data)]; ok && (key != nil || private == nil) {
+			return
+		} else if ok {
+			added = true
+		}
+
+		w.scripts[string(p2pkh.data)] = private
+		w.scripts[string(BuildP2PKScript(PublicKeyToBytes(public)).data)] = private
+
+		// Change keys are new
+		added = added || !w.IsInternal(public)
+	}
+
+	for i := range w.PrivateKeys {
+		register(w.PrivateKeys[i].PublicKey, &w.PrivateKeys[i])
+	}
+
+	for _, key := range w.PublicKeys {
+		register(key, nil)
+	}
+
+	return added
+}
+
+func (w *Wallet) resetScan() {
+	w.funds = make(map[string][]*walletFund)
+	w.scan_height = 0
+	w.scan_hash = nil
+	w.undo = nil
+	w.saved = nil
+}
+
+// Wallet fund for output, if it is ours.
+func (w *Wallet) matchOutput(txn *Transaction, output_id int, height int64, position int) (*walletFund, error) {
+	output := txn.outputs[output_id]
+	if output == nil {
+		return nil, nil
+	}
+
+	key, ok := w.scripts[string(output.script.data)]
+	if !ok {
+		return nil, nil
+	}
+
+	fund := &walletFund{txn, output_id, nil, height, position}
+	if key != nil {
+		script, err := BuildSpendScript(*key, output.script)
+		if err != nil {
+			return nil, err
+		}
+
+		fund.script = script
+	}
+
+	return fund, nil
+}
+
+func (w *Wallet) addFunds(txn *Transaction, height int64, position int) (bool, error) {
+	funds := []*walletFund{}
+	for i := range txn.outputs {
+		fund, err := w.matchOutput(txn, i, height, position)
+		if err != nil {
+			return false, err
+		}
+
+		if fund != nil {
+			funds = append(funds, fund)
+		}
+	}
+
+	if len(funds) == 0 {
+		return false, nil
+	}
+
+	// Coinbase transactions can share a hash
+	w.funds[string(txn.hash)] = append(w.funds[string(txn.hash)], funds...)
+
+	return true, nil
+}
+
+// Find saved funds in chain. Scan starts again if one is missing.
+func (bc *Blockchain) resolveSavedFunds(w *Wallet, pruned map[string]*Transaction) error {
+	saved := w.saved
+	w.saved = nil
+
+	for _, s := range saved {
+		var txn *Transaction
+
+		if s.height < 0 {
+			txn = pruned[string(s.txhash)]
+		} else if uint64(s.height) >= bc.pruned && uint64(s.height) < uint64(len(bc.blocks)) && s.position < len(bc.blocks[s.height].txns) {
+			txn = bc.blocks[s.height].txns[s.position]
+		}
+
+		if txn == nil || !bytes.Equal(txn.hash, s.txhash) || int(s.output_id) >= len(txn.outputs) {
+			return errors.New(fmt.Sprintf("Saved wallet fund %x:%d not found, scanning chain again", s.txhash, s.output_id))
+		}
+
+		fund, err := w.matchOutput(txn, int(s.output_id), s.height, s.position)
+		if err != nil {
+			return err
+		}
+
+		if fund == nil {
+			return errors.New(fmt.Sprintf("Saved wallet fund %x:%d is not ours, scanning chain again", s.txhash, s.output_id))
+		}
+
+		w.funds[string(txn.hash)] = append(w.funds[string(txn.hash)], fund)
+	}
+
+	return nil
+}
+
+// Undo last scanned block.
+func (w *Wallet) undoBlock() {
+	undo := w.undo[len(w.undo)-1]
+	w.undo = w.undo[:len(w.undo)-1]
+
+	for _, txhash := range undo.added {
+		kept := []*walletFund{}
+		for _, fund := range w.funds[string(txhash)] {
+			if fund.height != undo.height {
+				kept = append(kept, fund)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(w.funds, string(txhash))
+		} else {
+			w.funds[string(txhash)] = kept
+		}
+	}
+
+	for txhash, funds := range undo.removed {
+		w.funds[txhash] = append(w.funds[txhash], funds...)
+	}
+
+	w.scan_height--
+	w.scan_hash = undo.last_hash
+}
+
+// Inputs spend funds of previous blocks, and transactions of this block
+// up to their own. Funds of same hash earlier in block are kept, as a
+// newest first scan finds them.
+func (w *Wallet) scanBlock(b *Block) error {
+	undo := new(scanUndo)
+	undo.height = int64(b.index)
+	undo.last_hash = w.scan_hash
+	undo.removed = make(map[string][]*walletFund)
+
+	spent := make(map[string]bool)
+
+	for position, txn := range b.txns {
+		for _, input := range txn.inputs {
+			spent[string(input.txhash)] = true
+
+			kept := []*walletFund{}
+			for _, fund := range w.funds[string(input.txhash)] {
+				if fund.height == undo.height {
+					kept = append(kept, fund)
+				} else {
+					undo.removed[string(input.txhash)] = append(undo.removed[string(input.txhash)], fund)
+				}
+			}
+
+			if len(kept) == 0 {
+				delete(w.funds, string(input.txhash))
+			} else {
+				w.funds[string(input.txhash)] = kept
+			}
+		}
+
+		if spent[string(txn.hash)] {
+			continue
+		}
+
+		added, err := w.addFunds(txn, int64(b.index), position)
+		if err != nil {
+			return err
+		}
+
+		if added {
+			undo.added = append(undo.added, txn.hash)
+		}
+	}
+
+	w.undo = append(w.undo, undo)
+	if len(w.undo) > MAX_SCAN_UNDO {
+		w.undo = w.undo[1:]
+	}
+
+	w.scan_height = b.index + 1
+	w.scan_hash = b.hash
+
+	return nil
+}
+
+// Bring wallet funds up to chain last block. Wallet is saved when new
+// blocks are scanned.
+func (bc *Blockchain) scanWallet(w *Wallet) error {
+	if w.funds == nil {
+		w.resetScan()
+	}
+
+	if w.registerKeys() {
+		w.resetScan()
+	}
+
+	// Roll back blocks no longer in chain
+	for w.scan_height > 0 {
+		last := w.scan_height - 1
+		if last < uint64(len(bc.blocks)) && bytes.Equal(bc.blocks[last].hash, w.scan_hash) {
+			break
+		}
+
+		if len(w.undo) == 0 {
+			w.resetScan()
+			break
+		}
+
+		w.undoBlock()
+	}
+
+	// Transactions of pruned blocks are gone
+	if w.scan_height < bc.pruned {
+		w.resetScan()
+	}
+
+	scanned := w.scan_height
+
+	var pruned map[string]*Transaction
+	if (w.scan_height == 0 || w.saved != nil) && bc.pruned > 0 {
+		txns, err := bc.getPrunedTransactions()
+		if err != nil {
+			return err
+		}
+
+		pruned = make(map[string]*Transaction)
+		for i, txn := range txns {
+			pruned[string(txn.hash)] = txn
+
+			if w.scan_height == 0 {
+				_, err = w.addFunds(txn, -1, i)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if w.scan_height == 0 {
+			w.scan_height = bc.pruned
+			w.scan_hash = bc.blocks[bc.pruned-1].hash
+		}
+	}
+
+	// Saved funds not matching chain are found again by a full scan
+	if w.saved != nil {
+		err := bc.resolveSavedFunds(w, pruned)
+		if err != nil {
+			w.resetScan()
+			return bc.scanWallet(w)
+		}
+	}
+
+	for height := w.scan_height; height < uint64(len(bc.blocks)); height++ {
+		err := w.scanBlock(bc.blocks[height])
+		if err != nil {
+			return err
+		}
+	}
+
+	if w.scan_height != scanned && w.path != "" {
+		return w.write(w.path)
+	}
+
+	return nil
+}
+
+// Scan chain for unspent outputs matching our wallet private keys, most
+// recent first. Outputs of pruned blocks are read from unspent set. Scan and
+// wallet write errors are returned, funds may be stale then.
+func (bc *Blockchain) GetFunds(wallet *Wallet) ([]*OutputFund, error) {
+	wallet.lock.Lock()
+	defer wallet.lock.Unlock()
+
+	err := bc.scanWallet(wallet)
+	if err != nil {
+		return nil, err
+	}
+
+	funds := make([]*walletFund, 0)
+	for _, list := range wallet.funds {
+		funds = append(funds, list...)
+	}
+
+	sort.Slice(funds, func(i, j int) bool {
+		a, b := funds[i], funds[j]
+		if (a.height < 0) != (b.height < 0) {
+			return b.height < 0
+		}
+		if a.height != b.height {
+			return a.height > b.height
+		}
+		if a.position != b.position {
+			return a.position < b.position
+		}
+		return a.output_id < b.output_id
+	})
+
+	list := make([]*OutputFund, len(funds))
+	for i, fund := range funds {
+		list[i] = &OutputFund{fund.txn, fund.output_id, fund.script}
+	}
+
+	return list, nil
+}
+
+// Saved funds not resolved yet are written unchanged.
+func (w *Wallet) encodeScan(buffer *bytes.Buffer) {
+	if w.saved != nil {
+		WriteVarInt(buffer, w.scan_height)
+		WriteVarBytes(buffer, w.scan_hash)
+		WriteVarInt(buffer, uint64(len(w.saved)))
+
+		for _, s := range w.saved {
+			WriteVarBytes(buffer, s.txhash)
+			WriteVarInt(buffer, uint64(s.output_id))
+			WriteVarInt(buffer, uint64(s.height+1))
+			WriteVarInt(buffer, uint64(s.position))
+		}
+
+		return
+	}
+
+	keys := make([]string, 0, len(w.funds))
+	for key := range w.funds {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	count := 0
+	for _, key := range keys {
+		count += len(w.funds[key])
+	}
+
+	WriteVarInt(buffer, w.scan_height)
+	WriteVarBytes(buffer, w.scan_hash)
+	WriteVarInt(buffer, uint64(count))
+
+	for _, key := range keys {
+		for _, fund := range w.funds[key] {
+			WriteVarBytes(buffer, fund.txn.hash)
+			WriteVarInt(buffer, uint64(fund.output_id))
+			WriteVarInt(buffer, uint64(fund.height+1))
+			WriteVarInt(buffer, uint64(fund.position))
+		}
+	}
+}
+
+// Returns bytes read.
+func (w *Wallet) decodeScan(data []byte) (int, error) {
+	reader := bytes.NewReader(data)
+
+	height, err := ReadVarInt(reader)
+	if err != nil {
+		return 0, err
+	}
+
+	hash, err := ReadVarBytes(reader, MAX_HASH_SIZE, "Scan hash")
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := ReadBoundedVarInt(reader, uint64(len(data)), "Scan funds")
+	if err != nil {
+		return 0, err
+	}
+
+	saved := make([]*savedFund, count)
+	for i := range saved {
+		s := new(savedFund)
+
+		s.txhash, err = ReadVarBytes(reader, MAX_HASH_SIZE, "Fund hash")
+		if err != nil {
+			return 0, err
+		}
+
+		values := make([]uint64, 3)
+		for j := range values {
+			values[j], err = ReadVarInt(reader)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		s.output_id = uint32(values[0])
+		s.height = int64(values[1]) - 1
+		s.position = int(values[2])
+		saved[i] = s
+	}
+
+	w.scan_height = height
+	w.scan_hash = hash
+	w.saved = saved
+
+	return len(data) - reader.Len(), nil
+}
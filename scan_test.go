@@ -0,0 +1,118 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestScanWallet(t *testing.T) {
+	config := Config{Wallet: filepath.Join(t.TempDir(), "wallet.key")}
+
+	// One key per block, so coinbase transactions differ
+	w1, _ := LoadWallet(config)
+	for i := 0; i < 8; i++ {
+		key, _ := CreateKeyPair()
+		w1.AddPrivateKey(*key)
+	}
+	w2 := CreateTestingWallet()
+
+	bc := CreateBlockchain()
+	for i := 0; i < 3; i++ {
+		bc.MineBlock(w1.PrivateKeys[i].PublicKey)
+	}
+
+	ControlFunds(t, w1, bc, 300)
+
+	// Only new blocks are scanned
+	TransferFund(bc, w1, w2, 30)
+	bc.MineBlock(w1.PrivateKeys[3].PublicKey)
+	bc.MineBlock(w2.PrivateKeys[0].PublicKey)
+
+	ControlFunds(t, w1, bc, 370)
+	if w1.scan_height != 5 || len(w1.undo) != 5 {
+		t.Errorf("Invalid scan: %d blocks, %d undo", w1.scan_height, len(w1.undo))
+	}
+
+	// Other branch from block 2
+	bc2 := CreateBlockchain()
+	bc2.blocks = append([]*Block{}, bc.blocks[:3]...)
+	bc2.last_index = 2
+	TransferFund(bc2, w1, w2, 50)
+	for i := 4; i < 8; i++ {
+		bc2.MineBlock(w1.PrivateKeys[i].PublicKey)
+	}
+
+	ControlFunds(t, w1, bc2, 650)
+	ControlFunds(t, w1, bc, 370)
+
+	// Too far to undo
+	w1.undo = nil
+	ControlFunds(t, w1, bc2, 650)
+
+	// Scan is saved
+	w3, err := LoadWallet(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w3.scan_height != 7 || len(w3.saved) != 7 {
+		t.Fatalf("Invalid saved scan: %d blocks, %d funds", w3.scan_height, len(w3.saved))
+	}
+
+	// Written before being resolved, by labelling
+	w3.SetAddressLabel(GetPublicKeyHash(w1.PrivateKeys[0].PublicKey), "mining")
+	err = w3.WriteWallet(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w3, err = LoadWallet(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w3.scan_height != 7 || len(w3.saved) != 7 || w3.GetAddressLabel(GetPublicKeyHash(w1.PrivateKeys[0].PublicKey)) != "mining" {
+		t.Fatalf("Saved scan lost on write: %d blocks, %d funds", w3.scan_height, len(w3.saved))
+	}
+
+	funds, err := bc2.GetFunds(w3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(funds) != 7 || len(w3.undo) != 0 {
+		t.Errorf("Saved funds not used: %d funds, %d blocks scanned", len(funds), len(w3.undo))
+	}
+
+	funds1, err := bc2.GetFunds(w1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, fund := range funds1 {
+		if string(fund.txn.hash) != string(funds[i].txn.hash) || fund.output_id != funds[i].output_id {
+			t.Errorf("Invalid saved fund %d", i)
+		}
+	}
+
+	// Saved scan of another chain
+	w3, _ = LoadWallet(config)
+	ControlFunds(t, w3, bc, 370)
+
+	// Key added to scanned wallet
+	key, _ := CreateKeyPair()
+	bc.MineBlock(key.PublicKey)
+	ControlFunds(t, w3, bc, 370)
+
+	w3.AddPrivateKey(*key)
+	ControlFunds(t, w3, bc, 470)
+
+	// Scan which can't be saved
+	w3.path = filepath.Join(config.Wallet, "missing", "wallet.key")
+	bc.MineBlock(key.PublicKey)
+
+	_, err = bc.GetFunds(w3)
+	if err == nil {
+		t.Error("Wallet write error not returned.")
+	}
+}
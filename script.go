@@ -3,28 +3,46 @@ package main
 import (
 	"encoding/binary"
 	"fmt"
-	"strings"
+	"io"
 )
 
 type Instruction byte
 
 const (
-	OP_NOP         Instruction = iota
-	OP_PUSH_BYTE               = 0x10
-	OP_PUSH_WORD               = 0x11
-	OP_PUSH_DWORD              = 0x12
-	OP_PUSH_BYTES              = 0x13
-	OP_DUP                     = 0x14
-	OP_SWAP                    = 0x15
-	OP_EQUAL                   = 0x20
-	OP_HASH_BASE58             = 0x30
-	OP_HASH_BASE64             = 0x31
-	OP_HASH_TOHEX              = 0x32
-	OP_HASH_MD5                = 0x40
-	OP_HASH_KEY                = 0x41
-	OP_CHECKSIG                = 0x50
+	OP_NOP                 Instruction = iota
+	OP_PUSH_BYTE                       = 0x10
+	OP_PUSH_WORD                       = 0x11
+	OP_PUSH_DWORD                      = 0x12
+	OP_PUSH_BYTES                      = 0x13
+	OP_DUP                             = 0x14
+	OP_SWAP                            = 0x15
+	OP_EQUAL                           = 0x20
+	OP_HASH_BASE58                     = 0x30
+	OP_HASH_BASE64                     = 0x31
+	OP_HASH_TOHEX                      = 0x32
+	OP_HASH_MD5                        = 0x40
+	OP_HASH_KEY                        = 0x41
+	OP_HASH_SHA256                     = 0x42
+	OP_CHECKSIG                        = 0x50
+	OP_CHECKMULTISIG                   = 0x51
+	OP_CHECKLOCKTIMEVERIFY             = 0x60
+	OP_CHECKSEQUENCEVERIFY             = 0x61
+	OP_IF                              = 0x70
+	OP_ELSE                            = 0x71
+	OP_ENDIF                           = 0x72
+	OP_RETURN                          = 0x80
 )
 
+func (inst Instruction) isPush() bool {
+	op := GetOpcode(inst)
+	return op != nil && op.push
+}
+
+func (inst Instruction) isConditional() bool {
+	op := GetOpcode(inst)
+	return op != nil && op.conditional
+}
+
 type Script struct {
 	data []byte
 }
@@ -59,48 +77,84 @@ func (script *Script) addPushBytes(bytes []byte) {
 	script.data = append(script.data, bytes...)
 }
 
-func (script *Script) String() string {
-	elem := make([]string, 0)
-
-	for i := 0; i < len(script.data); {
-		inst := script.data[i]
-		i++
-
-		switch Instruction(inst) {
-		case OP_NOP:
-			elem = append(elem, "OP_NOP")
-		case OP_PUSH_BYTE:
-			elem = append(elem, "OP_PUSH_BYTE")
-			// xxx add byte
-		case OP_PUSH_WORD:
-			elem = append(elem, "OP_PUSH_WORD")
-			// xxx
-		case OP_PUSH_DWORD:
-			elem = append(elem, "OP_PUSH_DWORD")
-			// xxx
-		case OP_PUSH_BYTES:
-			elem = append(elem, "OP_PUSH_BYTES")
-			size_bytes := int(binary.BigEndian.Uint16(script.data[i : i+2]))
-			i += 2
-			bytes := script.data[i : i+size_bytes]
-			elem = append(elem, fmt.Sprintf("0x%x", bytes))
-			i += size_bytes
-		case OP_DUP:
-			elem = append(elem, "OP_DUP")
-		case OP_SWAP:
-			elem = append(elem, "OP_SWAP")
-		case OP_EQUAL:
-			elem = append(elem, "OP_EQUAL")
-		case OP_HASH_KEY:
-			elem = append(elem, "OP_HASH_KEY")
-		case OP_CHECKSIG:
-			elem = append(elem, "OP_CHECKSIG")
-		default:
-			elem = append(elem, fmt.Sprintf("UNKNOWN:0x%x", inst))
+// Push a number using the smallest push instruction able to hold it.
+func (script *Script) addPushNumber(value uint32) {
+	switch {
+	case value <= 0xff:
+		script.addInstruction(OP_PUSH_BYTE)
+		script.addByte(byte(value))
+	case value <= 0xffff:
+		script.addInstruction(OP_PUSH_WORD)
+		script.addWord(uint16(value))
+	default:
+		script.addInstruction(OP_PUSH_DWORD)
+		script.addDword(value)
+	}
+}
+
+// Read data pushed by instruction at given index.
+// Returns data and index of next instruction.
+func (script *Script) readPush(idx int) ([]byte, int, bool) {
+	if idx >= len(script.data) {
+		return nil, idx, false
+	}
+
+	op := GetOpcode(Instruction(script.data[idx]))
+	if op == nil || !op.push {
+		return nil, idx + 1, false
+	}
+
+	return op.parse(script.data, idx+1)
+}
+
+// Outputs starting with OP_RETURN can never be spent.
+func (script *Script) IsUnspendable() bool {
+	return len(script.data) > 0 && Instruction(script.data[0]) == OP_RETURN
+}
+
+// Push only scripts can't run any other instruction.
+func (script *Script) IsPushOnly() bool {
+	for idx := 0; idx < len(script.data); {
+		_, next, ok := script.readPush(idx)
+		if !ok {
+			return false
 		}
+		idx = next
 	}
 
-	return strings.Join(elem, " ")
+	return true
+}
+
+func (script *Script) Encode(w io.Writer) error {
+	return WriteVarBytes(w, script.data)
+}
+
+func (script *Script) Decode(r io.Reader) error {
+	data, err := ReadVarBytes(r, MAX_SCRIPT_SIZE, "Script")
+	if err != nil {
+		return err
+	}
+
+	script.data = data
+
+	return nil
+}
+
+func (script *Script) MarshalBinary() ([]byte, error) {
+	return marshalBinary(script)
+}
+
+func (script *Script) UnmarshalBinary(data []byte) error {
+	return unmarshalBinary(script, data)
+}
+
+func (script *Script) String() string {
+	str, err := script.Disassemble()
+	if err != nil {
+		str += fmt.Sprintf(" [%s]", err)
+	}
+
+	return str
 }
 
 func (script *Script) dump() {
@@ -116,6 +170,30 @@ func BuildP2PKScript(key []byte) *Script {
 	return s
 }
 
+// OP_RETURN <data>
+func BuildDataScript(data []byte) *Script {
+	s := new(Script)
+
+	s.addInstruction(OP_RETURN)
+	s.addPushBytes(data)
+
+	return s
+}
+
+// <m> <key1> ... <keyn> <n> OP_CHECKMULTISIG
+func BuildMultisigScript(m uint32, keys [][]byte) *Script {
+	s := new(Script)
+
+	s.addPushNumber(m)
+	for _, key := range keys {
+		s.addPushBytes(key)
+	}
+	s.addPushNumber(uint32(len(keys)))
+	s.addInstruction(OP_CHECKMULTISIG)
+
+	return s
+}
+
 func BuildP2PKHScript(hash []byte) *Script {
 	s := new(Script)
 
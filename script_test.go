@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/ecdsa"
+
+	"bytes"
 	"testing"
 )
 
@@ -8,19 +11,18 @@ func TestScript1(t *testing.T) {
 	scp := new(Script)
 	scpOutput := new(Script)
 
-	scp.addInstruction(OP_NOP)
-
 	str := []byte("Hello World")
 	scp.addPushBytes(str)
 
 	hash := []byte("b10a8db164e0754105b7a99be72e3fe5")
 	scp.addPushBytes(hash)
 
-	scp.addInstruction(OP_SWAP)
-	scp.addInstruction(OP_HASH_MD5)
-	scp.addInstruction(OP_HASH_TOHEX)
+	scpOutput.addInstruction(OP_NOP)
+	scpOutput.addInstruction(OP_SWAP)
+	scpOutput.addInstruction(OP_HASH_MD5)
+	scpOutput.addInstruction(OP_HASH_TOHEX)
 
-	scp.addInstruction(OP_EQUAL)
+	scpOutput.addInstruction(OP_EQUAL)
 
 	vm := new(VM)
 	res, err := vm.runInputOutput(*scp, *scpOutput)
@@ -44,13 +46,13 @@ func TestScript2(t *testing.T) {
 	scp.addPushBytes(str)
 
 	// Script
-	scp.addInstruction(OP_HASH_MD5)
-	scp.addInstruction(OP_HASH_TOHEX)
+	scpOutput.addInstruction(OP_HASH_MD5)
+	scpOutput.addInstruction(OP_HASH_TOHEX)
 
 	hash := []byte("b10a8db164e0754105b7a99be72e3fe5")
-	scp.addPushBytes(hash)
+	scpOutput.addPushBytes(hash)
 
-	scp.addInstruction(OP_EQUAL)
+	scpOutput.addInstruction(OP_EQUAL)
 
 	vm := new(VM)
 	res, err := vm.runInputOutput(*scp, *scpOutput)
@@ -135,3 +137,700 @@ func TestScript4(t *testing.T) {
 
 	return
 }
+
+func BuildLockedP2PKScript(key []byte, inst Instruction, lock uint32) *Script {
+	output := new(Script)
+	output.addPushNumber(lock)
+	output.addInstruction(inst)
+	output.addBytes(BuildP2PKScript(key).data)
+
+	return output
+}
+
+func TestScriptLockTime(t *testing.T) {
+	key, err := CreateKeyPair()
+	if err != nil {
+		t.Errorf("Could not create key...")
+	}
+
+	output := BuildLockedP2PKScript(PublicKeyToBytes(key.PublicKey), OP_CHECKLOCKTIMEVERIFY, 10)
+
+	input := new(Script)
+	sign, err := SignMessage(*key, output.data)
+	if err != nil {
+		t.Errorf("Could not sign output.")
+	}
+	input.addPushBytes(sign)
+
+	txn := CreateTransaction()
+	txn.AddInput(CreateTxInput([]byte("prev"), 0, input))
+
+	// No transaction context
+	vm := new(VM)
+	res, _ := vm.runInputOutput(*input, *output)
+	if res {
+		t.Error("Script without transaction should fail.")
+	}
+
+	// Input is final: lock time would not be enforced
+	txn.locktime = 10
+	vm = NewVM(txn, 0)
+	res, _ = vm.runInputOutput(*input, *output)
+	if res {
+		t.Error("Script with final input should fail.")
+	}
+
+	// Lock time before required one
+	txn.inputs[0].sequence = 0
+	txn.locktime = 9
+	vm = NewVM(txn, 0)
+	res, _ = vm.runInputOutput(*input, *output)
+	if res {
+		t.Error("Script with lower lock time should fail.")
+	}
+
+	// Timestamp lock time can't satisfy a height
+	txn.locktime = LOCKTIME_THRESHOLD + 10
+	vm = NewVM(txn, 0)
+	res, _ = vm.runInputOutput(*input, *output)
+	if res {
+		t.Error("Script with timestamp lock time should fail.")
+	}
+
+	txn.locktime = 10
+	vm = NewVM(txn, 0)
+	res, err = vm.runInputOutput(*input, *output)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res != true {
+		t.Error("Result is not true.")
+	}
+}
+
+func TestScriptSequence(t *testing.T) {
+	key, err := CreateKeyPair()
+	if err != nil {
+		t.Errorf("Could not create key...")
+	}
+
+	output := BuildLockedP2PKScript(PublicKeyToBytes(key.PublicKey), OP_CHECKSEQUENCEVERIFY, 5)
+
+	input := new(Script)
+	sign, err := SignMessage(*key, output.data)
+	if err != nil {
+		t.Errorf("Could not sign output.")
+	}
+	input.addPushBytes(sign)
+
+	txn := CreateTransaction()
+	txn.AddInput(CreateTxInput([]byte("prev"), 0, input))
+
+	// Relative lock disabled on input
+	vm := NewVM(txn, 0)
+	res, _ := vm.runInputOutput(*input, *output)
+	if res {
+		t.Error("Script with disabled relative lock should fail.")
+	}
+
+	txn.inputs[0].sequence = 4
+	vm = NewVM(txn, 0)
+	res, _ = vm.runInputOutput(*input, *output)
+	if res {
+		t.Error("Script with lower sequence should fail.")
+	}
+
+	txn.inputs[0].sequence = 5 | SEQUENCE_TYPE_FLAG
+	vm = NewVM(txn, 0)
+	res, _ = vm.runInputOutput(*input, *output)
+	if res {
+		t.Error("Script with time based sequence should fail.")
+	}
+
+	txn.inputs[0].sequence = 5
+	vm = NewVM(txn, 0)
+	res, err = vm.runInputOutput(*input, *output)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res != true {
+		t.Error("Result is not true.")
+	}
+}
+
+func TestScriptConditional(t *testing.T) {
+	// Output: OP_IF OP_IF 1 OP_ELSE 2 OP_ENDIF OP_ELSE 3 OP_ENDIF <expected> OP_EQUAL
+	buildOutput := func(expected uint32) *Script {
+		s := new(Script)
+		s.addInstruction(OP_IF)
+		s.addInstruction(OP_IF)
+		s.addPushNumber(1)
+		s.addInstruction(OP_ELSE)
+		s.addPushNumber(2)
+		s.addInstruction(OP_ENDIF)
+		s.addInstruction(OP_ELSE)
+		s.addPushNumber(3)
+		s.addInstruction(OP_ENDIF)
+		s.addPushNumber(expected)
+		s.addInstruction(OP_EQUAL)
+
+		return s
+	}
+
+	cases := []struct {
+		conditions []uint32
+		expected   uint32
+	}{
+		{[]uint32{1, 1}, 1},
+		{[]uint32{0, 1}, 2},
+		{[]uint32{0}, 3},
+	}
+
+	for _, c := range cases {
+		input := new(Script)
+		for _, cond := range c.conditions {
+			input.addPushNumber(cond)
+		}
+
+		vm := new(VM)
+		res, err := vm.runInputOutput(*input, *buildOutput(c.expected))
+		if err != nil {
+			t.Error(err)
+		}
+
+		if res != true {
+			t.Error("Result is not true.")
+		}
+	}
+
+	// Unbalanced
+	input := new(Script)
+	input.addPushNumber(1)
+
+	output := new(Script)
+	output.addInstruction(OP_IF)
+
+	vm := new(VM)
+	res, _ := vm.runInputOutput(*input, *output)
+	if res {
+		t.Error("Unbalanced script should fail.")
+	}
+
+	// A branch can't be opened in input and closed in output
+	input.addInstruction(OP_IF)
+	output = new(Script)
+	output.addInstruction(OP_ENDIF)
+
+	res, _ = vm.runInputOutput(*input, *output)
+	if res {
+		t.Error("Branch across scripts should fail.")
+	}
+}
+
+func TestScriptDisassemble(t *testing.T) {
+	scp := new(Script)
+	scp.addInstruction(OP_NOP)
+	scp.addPushNumber(0x0a)
+	scp.addPushNumber(0x0102)
+	scp.addPushNumber(0x01020304)
+	scp.addPushBytes([]byte{0xab, 0xcd})
+	scp.addInstruction(OP_HASH_MD5)
+	scp.addInstruction(OP_HASH_BASE64)
+	scp.addInstruction(OP_HASH_TOHEX)
+	scp.addByte(0xee)
+
+	control := "OP_NOP OP_PUSH_BYTE 0x0a OP_PUSH_WORD 0x0102 OP_PUSH_DWORD 0x01020304 " +
+		"OP_PUSH_BYTES 0xabcd OP_HASH_MD5 OP_HASH_BASE64 OP_HASH_TOHEX UNKNOWN:0xee"
+
+	str, err := scp.Disassemble()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if str != control {
+		t.Errorf("Invalid disassembly: %s", str)
+	}
+
+	// Assemble it back
+	scp2, err := AssembleScript(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(scp.data, scp2.data) {
+		t.Errorf("Invalid assembly: %x != %x", scp2.data, scp.data)
+	}
+}
+
+func TestScriptDisassembleTruncated(t *testing.T) {
+	scripts := [][]byte{
+		{OP_PUSH_BYTE},
+		{OP_PUSH_WORD, 0x01},
+		{OP_PUSH_DWORD, 0x01, 0x02},
+		{OP_PUSH_BYTES, 0x00},
+		{OP_PUSH_BYTES, 0x00, 0x04, 0x01},
+	}
+
+	for _, data := range scripts {
+		scp := Script{data: data}
+
+		_, err := scp.Disassemble()
+		if err == nil {
+			t.Errorf("Truncated script %x should fail", data)
+		}
+
+		// Must not panic
+		_ = scp.String()
+	}
+}
+
+func TestScriptAssemble(t *testing.T) {
+	scp, err := AssembleScript("OP_DUP OP_HASH_KEY 0xabcd OP_EQUAL OP_CHECKSIG")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	control := BuildP2PKHScript([]byte{0xab, 0xcd})
+	if !bytes.Equal(scp.data, control.data) {
+		t.Errorf("Invalid assembly: %x != %x", scp.data, control.data)
+	}
+
+	// Numbers use smallest push
+	scp, err = AssembleScript("10 OP_CHECKLOCKTIMEVERIFY 1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(scp.data, []byte{OP_PUSH_BYTE, 10, OP_CHECKLOCKTIMEVERIFY, OP_PUSH_WORD, 0x03, 0xe8}) {
+		t.Errorf("Invalid assembly: %x", scp.data)
+	}
+
+	invalids := []string{
+		"OP_UNKNOWN",
+		"OP_PUSH_BYTES",
+		"OP_PUSH_WORD 0x01",
+		"0xabc",
+		"hello",
+	}
+
+	for _, text := range invalids {
+		_, err := AssembleScript(text)
+		if err == nil {
+			t.Errorf("Assembling %s should fail", text)
+		}
+	}
+}
+
+// Hex needs its prefix, numbers are decimal.
+func TestParseScriptText(t *testing.T) {
+	tests := []struct {
+		text string
+		data []byte
+	}{
+		{"10", []byte{OP_PUSH_BYTE, 10}},
+		{"0x10", []byte{0x10}},
+		{" 0x1441130002abcd2050 ", BuildP2PKHScript([]byte{0xab, 0xcd}).data},
+		{"OP_DUP OP_HASH_KEY 0xabcd OP_EQUAL OP_CHECKSIG", BuildP2PKHScript([]byte{0xab, 0xcd}).data},
+	}
+
+	for _, test := range tests {
+		scp, err := ParseScriptText(test.text)
+		if err != nil {
+			t.Fatalf("%s: %s", test.text, err)
+		}
+
+		if !bytes.Equal(scp.data, test.data) {
+			t.Errorf("%s: Invalid script %x", test.text, scp.data)
+		}
+	}
+
+	_, err := ParseScriptText("0xabc")
+	if err == nil {
+		t.Error("Odd hex script parsed.")
+	}
+}
+
+func TestScriptTrace(t *testing.T) {
+	input, err := AssembleScript("0x48656c6c6f20576f726c64")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wrong hash: last instruction fails
+	output, err := AssembleScript("OP_HASH_MD5 OP_HASH_TOHEX 0x6162 OP_EQUAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := make([]*TraceStep, 0)
+	res, err := TraceScripts(nil, *input, *output, func(step *TraceStep) bool {
+		steps = append(steps, step)
+		return true
+	})
+
+	if res || err == nil {
+		t.Error("Script should fail")
+	}
+
+	if len(steps) != 5 {
+		t.Fatalf("Invalid step count: %d", len(steps))
+	}
+
+	if steps[0].output || !steps[1].output {
+		t.Error("Invalid step script part")
+	}
+
+	if steps[1].inst != OP_HASH_MD5 || steps[1].pc != 0 {
+		t.Errorf("Invalid step: %s", steps[1])
+	}
+
+	if len(steps[1].before) != 1 || string(steps[1].before[0]) != "Hello World" {
+		t.Errorf("Invalid stack before step: %s", StackToString(steps[1].before))
+	}
+
+	if len(steps[2].after) != 1 || string(steps[2].after[0]) != "b10a8db164e0754105b7a99be72e3fe5" {
+		t.Errorf("Invalid stack after step: %s", StackToString(steps[2].after))
+	}
+
+	if steps[4].err == nil || steps[4].err != err {
+		t.Error("Last step should hold error")
+	}
+
+	// Abort after first step
+	count := 0
+	res, _ = TraceScripts(nil, *input, *output, func(step *TraceStep) bool {
+		count++
+		return false
+	})
+
+	if res || count != 1 {
+		t.Error("Execution should be aborted")
+	}
+}
+
+func TestScriptLimits(t *testing.T) {
+	scripts := map[string]*Script{
+		"script size":   {data: make([]byte, MAX_SCRIPT_SIZE+1)},
+		"element size":  new(Script),
+		"stack size":    new(Script),
+		"ops count":     new(Script),
+		"hashed length": new(Script),
+	}
+
+	scripts["element size"].addPushBytes(make([]byte, MAX_ELEMENT_SIZE+1))
+
+	for i := 0; i <= MAX_STACK_SIZE; i++ {
+		scripts["stack size"].addPushNumber(1)
+	}
+
+	for i := 0; i <= MAX_SCRIPT_OPS; i++ {
+		scripts["ops count"].addInstruction(OP_NOP)
+	}
+
+	// Hex encoding doubles element size
+	scripts["hashed length"].addPushBytes(make([]byte, MAX_ELEMENT_SIZE/2+1))
+	scripts["hashed length"].addInstruction(OP_HASH_TOHEX)
+
+	for name, scp := range scripts {
+		vm := new(VM)
+		res, err := vm.runInputOutput(Script{}, *scp)
+		if res || err == nil {
+			t.Errorf("Script over %s limit should fail", name)
+		}
+	}
+}
+
+func TestScriptMultisig(t *testing.T) {
+	keys := make([]*ecdsa.PrivateKey, 3)
+	pubkeys := make([][]byte, 3)
+
+	for i := range keys {
+		key, err := CreateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+		pubkeys[i] = PublicKeyToBytes(key.PublicKey)
+	}
+
+	output := BuildMultisigScript(2, pubkeys)
+
+	sign := func(idx ...int) *Script {
+		input := new(Script)
+		for _, i := range idx {
+			s, err := SignMessage(*keys[i], output.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			input.addPushBytes(s)
+		}
+
+		return input
+	}
+
+	cases := []struct {
+		signers []int
+		valid   bool
+	}{
+		{[]int{0, 1}, true},
+		{[]int{0, 2}, true},
+		{[]int{1, 2}, true},
+		{[]int{1, 0}, false},
+		{[]int{2, 2}, false},
+		{[]int{0}, false},
+	}
+
+	for _, c := range cases {
+		vm := new(VM)
+		res, _ := vm.runInputOutput(*sign(c.signers...), *output)
+
+		if res != c.valid {
+			t.Errorf("Invalid multisig result for signers %v: %v", c.signers, res)
+		}
+	}
+}
+
+func TestScriptInputPushOnly(t *testing.T) {
+	key, err := CreateKeyPair()
+	if err != nil {
+		t.Errorf("Could not create key...")
+	}
+
+	// Input script skipping output signature check
+	output := BuildP2PKScript(PublicKeyToBytes(key.PublicKey))
+	input, err := AssembleScript("1 OP_IF")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := new(VM)
+	res, err := vm.runInputOutput(*input, *output)
+	if res || err == nil {
+		t.Error("Input script with instructions should fail.")
+	}
+
+	// Caller scripts are not modified
+	input = new(Script)
+	input.data = make([]byte, 0, 64)
+	input.addPushNumber(1)
+
+	output, err = AssembleScript("1 OP_EQUAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = vm.runInputOutput(*input, *output)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res != true {
+		t.Error("Result is not true.")
+	}
+
+	if input.data[:3][2] != 0 {
+		t.Error("Input script backing array was modified.")
+	}
+}
+
+func TestScriptConcurrent(t *testing.T) {
+	key, err := CreateKeyPair()
+	if err != nil {
+		t.Errorf("Could not create key...")
+	}
+
+	output := BuildP2PKScript(PublicKeyToBytes(key.PublicKey))
+
+	input := new(Script)
+	sign, err := SignMessage(*key, output.data)
+	if err != nil {
+		t.Errorf("Could not sign output.")
+	}
+	input.addPushBytes(sign)
+
+	// Same VM shared by all validations
+	vm := new(VM)
+	results := make(chan error)
+
+	for i := 0; i < 16; i++ {
+		go func() {
+			_, err := vm.runInputOutput(*input, *output)
+			results <- err
+		}()
+	}
+
+	for i := 0; i < 16; i++ {
+		err := <-results
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestOpcodeRegistry(t *testing.T) {
+	// Drop top element
+	const OP_TEST_DROP = 0xf0
+
+	op := &Opcode{inst: OP_TEST_DROP, name: "OP_TEST_DROP", run: func(ex *execution, operand []byte) error {
+		_, err := ex.stack.Pop()
+		return err
+	}}
+
+	err := RegisterOpcode(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delete(opcodes, OP_TEST_DROP)
+
+	if RegisterOpcode(op) == nil {
+		t.Error("Instruction should not be registered twice.")
+	}
+
+	if RegisterOpcode(&Opcode{inst: 0xf1, name: "OP_DUP", run: runNop}) == nil {
+		t.Error("Instruction name should not be registered twice.")
+	}
+
+	if RegisterOpcode(&Opcode{inst: 0xf1, name: "OP_TEST_PUSH", run: runNop, push: true}) == nil {
+		delete(opcodes, 0xf1)
+		t.Error("Push instruction without operand registered.")
+	}
+
+	// Assembler, VM and disassembler all know the new instruction
+	output, err := AssembleScript("1 OP_TEST_DROP")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := new(VM)
+	res, err := vm.runInputOutput(Script{}, *output)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res != true {
+		t.Error("Result is not true.")
+	}
+
+	text, err := output.Disassemble()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if text != "OP_PUSH_BYTE 0x01 OP_TEST_DROP" {
+		t.Errorf("Invalid disassembly: %s", text)
+	}
+}
+
+func TestOpcodeExperimental(t *testing.T) {
+	// base58("a") is "2g"
+	input, err := AssembleScript("0x61")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := AssembleScript("OP_HASH_BASE58 0x3267 OP_EQUAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Disabled on main network
+	vm := new(VM)
+	res, err := vm.runInputOutput(*input, *output)
+	if res || err == nil {
+		t.Error("Experimental instruction should be disabled.")
+	}
+
+	vm.params = &TestNetParams
+	res, err = vm.runInputOutput(*input, *output)
+	if res || err == nil {
+		t.Error("Experimental instruction should be disabled.")
+	}
+
+	vm.params = &RegTestParams
+	res, err = vm.runInputOutput(*input, *output)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res != true {
+		t.Error("Result is not true.")
+	}
+}
+
+// Malformed keys and signatures make instructions fail.
+func TestScriptMalformedKeys(t *testing.T) {
+	key, _ := CreateKeyPair()
+	pubkey := PublicKeyToBytes(key.PublicKey)
+
+	output := new(Script)
+	output.addPushBytes(pubkey)
+	output.addInstruction(OP_CHECKSIG)
+
+	sign, err := SignMessage(*key, output.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Integer larger than any key one, whole
+	oversized := []byte{100, 0, 0, 0}
+	oversized = append(oversized, make([]byte, 100)...)
+	oversized = append(oversized, pubkey...)
+
+	malformed := map[string][]byte{
+		"2 bytes":    {0x01, 0x02},
+		"empty":      {},
+		"size only":  {0xff, 0xff, 0xff, 0xff},
+		"oversized":  oversized,
+		"truncated":  nil,
+		"extra byte": nil,
+	}
+
+	for name, data := range malformed {
+		keyData, signData := data, data
+		switch name {
+		case "truncated":
+			keyData, signData = pubkey[:len(pubkey)-1], sign[:len(sign)-1]
+		case "extra byte":
+			keyData, signData = append(append([]byte{}, pubkey...), 0), append(append([]byte{}, sign...), 0)
+		}
+
+		scripts := map[string][2]*Script{}
+
+		// Valid key, malformed signature
+		input, output := new(Script), new(Script)
+		input.addPushBytes(signData)
+		output.addPushBytes(pubkey)
+		output.addInstruction(OP_CHECKSIG)
+		scripts["OP_CHECKSIG signature"] = [2]*Script{input, output}
+
+		// Valid signature, malformed key
+		input, output = new(Script), new(Script)
+		input.addPushBytes(sign)
+		output.addPushBytes(keyData)
+		output.addInstruction(OP_CHECKSIG)
+		scripts["OP_CHECKSIG key"] = [2]*Script{input, output}
+
+		input, output = new(Script), new(Script)
+		input.addPushBytes(keyData)
+		output.addInstruction(OP_HASH_KEY)
+		scripts["OP_HASH_KEY"] = [2]*Script{input, output}
+
+		input = new(Script)
+		input.addPushBytes(signData)
+		scripts["OP_CHECKMULTISIG signature"] = [2]*Script{input, BuildMultisigScript(1, [][]byte{pubkey})}
+
+		input = new(Script)
+		input.addPushBytes(sign)
+		scripts["OP_CHECKMULTISIG key"] = [2]*Script{input, BuildMultisigScript(1, [][]byte{keyData})}
+
+		for op, pair := range scripts {
+			vm := new(VM)
+			res, err := vm.runInputOutput(*pair[0], *pair[1])
+			if res || err == nil {
+				t.Errorf("%s with %s data should fail", op, name)
+			}
+		}
+	}
+}
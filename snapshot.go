@@ -0,0 +1,337 @@
+package main
+
+import (
+	"crypto/sha256"
+
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Unspent set snapshot, to start a node without replaying the chain. File
+// starts with a header, then two records: network, commitment and block
+// headers up to snapshot block, then unspent outputs after it.
+//
+// An imported chain holds headers only below snapshot block, like a pruned
+// one. Snapshot is checked later by replaying blocks from another store.
+const SNAPSHOT_FILE_MAGIC = 0x53544353 // "STCS"
+
+// Commitment over number of blocks, last block hash, and unspent outputs
+// by outpoint order.
+func SnapshotCommitment(count uint64, tip []byte, utxos map[string]*TxOutput) []byte {
+	keys := make([]string, 0, len(utxos))
+	for key := range utxos {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	WriteVarInt(h, count)
+	WriteVarBytes(h, tip)
+
+	for _, key := range keys {
+		WriteVarBytes(h, []byte(key))
+		utxos[key].Encode(h)
+	}
+
+	return h.Sum(nil)
+}
+
+func writeSnapshot(path string, network string, headers []*Block, utxos map[string]*TxOutput) ([]byte, error) {
+	count := uint64(len(headers))
+	commitment := SnapshotCommitment(count, headers[count-1].hash, utxos)
+
+	first := new(bytes.Buffer)
+	WriteVarBytes(first, []byte(network))
+	WriteVarBytes(first, commitment)
+	WriteVarInt(first, count)
+	for _, header := range headers {
+		err := header.EncodeHeader(first)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	second := new(bytes.Buffer)
+	err := encodeUnspentSet(second, count, utxos)
+	if err != nil {
+		return nil, err
+	}
+
+	data := new(bytes.Buffer)
+	WriteFileHeader(data, SNAPSHOT_FILE_MAGIC)
+
+	for _, payload := range [][]byte{first.Bytes(), second.Bytes()} {
+		if len(payload) > MAX_RECORD_SIZE {
+			return nil, errors.New(fmt.Sprintf("Snapshot is over %d bytes", MAX_RECORD_SIZE))
+		}
+
+		WriteRecord(data, payload)
+	}
+
+	return commitment, WriteFileAtomic(path, data.Bytes(), 0644)
+}
+
+// Read snapshot, checking headers link together and unspent outputs match
+// commitment.
+func readSnapshot(path string) (string, []byte, []*Block, map[string]*TxOutput, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+	defer fd.Close()
+
+	reader := bufio.NewReader(fd)
+
+	_, err = ReadFileHeader(reader, SNAPSHOT_FILE_MAGIC)
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+
+	payload, err := ReadRecord(reader)
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+
+	first := bytes.NewReader(payload)
+
+	network, err := ReadVarBytes(first, MAX_HASH_SIZE, "Network")
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+
+	commitment, err := ReadVarBytes(first, MAX_HASH_SIZE, "Commitment")
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+
+	count, err := ReadBoundedVarInt(first, MAX_RECORD_SIZE, "Snapshot headers")
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+
+	if count == 0 {
+		return "", nil, nil, nil, errors.New("Snapshot has no block")
+	}
+
+	headers := make([]*Block, count)
+	for i := range headers {
+		headers[i] = new(Block)
+
+		err = headers[i].DecodeHeader(first)
+		if err != nil {
+			return "", nil, nil, nil, err
+		}
+
+		if headers[i].index != uint64(i) || (i > 0 && !bytes.Equal(headers[i].last_hash, headers[i-1].hash)) {
+			return "", nil, nil, nil, errors.New(fmt.Sprintf("Snapshot header %d does not follow previous one", i))
+		}
+	}
+
+	payload, err = ReadRecord(reader)
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+
+	utxo_count, utxos, err := decodeUnspentSet(bytes.NewReader(payload))
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+
+	if utxo_count != count {
+		return "", nil, nil, nil, errors.New(fmt.Sprintf("Unspent outputs are after block %d, not %d", utxo_count, count))
+	}
+
+	if !bytes.Equal(SnapshotCommitment(count, headers[count-1].hash, utxos), commitment) {
+		return "", nil, nil, nil, errors.New("Snapshot does not match its commitment")
+	}
+
+	return string(network), commitment, headers, utxos, nil
+}
+
+// Write unspent set after block with given hash. Set is read from store at
+// last block, and rebuilt from blocks otherwise.
+func (bc *Blockchain) ExportSnapshot(path string, hash []byte) ([]byte, error) {
+	height := -1
+	for i, b := range bc.blocks {
+		if bytes.Equal(b.hash, hash) {
+			height = i
+		}
+	}
+
+	if height < 0 {
+		return nil, errors.New(fmt.Sprintf("Block %x not found", hash))
+	}
+
+	utxos := createUnspentSet(nil)
+
+	if height == len(bc.blocks)-1 && bc.store != nil && bc.store.BlockCount() == uint64(len(bc.blocks)) {
+		err := bc.store.ForEachUnspent(func(txhash []byte, output_id uint32, output *TxOutput) error {
+			utxos.add(outpointKey(txhash, output_id), output)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if bc.pruned > 0 {
+			return nil, errors.New(fmt.Sprintf("Blocks before %d are pruned, snapshot can only be taken at last block", bc.pruned))
+		}
+
+		for _, b := range bc.blocks[:height+1] {
+			err := utxos.applyBlock(b)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	headers := make([]*Block, height+1)
+	for i, b := range bc.blocks[:height+1] {
+		headers[i] = b.Header()
+	}
+
+	return writeSnapshot(path, bc.params.Name, headers, utxos.outputs)
+}
+
+// Start an empty store from a snapshot. If expected is set, snapshot
+// commitment must match it. Returns number of blocks and commitment.
+func ImportSnapshot(path string, config Config, expected []byte) (uint64, []byte, error) {
+	network, commitment, headers, utxos, err := readSnapshot(path)
+	if err != nil {
+		return 0, nil, errors.New(fmt.Sprintf("%s: %s", path, err))
+	}
+
+	if expected != nil && !bytes.Equal(commitment, expected) {
+		return 0, nil, errors.New(fmt.Sprintf("Snapshot commitment is %x, not %x", commitment, expected))
+	}
+
+	params, err := GetNetworkParams(config.Network)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if network != params.Name {
+		return 0, nil, errors.New(fmt.Sprintf("Snapshot is for %s network, not %s", network, params.Name))
+	}
+
+	store, err := OpenChainStore(config)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer store.Close()
+
+	if store.BlockCount() > 0 {
+		return 0, nil, errors.New(fmt.Sprintf("%s already holds %d blocks", config.Blockchain, store.BlockCount()))
+	}
+
+	err = store.PutMeta("network", []byte(params.Name))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	err = store.ImportSnapshot(headers, utxos)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	meta := new(bytes.Buffer)
+	WriteVarInt(meta, uint64(len(headers)))
+	WriteVarBytes(meta, commitment)
+
+	err = store.PutMeta("snapshot", meta.Bytes())
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return uint64(len(headers)), commitment, nil
+}
+
+// Number of blocks of imported snapshot not checked yet, 0 if none.
+func (bc *Blockchain) PendingSnapshot() (uint64, []byte, error) {
+	data, err := bc.store.GetMeta("snapshot")
+	if err != nil || data == nil {
+		return 0, nil, err
+	}
+
+	verified, err := bc.store.GetMeta("snapshot-verified")
+	if err != nil || verified != nil {
+		return 0, nil, err
+	}
+
+	reader := bytes.NewReader(data)
+
+	count, err := ReadVarInt(reader)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	commitment, err := ReadVarBytes(reader, MAX_HASH_SIZE, "Commitment")
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return count, commitment, nil
+}
+
+// Check imported snapshot: replay blocks of history up to snapshot, which
+// must match chain headers and give the same unspent outputs.
+func (bc *Blockchain) VerifySnapshot(history ChainStore) error {
+	count, commitment, err := bc.PendingSnapshot()
+	if err != nil || count == 0 {
+		return err
+	}
+
+	err = checkSnapshotHistory(history, bc.params, bc.blocks, count, commitment)
+	if err != nil {
+		return err
+	}
+
+	return bc.store.PutMeta("snapshot-verified", []byte{1})
+}
+
+// Replay history up to snapshot against chain headers. Headers are only
+// read, a copy can be checked while chain grows.
+func checkSnapshotHistory(history ChainStore, params *NetworkParams, headers []*Block, count uint64, commitment []byte) error {
+	if count > uint64(len(headers)) {
+		return errors.New(fmt.Sprintf("Snapshot is after block %d, chain has %d blocks", count, len(headers)))
+	}
+
+	replay := CreateBlockchain()
+	replay.params = params
+	utxos := createUnspentSet(nil)
+
+	for i := uint64(0); i < count; i++ {
+		b, err := history.GetBlock(i)
+		if err != nil {
+			return errors.New(fmt.Sprintf("History block %d: %s", i, err))
+		}
+
+		// Block hash is computed from its content when read
+		if !bytes.Equal(b.hash, headers[i].hash) {
+			return errors.New(fmt.Sprintf("History block %d does not match chain header", i))
+		}
+
+		replay.blocks = append(replay.blocks, b)
+		replay.last_index = i
+
+		err = replay.VerifyBlock(b)
+		if err != nil {
+			return errors.New(fmt.Sprintf("History block %d: %s", i, err))
+		}
+
+		err = utxos.applyBlock(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !bytes.Equal(SnapshotCommitment(count, headers[count-1].hash, utxos.outputs), commitment) {
+		return errors.New(fmt.Sprintf("Unspent outputs after block %d do not match snapshot", count))
+	}
+
+	return nil
+}
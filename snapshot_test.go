@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	// One key per block, so coinbase transactions differ
+	w1 := new(Wallet)
+	for i := 0; i < 6; i++ {
+		key, _ := CreateKeyPair()
+		w1.AddPrivateKey(*key)
+	}
+	w2 := CreateTestingWallet()
+
+	bc := CreateBlockchain()
+	for i := 0; i < 6; i++ {
+		if i == 2 {
+			TransferFund(bc, w1, w2, 30)
+		}
+
+		bc.MineBlock(w1.PrivateKeys[i].PublicKey)
+	}
+
+	dir := t.TempDir()
+	history := Config{Blockchain: filepath.Join(dir, "history")}
+
+	err := bc.SaveBlockchain(history)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "snapshot.dat")
+
+	// Rebuilt from blocks, or read from store at last block
+	middle, err := bc.ExportSnapshot(path, bc.blocks[3].hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commitment, err := bc.ExportSnapshot(path, bc.blocks[5].hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(middle, commitment) {
+		t.Error("Snapshots of different blocks share commitment.")
+	}
+
+	for _, backend := range []string{STORE_FILE, STORE_KV, STORE_MEMORY} {
+		c := Config{Blockchain: filepath.Join(dir, backend), Store: backend}
+
+		_, _, err = ImportSnapshot(path, c, middle)
+		if err == nil {
+			t.Errorf("%s: Snapshot imported with another commitment", backend)
+		}
+
+		count, imported, err := ImportSnapshot(path, c, commitment)
+		if err != nil {
+			t.Fatalf("%s: %s", backend, err)
+		}
+
+		if count != 6 || !bytes.Equal(imported, commitment) {
+			t.Errorf("%s: Invalid import: %d blocks, %x", backend, count, imported)
+		}
+
+		_, _, err = ImportSnapshot(path, c, nil)
+		if err == nil {
+			t.Errorf("%s: Snapshot imported twice", backend)
+		}
+
+		bc2, err := LoadBlockchain(c)
+		if err != nil {
+			t.Fatalf("%s: %s", backend, err)
+		}
+
+		if bc2.pruned != 6 || CheckFunds(bc2, w1) != CheckFunds(bc, w1) || CheckFunds(bc2, w2) != 30 {
+			t.Errorf("%s: Invalid imported chain: pruned before %d", backend, bc2.pruned)
+		}
+
+		// New blocks spend snapshot outputs right away
+		TransferFund(bc2, w1, w2, 250)
+		bc2.MineBlock(w2.PrivateKeys[0].PublicKey)
+
+		err = bc2.SaveBlockchain(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bc2.Close()
+
+		bc2, err = LoadBlockchain(c)
+		if err != nil {
+			t.Fatalf("%s: %s", backend, err)
+		}
+
+		if len(bc2.blocks) != 7 || CheckFunds(bc2, w2) != 30+250+100 {
+			t.Errorf("%s: Invalid chain after snapshot: %d blocks, %f", backend, len(bc2.blocks), CheckFunds(bc2, w2))
+		}
+
+		// Check against blocks
+		store, err := OpenChainStore(history)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = bc2.VerifySnapshot(store)
+		if err != nil {
+			t.Errorf("%s: %s", backend, err)
+		}
+
+		pending, _, _ := bc2.PendingSnapshot()
+		if pending != 0 {
+			t.Errorf("%s: Snapshot still pending", backend)
+		}
+
+		store.Close()
+		bc2.Close()
+	}
+
+	// Snapshot made up with a valid commitment
+	headers := []*Block{}
+	for _, b := range bc.blocks {
+		headers = append(headers, b.Header())
+	}
+
+	set := createUnspentSet(nil)
+	for _, b := range bc.blocks {
+		set.applyBlock(b)
+	}
+
+	utxos := set.outputs
+	key := string(outpointKey(bc.blocks[5].txns[0].hash, 0))
+	utxos[key] = CreateTxOutput(utxos[key].script, 1000)
+
+	_, err = writeSnapshot(path, MainNetParams.Name, headers, utxos)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := Config{Blockchain: filepath.Join(dir, "forged"), Store: STORE_MEMORY}
+
+	_, _, err = ImportSnapshot(path, c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc3, err := LoadBlockchain(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenChainStore(history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	err = bc3.VerifySnapshot(store)
+	if err == nil {
+		t.Error("Forged snapshot checked.")
+	}
+
+	// Another network
+	c = Config{Blockchain: filepath.Join(dir, "regtest"), Store: STORE_MEMORY, Network: RegTestParams.Name}
+
+	_, _, err = ImportSnapshot(path, c, nil)
+	if err == nil {
+		t.Error("Snapshot imported on another network.")
+	}
+}
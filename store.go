@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Persistent chain state: blocks, their hash index, unspent outputs and
+// chain metadata.
+type ChainStore interface {
+	// Append next block, updating indexes and unspent outputs.
+	PutBlock(b *Block) error
+	GetBlock(height uint64) (*Block, error)
+	FindBlock(hash []byte) (*Block, error)
+	BlockCount() uint64
+
+	// Headers are kept when blocks are pruned.
+	GetHeader(height uint64) (*Block, error)
+
+	// Drop blocks below height, keeping their headers. Some may be kept
+	// longer, when stored together with more recent ones.
+	PruneBlocks(height uint64) error
+
+	// First block not pruned.
+	PrunedHeight() uint64
+
+	// Start empty store from headers and unspent outputs after them.
+	// Blocks of headers are pruned.
+	ImportSnapshot(headers []*Block, utxos map[string]*TxOutput) error
+
+	GetUnspent(txhash []byte, output_id uint32) (*TxOutput, error)
+	ForEachUnspent(fn func(txhash []byte, output_id uint32, output *TxOutput) error) error
+
+	// Returns nil if key is not set.
+	GetMeta(key string) ([]byte, error)
+	PutMeta(key string, value []byte) error
+
+	// Chain index records, by key. Records are written together, replacing
+	// all stored ones if replace is set. Empty value removes a record.
+	PutIndexRecords(records map[string][]byte, replace bool) error
+	ForEachIndexRecord(fn func(key string, value []byte) error) error
+
+	Close() error
+}
+
+// Returned when block data was pruned.
+var ErrPrunedBlock = errors.New("Block is pruned")
+
+// Store backends, set by `store` in configuration.
+const (
+	STORE_FILE   = "file"
+	STORE_KV     = "kv"
+	STORE_MEMORY = "memory"
+)
+
+func OpenChainStore(config Config) (ChainStore, error) {
+	switch config.Store {
+	case "", STORE_FILE:
+		return OpenBlockStore(config.Blockchain)
+	case STORE_KV:
+		return OpenKVStore(config.Blockchain)
+	case STORE_MEMORY:
+		return OpenMemoryStore(config.Blockchain), nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("Unknown store: %s", config.Store))
+}
+
+// Backend of an existing store directory, from its files.
+func DetectStore(dir string) string {
+	_, err := os.Stat(filepath.Join(dir, "chain.db"))
+	if err == nil {
+		return STORE_KV
+	}
+
+	return STORE_FILE
+}
+
+// Key of an output in unspent set: transaction hash, then output id.
+func outpointKey(txhash []byte, output_id uint32) []byte {
+	key := make([]byte, len(txhash)+4)
+	copy(key, txhash)
+	binary.BigEndian.PutUint32(key[len(txhash):], output_id)
+
+	return key
+}
+
+func parseOutpointKey(key []byte) ([]byte, uint32) {
+	return key[:len(key)-4], binary.BigEndian.Uint32(key[len(key)-4:])
+}
+
+func encodeTxOutput(output *TxOutput) []byte {
+	data, _ := marshalBinary(output)
+
+	return data
+}
+
+func decodeTxOutput(data []byte) (*TxOutput, error) {
+	output := new(TxOutput)
+
+	err := unmarshalBinary(output, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+// Changes of unspent set made by a block: an input spends all outputs of
+// its transaction, as other ones are copied to the spending transaction.
+// New spendable outputs are added.
+func applyBlockOutputs(b *Block, spend func(txhash []byte) error, add func(key []byte, output *TxOutput) error) error {
+	for _, txn := range b.txns {
+		for _, input := range txn.inputs {
+			err := spend(input.txhash)
+			if err != nil {
+				return err
+			}
+		}
+
+		for i, output := range txn.outputs {
+			if output.script.IsUnspendable() {
+				continue
+			}
+
+			err := add(outpointKey(txn.hash, uint32(i)), output)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Unspent set snapshot: number of blocks applied, then each outpoint key
+// and output.
+func encodeUnspentSet(w io.Writer, count uint64, utxos map[string]*TxOutput) error {
+	err := WriteVarInt(w, count)
+	if err != nil {
+		return err
+	}
+
+	err = WriteVarInt(w, uint64(len(utxos)))
+	if err != nil {
+		return err
+	}
+
+	for key, output := range utxos {
+		err = WriteVarBytes(w, []byte(key))
+		if err != nil {
+			return err
+		}
+
+		err = output.Encode(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func decodeUnspentSet(r io.Reader) (uint64, map[string]*TxOutput, error) {
+	count, err := ReadVarInt(r)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Each output takes at least a byte
+	size, err := ReadBoundedVarInt(r, MAX_RECORD_SIZE, "Unspent outputs")
+	if err != nil {
+		return 0, nil, err
+	}
+
+	utxos := make(map[string]*TxOutput)
+	for i := uint64(0); i < size; i++ {
+		key, err := ReadVarBytes(r, MAX_HASH_SIZE+4, "Outpoint")
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if len(key) < 4 {
+			return 0, nil, errors.New(fmt.Sprintf("Invalid outpoint %x", key))
+		}
+
+		output := new(TxOutput)
+
+		err = output.Decode(r)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		utxos[string(key)] = output
+	}
+
+	return count, utxos, nil
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestChainStores(t *testing.T) {
+	w1 := CreateTestingWallet()
+	w2 := CreateTestingWallet()
+
+	bc := CreateBlockchain()
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	TransferFund(bc, w1, w2, 40)
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	// Transfer spends first coinbase, payment and change are left
+	transfer := bc.blocks[1].txns[1]
+
+	for _, backend := range []string{STORE_FILE, STORE_KV, STORE_MEMORY} {
+		c := Config{Blockchain: t.TempDir(), Store: backend}
+
+		store, err := OpenChainStore(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, b := range bc.blocks {
+			err = store.PutBlock(b)
+			if err != nil {
+				t.Fatalf("%s: %s", backend, err)
+			}
+		}
+
+		err = store.PutBlock(bc.blocks[0])
+		if err == nil {
+			t.Errorf("%s: Block stored twice", backend)
+		}
+
+		err = store.PutMeta("network", []byte("main"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		store.Close()
+
+		// Reopen
+		store, err = OpenChainStore(c)
+		if err != nil {
+			t.Fatalf("%s: %s", backend, err)
+		}
+
+		if store.BlockCount() != 2 {
+			t.Errorf("%s: Invalid block count %d", backend, store.BlockCount())
+		}
+
+		b, err := store.FindBlock(bc.blocks[1].hash)
+		if err != nil || b.index != 1 || len(b.txns) != 2 {
+			t.Errorf("%s: Invalid block found (%v)", backend, err)
+		}
+
+		_, err = store.GetUnspent(bc.blocks[0].txns[0].hash, 0)
+		if err == nil {
+			t.Errorf("%s: Spent output found in unspent set", backend)
+		}
+
+		output, err := store.GetUnspent(transfer.hash, 0)
+		if err != nil || output.amount != 40 {
+			t.Errorf("%s: Invalid unspent output (%v)", backend, err)
+		}
+
+		total := 0.0
+		store.ForEachUnspent(func(txhash []byte, output_id uint32, output *TxOutput) error {
+			if string(txhash) == string(transfer.hash) {
+				total += output.amount
+			}
+			return nil
+		})
+
+		if total != 100 {
+			t.Errorf("%s: Invalid unspent total %f", backend, total)
+		}
+
+		network, err := store.GetMeta("network")
+		if err != nil || string(network) != "main" {
+			t.Errorf("%s: Invalid metadata %s (%v)", backend, network, err)
+		}
+
+		value, err := store.GetMeta("unknown")
+		if err != nil || value != nil {
+			t.Errorf("%s: Unknown metadata found", backend)
+		}
+
+		store.Close()
+	}
+}
+
+func TestIndexRecords(t *testing.T) {
+	for _, backend := range []string{STORE_FILE, STORE_KV, STORE_MEMORY} {
+		c := Config{Blockchain: t.TempDir(), Store: backend}
+
+		store, err := OpenChainStore(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = store.PutIndexRecords(map[string][]byte{"a": []byte("1"), "b": []byte("2")}, false)
+		if err == nil {
+			err = store.PutIndexRecords(map[string][]byte{"b": []byte("3")}, false)
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", backend, err)
+		}
+
+		store.Close()
+
+		// Latest record of each key is read
+		store, err = OpenChainStore(c)
+		if err != nil {
+			t.Fatalf("%s: %s", backend, err)
+		}
+
+		records := make(map[string]string)
+		store.ForEachIndexRecord(func(key string, value []byte) error {
+			records[key] = string(value)
+			return nil
+		})
+
+		if len(records) != 2 || records["a"] != "1" || records["b"] != "3" {
+			t.Errorf("%s: Invalid records %v", backend, records)
+		}
+
+		// Replaced by new index
+		err = store.PutIndexRecords(map[string][]byte{"c": []byte("4")}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		store.Close()
+
+		store, _ = OpenChainStore(c)
+		records = make(map[string]string)
+		store.ForEachIndexRecord(func(key string, value []byte) error {
+			records[key] = string(value)
+			return nil
+		})
+
+		if len(records) != 1 || records["c"] != "4" {
+			t.Errorf("%s: Invalid replaced records %v", backend, records)
+		}
+
+		store.Close()
+	}
+
+	// Only latest records are kept in file
+	store, _ := OpenBlockStore(t.TempDir())
+	for i := 0; i < 100; i++ {
+		store.PutIndexRecords(map[string][]byte{"a": []byte(fmt.Sprintf("%d", i))}, false)
+	}
+
+	info, err := os.Stat(store.txIndexPath())
+	if err != nil || info.Size() > 3*(FILE_HEADER_SIZE+store.txindex_live) {
+		t.Errorf("Stale records kept: %d bytes for %d", info.Size(), store.txindex_live)
+	}
+
+	// Torn record is dropped
+	store, _ = OpenBlockStore(t.TempDir())
+	store.PutIndexRecords(map[string][]byte{"a": []byte("1")}, false)
+	store.PutIndexRecords(map[string][]byte{"b": []byte("2")}, false)
+
+	info, _ = os.Stat(store.txIndexPath())
+	err = os.Truncate(store.txIndexPath(), info.Size()-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenBlockStore(store.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.recovered) != 1 || len(store.txindex) != 1 || string(store.txindex["a"]) != "1" {
+		t.Errorf("Invalid recovered records: %v, %v", store.recovered, store.txindex)
+	}
+}
+
+func TestChainStoreNetwork(t *testing.T) {
+	w1 := CreateTestingWallet()
+
+	bc := CreateBlockchain()
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	c := Config{Blockchain: t.Name(), Store: STORE_MEMORY, Network: "test"}
+	bc.params = &TestNetParams
+
+	err := bc.SaveBlockchain(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Network = "regtest"
+	_, err = LoadBlockchain(c)
+	if err == nil {
+		t.Error("Chain loaded for another network.")
+	}
+}
+
+// Unspent outputs paying wallet add up to its funds: an input spends its
+// whole transaction, whose other outputs are copied.
+func TestUnspentFunds(t *testing.T) {
+	w1 := CreateTestingWallet()
+	w2 := CreateTestingWallet()
+	w3 := CreateTestingWallet()
+	miner := CreateTestingWallet()
+
+	bc := CreateBlockchain()
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	TransferFund(bc, w1, w2, 30)
+	bc.MineBlock(miner.PrivateKeys[0].PublicKey)
+	TransferFund(bc, w2, w3, 10)
+	bc.MineBlock(w3.PrivateKeys[0].PublicKey)
+
+	wallets := []*Wallet{w1, w2, w3, miner}
+
+	for _, backend := range []string{STORE_FILE, STORE_KV, STORE_MEMORY} {
+		c := Config{Blockchain: t.TempDir(), Store: backend}
+
+		store, err := OpenChainStore(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, b := range bc.blocks {
+			err = store.PutBlock(b)
+			if err != nil {
+				t.Fatalf("%s: %s", backend, err)
+			}
+		}
+
+		store.Close()
+
+		store, err = OpenChainStore(c)
+		if err != nil {
+			t.Fatalf("%s: %s", backend, err)
+		}
+
+		totals := make([]float64, len(wallets))
+		store.ForEachUnspent(func(txhash []byte, output_id uint32, output *TxOutput) error {
+			for i, wallet := range wallets {
+				if isOurOutput(wallet, output) {
+					totals[i] += output.amount
+				}
+			}
+			return nil
+		})
+
+		for i, wallet := range wallets {
+			funds := CheckFunds(bc, wallet)
+			if math.Abs(totals[i]-funds) > 0.000001 {
+				t.Errorf("%s: Unspent outputs of wallet %d are %f, funds are %f", backend, i, totals[i], funds)
+			}
+		}
+
+		store.Close()
+	}
+}
+
+// Block as written before transactions had a version.
+func encodeBlockWithoutTxnVersion(b *Block) []byte {
+	buffer := new(bytes.Buffer)
+	WriteVarInt(buffer, b.index)
+	WriteVarBytes(buffer, b.last_hash)
+	WriteVarInt(buffer, b.timestamp)
+	WriteVarInt(buffer, uint64(len(b.txns)))
+
+	for _, txn := range b.txns {
+		data, _ := txn.MarshalBinary()
+		buffer.Write(data[1:])
+	}
+
+	return buffer.Bytes()
+}
+
+// Stores written before transactions had a version are still read.
+func TestChainStoreTxnVersionUpgrade(t *testing.T) {
+	w1 := CreateTestingWallet()
+	w2 := CreateTestingWallet()
+
+	bc := CreateBlockchain()
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	TransferFund(bc, w1, w2, 30)
+	bc.MineBlock(w2.PrivateKeys[0].PublicKey)
+	makeLegacyBlocks(bc.blocks)
+
+	for _, backend := range []string{STORE_FILE, STORE_KV} {
+		c := Config{Blockchain: t.TempDir(), Store: backend}
+
+		store, err := OpenChainStore(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// One file per block
+		paths := []string{}
+		if backend == STORE_FILE {
+			store.(*BlockStore).max_file_size = 1
+			for i := range bc.blocks {
+				paths = append(paths, store.(*BlockStore).blockFilePath(uint32(i)))
+			}
+		}
+
+		for _, b := range bc.blocks {
+			err = store.PutBlock(b)
+			if err != nil {
+				t.Fatalf("%s: %s", backend, err)
+			}
+		}
+		store.Close()
+
+		if backend == STORE_FILE {
+			for i, b := range bc.blocks {
+				data := new(bytes.Buffer)
+				WriteUint32ToFd(data, BLOCK_FILE_MAGIC)
+				WriteUint32ToFd(data, CHAIN_FORMAT_HEADERS)
+				WriteRecord(data, encodeBlockWithoutTxnVersion(b))
+				os.WriteFile(paths[i], data.Bytes(), 0644)
+			}
+		} else {
+			db, err := bolt.Open(filepath.Join(c.Blockchain, "chain.db"), 0644, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			db.Update(func(tx *bolt.Tx) error {
+				for _, b := range bc.blocks {
+					tx.Bucket(bucketBlocks).Put(heightKey(b.index), encodeBlockWithoutTxnVersion(b))
+				}
+
+				version := make([]byte, 8)
+				binary.BigEndian.PutUint64(version, CHAIN_FORMAT_HEADERS)
+				return tx.Bucket(bucketMeta).Put([]byte("format"), version)
+			})
+			db.Close()
+		}
+
+		store, err = OpenChainStore(c)
+		if err != nil {
+			t.Fatalf("%s: %s", backend, err)
+		}
+
+		for i, b := range bc.blocks {
+			stored, err := store.GetBlock(uint64(i))
+			if err != nil {
+				t.Fatalf("%s: %s", backend, err)
+			}
+
+			if !bytes.Equal(stored.hash, b.hash) || stored.txns[0].version != TXN_VERSION_LEGACY {
+				t.Errorf("%s: Block %d changed", backend, i)
+			}
+		}
+
+		// New block is written in current format
+		next := CreateBlock(2, bc.blocks[1].hash)
+		err = store.PutBlock(next)
+		if err != nil {
+			t.Fatalf("%s: %s", backend, err)
+		}
+
+		if backend == STORE_FILE {
+			locations := store.(*BlockStore).locations
+			if locations[2].file == locations[1].file {
+				t.Error("Block appended to a file of an older format.")
+			}
+		}
+		store.Close()
+
+		store, err = OpenChainStore(c)
+		if err != nil {
+			t.Fatalf("%s: %s", backend, err)
+		}
+
+		stored, err := store.GetBlock(2)
+		if err != nil || !bytes.Equal(stored.hash, next.hash) {
+			t.Errorf("%s: New block not read (%v)", backend, err)
+		}
+
+		store.Close()
+	}
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"crypto/sha256"
+
+	"bufio"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"time"
 )
 
 var flagConfigFile string
@@ -12,6 +18,25 @@ var flagListKeys bool
 var flagMine, flagDumpChain bool
 var flagWeb bool
 var flagScan bool
+var flagHistory bool
+var flagLabel string
+var flagHTLCLock, flagHTLCClaim, flagHTLCRefund, flagHTLCPreimage bool
+var flagDest, flagHash, flagPreimage string
+var flagAsm, flagDisasm string
+var flagTimestamp, flagVerifyTimestamp string
+var flagDebugScript, flagStep bool
+var flagInput, flagOutput string
+var flagMigrate string
+var flagReindex bool
+var flagExportSnapshot, flagImportSnapshot, flagVerifySnapshot, flagCommitment string
+var flagExport, flagExportDir, flagAddress string
+var flagExportWatch, flagCreatePartial, flagSignPartial, flagFinalizePartial string
+var flagStrategy, flagChange string
+var flagSignMessage, flagVerifyMessage, flagSignature string
+var flagFrom uint64
+var flagTo int64
+var flagAmount, flagFee float64
+var flagLocktime uint
 
 func init() {
 	flag.BoolVar(&flagCreateKey, "create-key", false, "Create key pair")
@@ -21,6 +46,116 @@ func init() {
 	flag.BoolVar(&flagDumpChain, "dump", false, "Dump chain (debug)")
 	flag.BoolVar(&flagWeb, "web", false, "Launch API server")
 	flag.BoolVar(&flagScan, "scan", false, "Scan blockchain for our funds")
+	flag.BoolVar(&flagHistory, "history", false, "List wallet transactions: height, confirmations, hash, direction, amount, fee, counterparties, label")
+	flag.StringVar(&flagLabel, "label", "", "Label transaction -hash or -address in wallet (empty to remove)")
+	flag.StringVar(&flagAsm, "asm", "", "Assemble script text, printing it as hex")
+	flag.StringVar(&flagDisasm, "disasm", "", "Disassemble hex script, printing it as text")
+	flag.StringVar(&flagTimestamp, "timestamp", "", "Commit hash of given file in chain, and mine it")
+	flag.StringVar(&flagVerifyTimestamp, "verify-timestamp", "", "Find block committing hash of given file")
+	flag.BoolVar(&flagDebugScript, "debug-script", false, "Run -input & -output scripts (hex or text), printing each step")
+	flag.BoolVar(&flagStep, "step", false, "With -debug-script, wait for enter after each step (q to quit)")
+	flag.StringVar(&flagInput, "input", "", "Input script (0x hex or text)")
+	flag.StringVar(&flagOutput, "output", "", "Output script (0x hex or text)")
+	flag.StringVar(&flagMigrate, "migrate", "", "Rewrite given single file chain (.blocks.dat) into configured store")
+	flag.BoolVar(&flagReindex, "reindex", false, "Build transaction and address indexes again")
+	flag.StringVar(&flagExportSnapshot, "export-snapshot", "", "Write unspent outputs after last block (or block -hash) to given file")
+	flag.StringVar(&flagImportSnapshot, "import-snapshot", "", "Start empty chain from given snapshot, checking -commitment if set")
+	flag.StringVar(&flagVerifySnapshot, "verify-snapshot", "", "Check imported snapshot against blocks of given chain directory")
+	flag.StringVar(&flagCommitment, "commitment", "", "Expected snapshot commitment (hex)")
+	flag.StringVar(&flagExport, "export", "", "Export chain as json (to stdout) or csv (tables in -export-dir)")
+	flag.StringVar(&flagExportDir, "export-dir", "export", "Directory of exported csv tables")
+	flag.Uint64Var(&flagFrom, "from", 0, "First exported block")
+	flag.Int64Var(&flagTo, "to", -1, "Last exported block (-1 for last one)")
+	flag.StringVar(&flagAddress, "address", "", "Only export transactions paying or spending from address, address to label, or of signed message")
+
+	flag.StringVar(&flagExportWatch, "export-watch", "", "Write wallet public keys and labels to given watch-only wallet file")
+	flag.StringVar(&flagCreatePartial, "create-partial", "", "Write unsigned transaction paying -amount to -dest, change to -change, to given file")
+	flag.StringVar(&flagSignPartial, "sign-partial", "", "Sign inputs of given partial transaction file with wallet keys (offline)")
+	flag.StringVar(&flagFinalizePartial, "finalize-partial", "", "Check signed partial transaction file against chain, and mine it")
+	flag.Float64Var(&flagFee, "fee", 0, "Transaction fee")
+	flag.StringVar(&flagStrategy, "strategy", "", "Coin selection strategy (newest-first, largest-first, smallest-first, bnb, random)")
+	flag.StringVar(&flagChange, "change", "", "Change address of partial transaction")
+
+	flag.StringVar(&flagSignMessage, "sign-message", "", "Sign given message with wallet key of -address")
+	flag.StringVar(&flagVerifyMessage, "verify-message", "", "Verify -signature of given message by -address")
+	flag.StringVar(&flagSignature, "signature", "", "Message signature (base64)")
+
+	flag.BoolVar(&flagHTLCLock, "htlc-lock", false, "Lock -amount to -dest with -hash (or -preimage) until -locktime, and mine it")
+	flag.BoolVar(&flagHTLCClaim, "htlc-claim", false, "Claim HTLC funds revealing -preimage, and mine it")
+	flag.BoolVar(&flagHTLCRefund, "htlc-refund", false, "Refund HTLC funds locked with -hash, and mine it")
+	flag.BoolVar(&flagHTLCPreimage, "htlc-preimage", false, "Find preimage of -hash revealed by a HTLC claim")
+	flag.StringVar(&flagDest, "dest", "", "Destination address")
+	flag.Float64Var(&flagAmount, "amount", 0, "Amount to send")
+	flag.StringVar(&flagHash, "hash", "", "HTLC hash, snapshot block hash, or transaction to label (hex)")
+	flag.StringVar(&flagPreimage, "preimage", "", "HTLC preimage (hex)")
+	flag.UintVar(&flagLocktime, "locktime", 0, "HTLC refund lock time (block height or timestamp)")
+}
+
+// Queue transaction, then mine it in a new block.
+func MineTransaction(config Config, chain *Blockchain, txn *Transaction) error {
+	err := chain.QueueTransaction(txn)
+	if err != nil {
+		return err
+	}
+
+	err = chain.MineBlock(config.key)
+	if err != nil {
+		return err
+	}
+
+	err = chain.SaveBlockchain(config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Transaction %x mined.\n", txn.hash)
+
+	return nil
+}
+
+// Get HTLC hash from -hash, or computes it from -preimage.
+func HTLCHashFromFlags() ([]byte, error) {
+	if flagHash != "" {
+		return hex.DecodeString(flagHash)
+	}
+
+	preimage, err := hex.DecodeString(flagPreimage)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(preimage)
+
+	return hash[:], nil
+}
+
+// Run input & output scripts, printing each step.
+func DebugScripts(input *Script, output *Script, step bool) {
+	reader := bufio.NewReader(os.Stdin)
+
+	// Allow experimental instructions to try them out, with main network
+	// addresses
+	params := RegTestParams
+	params.AddressVersion = MainNetParams.AddressVersion
+
+	res, err := TraceScripts(&params, *input, *output, func(s *TraceStep) bool {
+		fmt.Print(s)
+
+		if step {
+			line, err := reader.ReadString('\n')
+			if err != nil || line == "q\n" {
+				return false
+			}
+		}
+
+		return true
+	})
+
+	if err != nil {
+		fmt.Printf("Result: %v (%s)\n", res, err)
+	} else {
+		fmt.Printf("Result: %v\n", res)
+	}
 }
 
 var Usage = func() {
@@ -31,11 +166,202 @@ var Usage = func() {
 func main() {
 	flag.Parse()
 
+	// Script tools do not need any configuration
+	if flagAsm != "" {
+		script, err := AssembleScript(flagAsm)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("%x\n", script.data)
+
+		return
+	}
+
+	if flagDebugScript {
+		input, err := ParseScriptText(flagInput)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		output, err := ParseScriptText(flagOutput)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		DebugScripts(input, output, flagStep)
+
+		return
+	}
+
+	if flagDisasm != "" {
+		data, err := hex.DecodeString(flagDisasm)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		script := Script{data: data}
+		str, err := script.Disassemble()
+		fmt.Println(str)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	config, err := LoadConfiguration(flagConfigFile)
 	if err != nil {
 		panic(err)
 	}
 
+	if flagMigrate != "" {
+		count, err := MigrateLegacyChain(flagMigrate, config)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("%d blocks migrated from %s to %s, hashes checked.\n", count, flagMigrate, config.Blockchain)
+
+		return
+	}
+
+	if flagVerifyMessage != "" {
+		params, err := GetNetworkParams(config.Network)
+		if err == nil {
+			err = VerifyAddressMessage(flagAddress, flagVerifyMessage, flagSignature, params)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Println("Signature is valid.")
+
+		return
+	}
+
+	if flagImportSnapshot != "" {
+		var expected []byte
+		if flagCommitment != "" {
+			expected, err = hex.DecodeString(flagCommitment)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+
+		count, commitment, err := ImportSnapshot(flagImportSnapshot, config, expected)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Snapshot of %d blocks imported, commitment: %x\n", count, commitment)
+		if expected == nil {
+			fmt.Printf("Compare commitment with a trusted node, or check snapshot with -verify-snapshot.\n")
+		}
+
+		return
+	}
+
+	if flagExportSnapshot != "" || flagVerifySnapshot != "" {
+		chain, err := LoadBlockchain(config)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		if flagExportSnapshot != "" {
+			if len(chain.blocks) == 0 {
+				fmt.Println("Chain has no block")
+				os.Exit(1)
+			}
+
+			hash := chain.blocks[chain.last_index].hash
+			if flagHash != "" {
+				hash, err = hex.DecodeString(flagHash)
+			}
+
+			var commitment []byte
+			if err == nil {
+				commitment, err = chain.ExportSnapshot(flagExportSnapshot, hash)
+			}
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Snapshot after block %x, commitment: %x\n", hash, commitment)
+		} else {
+			history, err := OpenChainStore(Config{Blockchain: flagVerifySnapshot, Store: DetectStore(flagVerifySnapshot)})
+			if err == nil {
+				err = chain.VerifySnapshot(history)
+				history.Close()
+			}
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Snapshot checked.\n")
+		}
+
+		return
+	}
+
+	if flagExport != "" {
+		chain, err := LoadBlockchain(config)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		filter := ExportFilter{From: flagFrom, To: uint64(flagTo), Address: flagAddress}
+
+		switch flagExport {
+		case EXPORT_JSON:
+			err = chain.ExportJSON(os.Stdout, filter)
+		case EXPORT_CSV:
+			err = chain.ExportCSV(flagExportDir, filter)
+		default:
+			err = errors.New(fmt.Sprintf("Unknown export format: %s", flagExport))
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if flagReindex {
+		// Stored index is replaced, don't read it
+		config.TxIndex = false
+
+		chain, err := LoadBlockchain(config)
+		if err == nil {
+			err = chain.Reindex()
+		}
+		if err == nil {
+			err = chain.SaveBlockchain(config)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("%d transactions, %d addresses indexed.\n", len(chain.index.txs), len(chain.index.addresses))
+
+		return
+	}
+
 	wallet, err := LoadWallet(config)
 	if err != nil {
 		fmt.Println(err)
@@ -57,7 +383,7 @@ func main() {
 			os.Exit(1)
 		}
 
-		fmt.Printf("Your new key hash: %s\n", GetPublicKeyHash(key.PublicKey))
+		fmt.Printf("Your new key hash: %s\n", wallet.Address(key.PublicKey))
 
 		return
 	}
@@ -68,6 +394,93 @@ func main() {
 		return
 	}
 
+	if flagExportWatch != "" {
+		err = wallet.WatchOnly().write(flagExportWatch)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Watch-only wallet written to %s\n", flagExportWatch)
+
+		return
+	}
+
+	if flagSignMessage != "" {
+		signature, err := wallet.SignAddressMessage(flagAddress, flagSignMessage)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Println(signature)
+
+		return
+	}
+
+	// Offline signing needs no chain
+	if flagSignPartial != "" {
+		params, err := GetNetworkParams(config.Network)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		partial, err := ReadPartialTransaction(flagSignPartial)
+		if err == nil {
+			err = partial.CheckNetwork(params.Name)
+		}
+
+		signed := 0
+		if err == nil {
+			signed, err = partial.Sign(wallet)
+		}
+		if err == nil {
+			err = partial.Write(flagSignPartial)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Print(partial.Summary(wallet))
+		fmt.Printf("%d inputs signed.\n", signed)
+
+		return
+	}
+
+	labelSet := false
+	flag.Visit(func(f *flag.Flag) {
+		labelSet = labelSet || f.Name == "label"
+	})
+
+	if labelSet {
+		var err error
+
+		if flagHash != "" {
+			var txhash []byte
+
+			txhash, err = hex.DecodeString(flagHash)
+			if err == nil {
+				err = wallet.SetTransactionLabel(txhash, flagLabel)
+			}
+		} else if flagAddress != "" {
+			err = wallet.SetAddressLabel(flagAddress, flagLabel)
+		} else {
+			err = errors.New("-label needs a transaction -hash or an -address")
+		}
+
+		if err == nil {
+			err = wallet.WriteWallet(config)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	key, err := wallet.GetPublicKeyByHash(config.MiningAddr)
 	config.key = key
 	if err != nil {
@@ -105,15 +518,190 @@ func main() {
 	}
 
 	if flagScan {
-		funds := chain.GetFunds(wallet)
+		funds, err := chain.GetFunds(wallet)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
 		for _, fund := range funds {
 			fmt.Printf("%x: %f\n", fund.txn.hash, fund.txn.outputs[fund.output_id].amount)
 		}
 		return
 	}
 
+	if flagHistory {
+		for _, entry := range chain.GetLedger(wallet) {
+			fmt.Println(entry)
+		}
+		return
+	}
+
+	if flagCreatePartial != "" {
+		order := &TxnOrder{Addr: flagDest, Amount: flagAmount, Fee: flagFee, Strategy: flagStrategy}
+
+		partial, err := chain.CreatePartialTransaction(wallet, order, flagChange)
+		if err == nil {
+			err = partial.Write(flagCreatePartial)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Print(partial.Summary(wallet))
+
+		return
+	}
+
+	if flagFinalizePartial != "" {
+		partial, err := ReadPartialTransaction(flagFinalizePartial)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		txn, err := partial.Finalize(chain)
+		if err == nil {
+			err = MineTransaction(config, chain, txn)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if flagTimestamp != "" {
+		hash, err := HashFile(flagTimestamp)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		txn, err := chain.CreateTimestampTransaction(wallet, hash)
+		if err == nil {
+			err = MineTransaction(config, chain, txn)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Document hash: %x\n", hash)
+
+		return
+	}
+
+	if flagVerifyTimestamp != "" {
+		hash, err := HashFile(flagVerifyTimestamp)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		block, txn, err := chain.FindData(hash)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Document hash: %x\n", hash)
+		fmt.Printf("Transaction: %x\n", txn.hash)
+		fmt.Printf("Block %d: %x\n", block.index, block.hash)
+		fmt.Printf("Timestamp: %s\n", time.Unix(int64(block.timestamp), 0).UTC().Format(time.RFC3339))
+
+		return
+	}
+
+	if flagHTLCLock {
+		hash, err := HTLCHashFromFlags()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		_, err = DecodeAddress(flagDest, chain.params)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		script := BuildHTLCScript(hash, []byte(flagDest), []byte(config.MiningAddr), uint32(flagLocktime))
+
+		txn, err := chain.CreateScriptTransaction(wallet, script, flagAmount)
+		if err == nil {
+			err = MineTransaction(config, chain, txn)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("HTLC hash: %x\n", hash)
+
+		return
+	}
+
+	if flagHTLCClaim {
+		preimage, err := hex.DecodeString(flagPreimage)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		txn, err := chain.CreateHTLCClaimTransaction(wallet, preimage)
+		if err == nil {
+			err = MineTransaction(config, chain, txn)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if flagHTLCRefund {
+		hash, err := HTLCHashFromFlags()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		txn, err := chain.CreateHTLCRefundTransaction(wallet, hash)
+		if err == nil {
+			err = MineTransaction(config, chain, txn)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if flagHTLCPreimage {
+		hash, err := HTLCHashFromFlags()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		preimage, err := chain.FindHTLCPreimage(hash)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("%x\n", preimage)
+
+		return
+	}
+
 	if flagWeb {
-		err := WebRun(config, *wallet, chain)
+		err := WebRun(config, wallet, chain)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/sha256"
+
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Documents are timestamped by committing their sha256 hash in a data
+// carrier output.
+func HashDocument(reader io.Reader) ([]byte, error) {
+	h := sha256.New()
+
+	_, err := io.Copy(h, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+func HashFile(path string) ([]byte, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	return HashDocument(fd)
+}
+
+func (bc *Blockchain) CreateTimestampTransaction(wallet *Wallet, hash []byte) (*Transaction, error) {
+	return bc.CreateScriptTransaction(wallet, BuildDataScript(hash), 0)
+}
+
+// Look for the first block committing data in a data carrier output.
+func (bc *Blockchain) FindData(data []byte) (*Block, *Transaction, error) {
+	for _, b := range bc.blocks {
+		for _, tx := range b.txns {
+			for _, output := range tx.outputs {
+				if !isDataScript(output.script) {
+					continue
+				}
+
+				// OP_RETURN
+				committed, _, _ := output.script.readPush(1)
+				if bytes.Equal(committed, data) {
+					return b, tx, nil
+				}
+			}
+		}
+	}
+
+	return nil, nil, errors.New(fmt.Sprintf("No block commits %x%s", data, bc.prunedNote()))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTimestamp(t *testing.T) {
+	bc := CreateBlockchain()
+	w1 := CreateTestingWallet()
+	w2 := CreateTestingWallet()
+
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	hash, err := HashDocument(strings.NewReader("Hello World"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txn, err := bc.CreateTimestampTransaction(w1, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bc.QueueTransaction(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	block, found, err := bc.FindData(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if block.index != 1 || found != txn {
+		t.Errorf("Invalid block %d for committed data", block.index)
+	}
+
+	// Data output is not a fund, and is not copied when spending
+	TransferFund(bc, w1, w2, 150)
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	for _, b := range bc.blocks[2:] {
+		for _, tx := range b.txns {
+			for _, output := range tx.outputs {
+				if output.script.IsUnspendable() {
+					t.Error("Data output was copied")
+				}
+			}
+		}
+	}
+
+	// Data output can't be spent
+	for k, output := range txn.outputs {
+		if !output.script.IsUnspendable() {
+			continue
+		}
+
+		spend := CreateTransaction()
+		spend.AddInput(CreateTxInput(txn.hash, uint32(k), new(Script)))
+		spend.AddOutput(CreateTxOutput(BuildP2PKHScript([]byte(GetPublicKeyHash(w2.PrivateKeys[0].PublicKey))), 0))
+
+		err = bc.VerifyTransaction(spend, uint64(len(bc.blocks)), block.timestamp)
+		if err == nil {
+			t.Error("Data output should be unspendable")
+		}
+	}
+}
+
+func TestTimestampPolicy(t *testing.T) {
+	bc := CreateBlockchain()
+	w1 := CreateTestingWallet()
+
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	txn, err := bc.CreateTimestampTransaction(w1, make([]byte, MAX_DATA_CARRIER_SIZE+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bc.QueueTransaction(txn)
+	if err == nil || !strings.Contains(err.Error(), "data carrier over") {
+		t.Errorf("Data over size limit should be rejected: %v", err)
+	}
+
+	txn, err = bc.CreateScriptTransaction(w1, BuildDataScript([]byte("data")), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bc.QueueTransaction(txn)
+	if err == nil || !strings.Contains(err.Error(), "would burn") {
+		t.Errorf("Data output with amount should be rejected: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// One instruction run by the VM, with stack before and after it.
+type TraceStep struct {
+	pc       int
+	inst     Instruction
+	code     []byte
+	output   bool
+	executed bool
+	before   [][]byte
+	after    [][]byte
+	err      error
+}
+
+func StackToString(data [][]byte) string {
+	elem := make([]string, len(data))
+	for i, d := range data {
+		elem[i] = fmt.Sprintf("0x%x", d)
+	}
+
+	return "[" + strings.Join(elem, " ") + "]"
+}
+
+func (step *TraceStep) String() string {
+	part := "input"
+	if step.output {
+		part = "output"
+	}
+
+	code := Script{data: step.code}
+	dump := fmt.Sprintf("%-6s %04d %s\n", part, step.pc, code.String())
+
+	if !step.executed {
+		dump += "       (skipped)\n"
+		return dump
+	}
+
+	dump += fmt.Sprintf("       before: %s\n", StackToString(step.before))
+	dump += fmt.Sprintf("       after:  %s\n", StackToString(step.after))
+
+	if step.err != nil {
+		dump += fmt.Sprintf("       error:  %s\n", step.err)
+	}
+
+	return dump
+}
+
+// Run input & output scripts, calling tracer after each instruction.
+func TraceScripts(params *NetworkParams, input Script, output Script, tracer func(step *TraceStep) bool) (bool, error) {
+	vm := new(VM)
+	vm.params = params
+	vm.tracer = tracer
+
+	return vm.runInputOutput(input, output)
+}
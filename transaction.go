@@ -4,15 +4,44 @@ import (
 	"crypto/sha256"
 
 	"fmt"
+	"io"
 	"math"
-	"os"
 	"strconv"
 	"time"
 )
 
+// Transaction versions. Version 0 transactions come from chains written
+// before transactions had a version, and keep their hash definition. Newer
+// ones hash their canonical encoding.
+const (
+	TXN_VERSION_LEGACY = 0
+	TXN_VERSION        = 1
+)
+
+// Output id of inputs from first chains, which spend every output of their
+// transaction (other ones were copied to the spending transaction).
+const OUTPUT_ID_ALL uint32 = math.MaxUint32
+
+// Lock times below this value are block heights, above it unix timestamps.
+const LOCKTIME_THRESHOLD = 500000000
+
+// Input sequence numbers.
+// An input with SEQUENCE_FINAL does not enforce its transaction lock time.
+// The low bits of any other value describe a relative lock (BIP68 like):
+// a number of blocks, or of 512 seconds units when SEQUENCE_TYPE_FLAG is set.
+const (
+	SEQUENCE_FINAL        uint32 = 0xffffffff
+	SEQUENCE_DISABLE_FLAG uint32 = 1 << 31
+	SEQUENCE_TYPE_FLAG    uint32 = 1 << 22
+	SEQUENCE_MASK         uint32 = 0x0000ffff
+	SEQUENCE_GRANULARITY         = 9
+)
+
 type TxInput struct {
-	txhash []byte
-	script *Script
+	txhash    []byte
+	output_id uint32
+	script    *Script
+	sequence  uint32
 }
 
 type TxOutput struct {
@@ -22,18 +51,31 @@ type TxOutput struct {
 
 type Transaction struct {
 	hash      []byte
+	version   uint64
 	timestamp uint64
+	locktime  uint64
 	inputs    []*TxInput
 	outputs   []*TxOutput
 }
 
 func CreateTransaction() *Transaction {
 	tx := new(Transaction)
+	tx.version = TXN_VERSION
 	tx.timestamp = uint64(time.Now().Unix())
 
 	return tx
 }
 
+func CreateTxInput(txhash []byte, output_id uint32, script *Script) *TxInput {
+	input := new(TxInput)
+	input.txhash = txhash
+	input.output_id = output_id
+	input.script = script
+	input.sequence = SEQUENCE_FINAL
+
+	return input
+}
+
 func CreateTxOutput(script *Script, amount float64) *TxOutput {
 	output := new(TxOutput)
 	output.script = script
@@ -47,6 +89,10 @@ func (tx *Transaction) String() string {
 
 	dump += fmt.Sprintf("Txn: %x\n", tx.hash)
 
+	if tx.locktime != 0 {
+		dump += fmt.Sprintf("- Locktime: %d\n", tx.locktime)
+	}
+
 	for j := 0; j < len(tx.inputs); j++ {
 		dump += fmt.Sprintf("- Input: %v\n",
 			tx.inputs[j].script.String())
@@ -71,13 +117,44 @@ func (tx *Transaction) AddOutput(output *TxOutput) {
 	tx.ComputeHash(true)
 }
 
+// Hash of canonical encoding, version included.
 func (tx *Transaction) ComputeHash(update bool) []byte {
+	var hash []byte
+
+	if tx.version == TXN_VERSION_LEGACY {
+		hash = tx.legacyHash()
+	} else {
+		data, _ := tx.MarshalBinary()
+		sum := sha256.Sum256(data)
+		hash = sum[:]
+	}
+
+	if update {
+		tx.hash = hash
+	}
+
+	return hash
+}
+
+// Hash of version 0 transactions. Fields added after first chain format
+// (lock time, output id, sequence) are only hashed when set, so first
+// chains keep their hashes.
+func (tx *Transaction) legacyHash() []byte {
 	h := sha256.New()
 	h.Write([]byte(strconv.FormatUint(tx.timestamp, 10)))
+	if tx.locktime != 0 {
+		h.Write([]byte(strconv.FormatUint(tx.locktime, 10)))
+	}
 
 	for _, input := range tx.inputs {
 		h.Write(input.txhash)
+		if input.output_id != 0 && input.output_id != OUTPUT_ID_ALL {
+			h.Write([]byte(strconv.FormatUint(uint64(input.output_id), 10)))
+		}
 		h.Write(input.script.data)
+		if input.sequence != SEQUENCE_FINAL {
+			h.Write([]byte(strconv.FormatUint(uint64(input.sequence), 10)))
+		}
 	}
 
 	for _, output := range tx.outputs {
@@ -85,93 +162,235 @@ func (tx *Transaction) ComputeHash(update bool) []byte {
 		h.Write([]byte(strconv.FormatUint(math.Float64bits(output.amount), 10)))
 	}
 
-	hash := h.Sum(nil)
+	return h.Sum(nil)
+}
 
-	if update {
-		tx.hash = hash
+// Outputs of previous transaction spent by input, false if its output id
+// is invalid.
+func (input *TxInput) spentOutputs(prev *Transaction) ([]*TxOutput, bool) {
+	if input.output_id == OUTPUT_ID_ALL {
+		outputs := []*TxOutput{}
+		for _, output := range prev.outputs {
+			if output != nil {
+				outputs = append(outputs, output)
+			}
+		}
+
+		return outputs, true
 	}
 
-	return hash
+	if int(input.output_id) >= len(prev.outputs) || prev.outputs[input.output_id] == nil {
+		return nil, false
+	}
+
+	return []*TxOutput{prev.outputs[input.output_id]}, true
 }
 
-// XXX to rewrite using bytes...
-func (tx *Transaction) SaveTransaction(fd *os.File) error {
-	WriteBytesToFd(fd, tx.hash)
-	WriteUint64ToFd(fd, tx.timestamp)
+func (input *TxInput) Encode(w io.Writer) error {
+	err := WriteVarBytes(w, input.txhash)
+	if err != nil {
+		return err
+	}
 
-	WriteUint32ToFd(fd, uint32(len(tx.inputs)))
-	for _, input := range tx.inputs {
-		WriteBytesToFd(fd, input.txhash)
-		WriteBytesToFd(fd, input.script.data)
+	err = WriteVarInt(w, uint64(input.output_id))
+	if err != nil {
+		return err
 	}
 
-	WriteUint32ToFd(fd, uint32(len(tx.outputs)))
-	for _, output := range tx.outputs {
-		WriteBytesToFd(fd, output.script.data)
-		WriteFloat64ToFd(fd, output.amount)
+	err = input.script.Encode(w)
+	if err != nil {
+		return err
 	}
 
+	return WriteVarInt(w, uint64(input.sequence))
+}
+
+func (input *TxInput) Decode(r io.Reader) error {
+	var err error
+
+	input.txhash, err = ReadVarBytes(r, MAX_HASH_SIZE, "Input hash")
+	if err != nil {
+		return err
+	}
+
+	output_id, err := ReadBoundedVarInt(r, math.MaxUint32, "Input output id")
+	if err != nil {
+		return err
+	}
+	input.output_id = uint32(output_id)
+
+	input.script = new(Script)
+	err = input.script.Decode(r)
+	if err != nil {
+		return err
+	}
+
+	sequence, err := ReadBoundedVarInt(r, math.MaxUint32, "Input sequence")
+	if err != nil {
+		return err
+	}
+	input.sequence = uint32(sequence)
+
 	return nil
 }
 
-func CreateTransactionFromFd(fd *os.File) (*Transaction, error) {
+func (output *TxOutput) Encode(w io.Writer) error {
+	err := output.script.Encode(w)
+	if err != nil {
+		return err
+	}
+
+	return WriteAmount(w, output.amount)
+}
+
+func (output *TxOutput) Decode(r io.Reader) error {
 	var err error
-	var i uint32
-	txn := CreateTransaction()
 
-	txn.hash, err = ReadBytesFromFd(fd)
+	output.script = new(Script)
+	err = output.script.Decode(r)
+	if err != nil {
+		return err
+	}
+
+	output.amount, err = ReadAmount(r)
+
+	return err
+}
+
+// Hash is not encoded, it is computed again when decoding.
+func (tx *Transaction) Encode(w io.Writer) error {
+	err := WriteVarInt(w, tx.version)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	txn.timestamp, err = ReadUint64FromFd(fd)
+	err = WriteVarInt(w, tx.timestamp)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	input_cnt, err := ReadUint32FromFd(fd)
+	err = WriteVarInt(w, tx.locktime)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	for i = 0; i < input_cnt; i++ {
-		input := new(TxInput)
+	err = WriteVarInt(w, uint64(len(tx.inputs)))
+	if err != nil {
+		return err
+	}
 
-		input.txhash, err = ReadBytesFromFd(fd)
+	for _, input := range tx.inputs {
+		err = input.Encode(w)
 		if err != nil {
-			return nil, err
+			return err
 		}
+	}
+
+	err = WriteVarInt(w, uint64(len(tx.outputs)))
+	if err != nil {
+		return err
+	}
 
-		input.script = new(Script)
-		input.script.data, err = ReadBytesFromFd(fd)
+	for _, output := range tx.outputs {
+		err = output.Encode(w)
 		if err != nil {
-			return nil, err
+			return err
 		}
+	}
+
+	return nil
+}
+
+func (tx *Transaction) Decode(r io.Reader) error {
+	return tx.decode(r, CHAIN_FORMAT_VERSION)
+}
+
+// Transactions of chain formats before CHAIN_FORMAT_TXN_VERSION have no
+// version.
+func (tx *Transaction) decode(r io.Reader, format uint32) error {
+	var err error
 
-		txn.AddInput(input)
+	if format >= CHAIN_FORMAT_TXN_VERSION {
+		tx.version, err = ReadBoundedVarInt(r, TXN_VERSION, "Transaction version")
+		if err != nil {
+			return err
+		}
 	}
 
-	output_cnt, err := ReadUint32FromFd(fd)
+	tx.timestamp, err = ReadVarInt(r)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	for i = 0; i < output_cnt; i++ {
-		output := new(TxOutput)
+	tx.locktime, err = ReadVarInt(r)
+	if err != nil {
+		return err
+	}
 
-		output.script = new(Script)
-		output.script.data, err = ReadBytesFromFd(fd)
+	input_cnt, err := ReadBoundedVarInt(r, MAX_TXN_INPUTS, "Transaction inputs")
+	if err != nil {
+		return err
+	}
+
+	tx.inputs = make([]*TxInput, input_cnt)
+	for i := range tx.inputs {
+		tx.inputs[i] = new(TxInput)
+
+		err = tx.inputs[i].Decode(r)
 		if err != nil {
-			return nil, err
+			return err
 		}
+	}
+
+	output_cnt, err := ReadBoundedVarInt(r, MAX_TXN_OUTPUTS, "Transaction outputs")
+	if err != nil {
+		return err
+	}
+
+	tx.outputs = make([]*TxOutput, output_cnt)
+	for i := range tx.outputs {
+		tx.outputs[i] = new(TxOutput)
 
-		output.amount, err = ReadFloat64FromFd(fd)
+		err = tx.outputs[i].Decode(r)
 		if err != nil {
-			return nil, err
+			return err
 		}
+	}
 
-		txn.AddOutput(output)
+	tx.ComputeHash(true)
+
+	return nil
+}
+
+func (tx *Transaction) MarshalBinary() ([]byte, error) {
+	return marshalBinary(tx)
+}
+
+func (tx *Transaction) UnmarshalBinary(data []byte) error {
+	return unmarshalBinary(tx, data)
+}
+
+// A transaction is final, and can be included in a block, when its lock time
+// is reached at given height / time, or when all its inputs are final.
+func (tx *Transaction) IsFinal(height uint64, timestamp uint64) bool {
+	if tx.locktime == 0 {
+		return true
+	}
+
+	limit := height
+	if tx.locktime >= LOCKTIME_THRESHOLD {
+		limit = timestamp
+	}
+
+	if tx.locktime < limit {
+		return true
+	}
+
+	for _, input := range tx.inputs {
+		if input.sequence != SEQUENCE_FINAL {
+			return false
+		}
 	}
 
-	return txn, nil
+	return true
 }
@@ -3,19 +3,58 @@ package main
 import (
 	"crypto/ecdsa"
 
+	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
+	"sync"
 )
 
+// Wallet file records start with their type.
+const (
+	WALLET_PRIVATE_KEY  = 0x01
+	WALLET_INTERNAL_KEY = 0x02 // Private key receiving change
+	WALLET_TXN_LABEL    = 0x03 // Transaction hash (hex), then label
+	WALLET_ADDR_LABEL   = 0x04 // Address, then label
+	WALLET_SCAN         = 0x05 // Last scanned block and funds found
+	WALLET_PUBLIC_KEY   = 0x06 // Watch-only key
+	WALLET_INTERNAL_PUB = 0x07 // Watch-only key receiving change
+)
+
+const MAX_LABEL_SIZE = 256
+
 type Wallet struct {
 	PublicKeys  []ecdsa.PublicKey
 	PrivateKeys []ecdsa.PrivateKey
+
+	internal    map[string]bool // Main network hashes of change keys
+	params      *NetworkParams  // Network of addresses, main if nil
+	txn_labels  map[string]string
+	addr_labels map[string]string
+	path        string // File written on change key creation and scan, if set
+
+	// Scan state
+	lock        sync.Mutex
+	scripts     map[string]*ecdsa.PrivateKey // Output script to key, nil if watch-only
+	funds       map[string][]*walletFund     // By transaction hash
+	scan_height uint64                       // Blocks scanned
+	scan_hash   []byte
+	undo        []*scanUndo
+	saved       []*savedFund
 }
 
 func LoadWallet(config Config) (*Wallet, error) {
 	w := new(Wallet)
+	w.path = config.Wallet
+
+	params, err := GetNetworkParams(config.Network)
+	if err != nil {
+		return w, err
+	}
+	w.params = params
 
 	if _, err := os.Stat(config.Wallet); os.IsNotExist(err) {
 		return w, nil
@@ -39,7 +78,7 @@ func LoadWallet(config Config) (*Wallet, error) {
 		idx++
 
 		switch typ {
-		case 0x01:
+		case WALLET_PRIVATE_KEY, WALLET_INTERNAL_KEY:
 			// Read PrivateKey
 			key, idxtmp, err := BytesToPrivateKey(bytes[idx:])
 			idx += idxtmp
@@ -48,29 +87,197 @@ func LoadWallet(config Config) (*Wallet, error) {
 			}
 
 			w.AddPrivateKey(key)
+			if typ == WALLET_INTERNAL_KEY {
+				w.setInternal(key.PublicKey)
+			}
+		case WALLET_TXN_LABEL, WALLET_ADDR_LABEL:
+			key, label, idxtmp, err := readWalletLabel(bytes[idx:])
+			idx += idxtmp
+			if err != nil {
+				return w, err
+			}
+
+			if typ == WALLET_TXN_LABEL {
+				w.txn_labels = setLabel(w.txn_labels, key, label)
+			} else {
+				w.addr_labels = setLabel(w.addr_labels, key, label)
+			}
+		case WALLET_PUBLIC_KEY, WALLET_INTERNAL_PUB:
+			key, idxtmp, err := readWalletPublicKey(bytes[idx:])
+			idx += idxtmp
+			if err != nil {
+				return w, err
+			}
+
+			w.AddPublicKey(key)
+			if typ == WALLET_INTERNAL_PUB {
+				w.setInternal(key)
+			}
+		case WALLET_SCAN:
+			idxtmp, err := w.decodeScan(bytes[idx:])
+			idx += idxtmp
+			if err != nil {
+				return w, err
+			}
 		default:
 			fmt.Println("Invalid type", typ)
 		}
 	}
 
+	// Keep loaded scan
+	w.registerKeys()
+	w.funds = make(map[string][]*walletFund)
+
 	return w, nil
 }
 
 func (w *Wallet) WriteWallet(config Config) error {
-	fd, err := os.Create(config.Wallet)
-	if err != nil {
-		return err
-	}
-	defer fd.Close()
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.write(config.Wallet)
+}
+
+func (w *Wallet) write(path string) error {
+	data := []byte{}
 
 	for _, key := range w.PrivateKeys {
 		pkbytes := PrivateKeyToBytes(key)
-		fd.Write(pkbytes)
+		if w.IsInternal(key.PublicKey) {
+			pkbytes[0] = WALLET_INTERNAL_KEY
+		}
+		data = append(data, pkbytes...)
+	}
+
+	for _, key := range w.PublicKeys {
+		buffer := bytes.NewBuffer([]byte{WALLET_PUBLIC_KEY})
+		if w.IsInternal(key) {
+			buffer = bytes.NewBuffer([]byte{WALLET_INTERNAL_PUB})
+		}
+
+		WriteVarBytes(buffer, PublicKeyToBytes(key))
+		data = append(data, buffer.Bytes()...)
+	}
+
+	for _, typ := range []byte{WALLET_TXN_LABEL, WALLET_ADDR_LABEL} {
+		labels := w.txn_labels
+		if typ == WALLET_ADDR_LABEL {
+			labels = w.addr_labels
+		}
+
+		keys := make([]string, 0, len(labels))
+		for key := range labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			buffer := bytes.NewBuffer([]byte{typ})
+			WriteVarBytes(buffer, []byte(key))
+			WriteVarBytes(buffer, []byte(labels[key]))
+			data = append(data, buffer.Bytes()...)
+		}
+	}
+
+	// Saved funds not resolved yet are written back as read
+	if w.scan_height > 0 {
+		buffer := bytes.NewBuffer([]byte{WALLET_SCAN})
+		w.encodeScan(buffer)
+		data = append(data, buffer.Bytes()...)
+	}
+
+	return WriteFileAtomic(path, data, 0600)
+}
+
+// Returns key & bytes read
+func readWalletPublicKey(data []byte) (ecdsa.PublicKey, int, error) {
+	reader := bytes.NewReader(data)
+
+	key, err := ReadVarBytes(reader, 2*MAX_KEY_INT_SIZE+8, "Public key")
+	if err != nil {
+		return ecdsa.PublicKey{}, 0, err
+	}
+
+	pk, err := GetPublicKeyFromBytes(key)
+	if err != nil {
+		return ecdsa.PublicKey{}, 0, err
 	}
 
+	return pk, len(data) - reader.Len(), nil
+}
+
+// Returns key, label & bytes read
+func readWalletLabel(data []byte) (string, string, int, error) {
+	reader := bytes.NewReader(data)
+
+	key, err := ReadVarBytes(reader, MAX_LABEL_SIZE, "Label key")
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	label, err := ReadVarBytes(reader, MAX_LABEL_SIZE, "Label")
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	return string(key), string(label), len(data) - reader.Len(), nil
+}
+
+// Empty label removes key.
+func setLabel(labels map[string]string, key string, label string) map[string]string {
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+
+	if label == "" {
+		delete(labels, key)
+	} else {
+		labels[key] = label
+	}
+
+	return labels
+}
+
+func (w *Wallet) SetTransactionLabel(txhash []byte, label string) error {
+	if len(label) > MAX_LABEL_SIZE {
+		return errors.New(fmt.Sprintf("Label is over %d bytes", MAX_LABEL_SIZE))
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.txn_labels = setLabel(w.txn_labels, hex.EncodeToString(txhash), label)
+
+	return nil
+}
+
+func (w *Wallet) SetAddressLabel(address string, label string) error {
+	if len(label) > MAX_LABEL_SIZE || len(address) > MAX_LABEL_SIZE {
+		return errors.New(fmt.Sprintf("Label or address is over %d bytes", MAX_LABEL_SIZE))
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.addr_labels = setLabel(w.addr_labels, address, label)
+
 	return nil
 }
 
+func (w *Wallet) GetTransactionLabel(txhash []byte) string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.txn_labels[hex.EncodeToString(txhash)]
+}
+
+func (w *Wallet) GetAddressLabel(address string) string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.addr_labels[address]
+}
+
 func (w *Wallet) AddPrivateKey(key ecdsa.PrivateKey) {
 	w.PrivateKeys = append(w.PrivateKeys, key)
 }
@@ -79,33 +286,120 @@ func (w *Wallet) AddPublicKey(key ecdsa.PublicKey) {
 	w.PublicKeys = append(w.PublicKeys, key)
 }
 
+func (w *Wallet) setInternal(key ecdsa.PublicKey) {
+	if w.internal == nil {
+		w.internal = make(map[string]bool)
+	}
+
+	w.internal[GetPublicKeyHash(key)] = true
+}
+
+// Copy of wallet without private keys, with labels, for a watch-only
+// node.
+func (w *Wallet) WatchOnly() *Wallet {
+	watch := new(Wallet)
+	watch.params = w.params
+
+	for _, key := range w.PrivateKeys {
+		watch.AddPublicKey(key.PublicKey)
+	}
+	for _, key := range w.PublicKeys {
+		watch.AddPublicKey(key)
+	}
+
+	watch.internal = make(map[string]bool)
+	for hash := range w.internal {
+		watch.internal[hash] = true
+	}
+
+	for key, label := range w.txn_labels {
+		watch.txn_labels = setLabel(watch.txn_labels, key, label)
+	}
+	for key, label := range w.addr_labels {
+		watch.addr_labels = setLabel(watch.addr_labels, key, label)
+	}
+
+	return watch
+}
+
+// Change keys are internal, receive keys are not.
+func (w *Wallet) IsInternal(key ecdsa.PublicKey) bool {
+	return w.internal[GetPublicKeyHash(key)]
+}
+
+// Create a key receiving change of one transaction. Wallet is written
+// before returning, so change is never sent to a lost key.
+func (w *Wallet) CreateChangeKey() (*ecdsa.PrivateKey, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	key, err := CreateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	w.AddPrivateKey(*key)
+	w.setInternal(key.PublicKey)
+
+	if w.path != "" {
+		err = w.write(w.path)
+		if err != nil {
+			// Not saved, don't use it
+			w.PrivateKeys = w.PrivateKeys[:len(w.PrivateKeys)-1]
+			delete(w.internal, GetPublicKeyHash(key.PublicKey))
+
+			return nil, err
+		}
+	}
+
+	return key, nil
+}
+
 func (w *Wallet) List() {
 
 	if len(w.PrivateKeys) > 0 {
 		fmt.Println("Private keys")
 		for _, key := range w.PrivateKeys {
-			fmt.Println(GetPublicKeyHash(key.PublicKey))
+			fmt.Println(w.describeKey(key.PublicKey))
 		}
 	}
 
 	if len(w.PublicKeys) > 0 {
 		fmt.Println("Public keys")
 		for _, key := range w.PublicKeys {
-			fmt.Println(key)
+			fmt.Println(w.describeKey(key))
 		}
 	}
 }
 
+// Key hash, internal flag and label.
+func (w *Wallet) describeKey(key ecdsa.PublicKey) string {
+	line := w.Address(key)
+	if w.IsInternal(key) {
+		line += " (internal)"
+	}
+	if label := w.GetAddressLabel(w.Address(key)); label != "" {
+		line += fmt.Sprintf(" %q", label)
+	}
+
+	return line
+}
+
+// Address of key on wallet network.
+func (w *Wallet) Address(key ecdsa.PublicKey) string {
+	return GetAddress(key, w.params)
+}
+
 func (w *Wallet) GetPublicKeyByHash(hash string) (ecdsa.PublicKey, error) {
 	for _, key := range w.PrivateKeys {
-		current_hash := GetPublicKeyHash(key.PublicKey)
+		current_hash := w.Address(key.PublicKey)
 		if current_hash == hash {
 			return key.PublicKey, nil
 		}
 	}
 
 	for _, key := range w.PublicKeys {
-		current_hash := GetPublicKeyHash(key)
+		current_hash := w.Address(key)
 		if current_hash == hash {
 			return key, nil
 		}
@@ -116,7 +410,7 @@ func (w *Wallet) GetPublicKeyByHash(hash string) (ecdsa.PublicKey, error) {
 
 func (w *Wallet) GetPrivateKeyByHash(hash string) (ecdsa.PrivateKey, error) {
 	for _, key := range w.PrivateKeys {
-		current_hash := GetPublicKeyHash(key.PublicKey)
+		current_hash := w.Address(key.PublicKey)
 		if current_hash == hash {
 			return key, nil
 		}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestChangeKeys(t *testing.T) {
+	config := Config{Wallet: filepath.Join(t.TempDir(), "wallet.key")}
+
+	w1, err := LoadWallet(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc := CreateBlockchain()
+	w2 := CreateTestingWallet()
+
+	// No key, no funds
+	_, err = bc.CreateTransfertTransaction(w1, &TxnOrder{Addr: GetPublicKeyHash(w2.PrivateKeys[0].PublicKey), Amount: 10})
+	if err == nil {
+		t.Error("Transfer from empty wallet created.")
+	}
+
+	key, _ := CreateKeyPair()
+	w1.AddPrivateKey(*key)
+	err = w1.WriteWallet(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc.MineBlock(key.PublicKey)
+	TransferFund(bc, w1, w2, 10)
+	bc.MineBlock(w2.PrivateKeys[0].PublicKey)
+	TransferFund(bc, w1, w2, 10)
+	bc.MineBlock(w2.PrivateKeys[0].PublicKey)
+
+	// Each change has its own key
+	change1 := bc.blocks[1].txns[1].outputs[1].script
+	change2 := bc.blocks[2].txns[1].outputs[1].script
+	if change1.String() == change2.String() || change1.String() == BuildP2PKHScript([]byte(GetPublicKeyHash(key.PublicKey))).String() {
+		t.Error("Change key reused.")
+	}
+
+	ControlFunds(t, w1, bc, 80)
+
+	// Change keys are saved, marked internal
+	w3, err := LoadWallet(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(w3.PrivateKeys) != 3 || w3.IsInternal(w3.PrivateKeys[0].PublicKey) || !w3.IsInternal(w3.PrivateKeys[1].PublicKey) || !w3.IsInternal(w3.PrivateKeys[2].PublicKey) {
+		t.Errorf("Invalid saved wallet: %d keys", len(w3.PrivateKeys))
+	}
+
+	ControlFunds(t, w3, bc, 80)
+
+	// No change, no key
+	_, err = bc.CreateTransfertTransaction(w3, &TxnOrder{Addr: GetPublicKeyHash(w2.PrivateKeys[0].PublicKey), Amount: 80})
+	if err != nil || len(w3.PrivateKeys) != 3 {
+		t.Errorf("Key created without change: %v", err)
+	}
+}
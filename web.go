@@ -1,10 +1,16 @@
 package main
 
 import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	// "html"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -13,8 +19,10 @@ type WebDaemon struct {
 	Config     Config
 	Mine       chan bool
 	Txn        chan *TxnOrder
+	Data       chan []byte
+	Snapshot   chan error
 	Blockchain *Blockchain
-	Wallet     Wallet
+	Wallet     *Wallet
 }
 
 func (wd *WebDaemon) MineHandler(w http.ResponseWriter, r *http.Request) {
@@ -22,33 +30,75 @@ func (wd *WebDaemon) MineHandler(w http.ResponseWriter, r *http.Request) {
 	wd.Mine <- true
 }
 
-func (wd *WebDaemon) AddTransactionHandler(w http.ResponseWriter, r *http.Request) {
-	// Add a transaction to transaction queue
-	// Input
-	// - A destination address (hash)
-	// - An amount.
+// Order from JSON body (TxnOrder fields, destinations for several
+// recipients), or from form: destination address (dest), amount, fee and
+// coin selection strategy.
+func parseTxnOrder(r *http.Request) (*TxnOrder, error) {
+	txnOrder := new(TxnOrder)
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+
+		err := decoder.Decode(txnOrder)
+		if err != nil {
+			return nil, err
+		}
+
+		return txnOrder, nil
+	}
 
 	r.ParseForm()
 	fmt.Println(r.PostForm)
 
-	txnOrder := new(TxnOrder)
 	txnOrder.Addr = ""
 	txnOrder.Amount = 0
 
-	if _, ok := r.PostForm["amount"]; ok {
-		f, err := strconv.ParseFloat(r.PostForm["amount"][0], 64)
-		if err != nil {
-			fmt.Fprintf(w, "NOT OK")
-			return
-		}
+	for name, value := range map[string]*float64{"amount": &txnOrder.Amount, "fee": &txnOrder.Fee} {
+		if _, ok := r.PostForm[name]; ok {
+			f, err := strconv.ParseFloat(r.PostForm[name][0], 64)
+			if err != nil {
+				return nil, err
+			}
 
-		txnOrder.Amount = f
+			*value = f
+		}
 	}
 
 	if _, ok := r.PostForm["dest"]; ok {
 		txnOrder.Addr = r.PostForm["dest"][0]
 	}
 
+	if _, ok := r.PostForm["strategy"]; ok {
+		txnOrder.Strategy = r.PostForm["strategy"][0]
+	}
+
+	return txnOrder, nil
+}
+
+func (wd *WebDaemon) AddTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	// Add a transaction to transaction queue
+	// Input
+	// - A destination address (hash)
+	// - An amount.
+	//   or a JSON list of destinations
+	// - A fee and coin selection strategy (optional)
+	// Funds are chosen by transaction creator, then reported after OK.
+
+	txnOrder, err := parseTxnOrder(r)
+	if err != nil {
+		fmt.Fprintf(w, "NOT OK")
+		return
+	}
+
+	_, _, err = txnOrder.GetDestinations(wd.Blockchain.params)
+	if err != nil {
+		fmt.Fprintf(w, "NOT OK %s", err)
+		return
+	}
+
+	txnOrder.result = make(chan error, 1)
+
 	select {
 	case wd.Txn <- txnOrder:
 	default:
@@ -56,52 +106,374 @@ func (wd *WebDaemon) AddTransactionHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	err = <-txnOrder.result
+	if err != nil {
+		fmt.Fprintf(w, "NOT OK %s", err)
+		return
+	}
+
+	fmt.Fprintf(w, "OK\n%s", txnOrder.selection)
+}
+
+// Report funds a transaction order would spend, without queuing it.
+func (wd *WebDaemon) SelectCoinsHandler(w http.ResponseWriter, r *http.Request) {
+	txnOrder, err := parseTxnOrder(r)
+	if err != nil {
+		fmt.Fprintf(w, "NOT OK")
+		return
+	}
+
+	_, total, err := txnOrder.GetDestinations(wd.Blockchain.params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	wd.Blockchain.lock.Lock()
+	selection, err := wd.Blockchain.SelectCoins(wd.Wallet, total, txnOrder.Fee, txnOrder.Strategy)
+	wd.Blockchain.lock.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Fprint(w, selection)
+}
+
+func (wd *WebDaemon) TimestampHandler(w http.ResponseWriter, r *http.Request) {
+	// Commit hash of an uploaded document
+	// Input
+	// - A file.
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		fmt.Fprintf(w, "NOT OK")
+		return
+	}
+	defer file.Close()
+
+	hash, err := HashDocument(file)
+	if err != nil {
+		fmt.Fprintf(w, "NOT OK")
+		return
+	}
+
+	select {
+	case wd.Data <- hash:
+	default:
+		fmt.Fprintf(w, "NOT QUEUED")
+		return
+	}
+
+	fmt.Fprintf(w, "OK %x", hash)
+}
+
+func (wd *WebDaemon) VerifyTimestampHandler(w http.ResponseWriter, r *http.Request) {
+	hash, err := hex.DecodeString(mux.Vars(r)["hash"])
+	if err != nil {
+		fmt.Fprintf(w, "NOT OK")
+		return
+	}
+
+	wd.Blockchain.lock.Lock()
+	defer wd.Blockchain.lock.Unlock()
+
+	block, txn, err := wd.Blockchain.FindData(hash)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	fmt.Fprintf(w, "%x %d %x %s", txn.hash, block.index, block.hash,
+		time.Unix(int64(block.timestamp), 0).UTC().Format(time.RFC3339))
+}
+
+// Pruned blocks are gone, only their header is kept.
+func (wd *WebDaemon) BlockHandler(w http.ResponseWriter, r *http.Request) {
+	height, err := strconv.ParseUint(mux.Vars(r)["height"], 10, 64)
+	if err != nil {
+		fmt.Fprintf(w, "NOT OK")
+		return
+	}
+
+	wd.Blockchain.lock.Lock()
+	defer wd.Blockchain.lock.Unlock()
+
+	block, err := wd.Blockchain.GetBlock(height)
+	if err == ErrPrunedBlock {
+		http.Error(w, fmt.Sprintf("Block %d is pruned, blocks are kept from %d", height, wd.Blockchain.pruned), http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	fmt.Fprint(w, block.Dump())
+}
+
+func (wd *WebDaemon) TransactionHandler(w http.ResponseWriter, r *http.Request) {
+	hash, err := hex.DecodeString(mux.Vars(r)["hash"])
+	if err != nil {
+		fmt.Fprintf(w, "NOT OK")
+		return
+	}
+
+	wd.Blockchain.lock.Lock()
+	defer wd.Blockchain.lock.Unlock()
+
+	txn, block, err := wd.Blockchain.FindTransaction(hash)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	fmt.Fprintf(w, "%d %x\n%s", block.index, block.hash, txn)
+}
+
+// One line per payment or spend: height, transaction, output or input id,
+// amount.
+func (wd *WebDaemon) AddressHandler(w http.ResponseWriter, r *http.Request) {
+	wd.Blockchain.lock.Lock()
+	defer wd.Blockchain.lock.Unlock()
+
+	entries, err := wd.Blockchain.GetAddressHistory(mux.Vars(r)["addr"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	for _, entry := range entries {
+		fmt.Fprintln(w, entry)
+	}
+}
+
+// One line per wallet transaction, oldest first: height, confirmations,
+// transaction, direction, amount, fee, counterparties, label.
+func (wd *WebDaemon) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	wd.Blockchain.lock.Lock()
+	defer wd.Blockchain.lock.Unlock()
+
+	for _, entry := range wd.Blockchain.GetLedger(wd.Wallet) {
+		fmt.Fprintln(w, entry)
+	}
+}
+
+func (wd *WebDaemon) LabelHandler(w http.ResponseWriter, r *http.Request) {
+	// Label a transaction or an address, saved in wallet
+	// Input
+	// - A transaction hash (txn) or an address
+	// - A label, empty to remove it.
+
+	r.ParseForm()
+
+	var err error
+
+	label := r.PostForm.Get("label")
+	if txn := r.PostForm.Get("txn"); txn != "" {
+		var txhash []byte
+
+		txhash, err = hex.DecodeString(txn)
+		if err == nil {
+			err = wd.Wallet.SetTransactionLabel(txhash, label)
+		}
+	} else if address := r.PostForm.Get("address"); address != "" {
+		err = wd.Wallet.SetAddressLabel(address, label)
+	} else {
+		fmt.Fprintf(w, "NOT OK")
+		return
+	}
+
+	if err == nil {
+		err = wd.Wallet.WriteWallet(wd.Config)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "NOT OK %s", err)
+		return
+	}
+
+	fmt.Fprintf(w, "OK")
+}
+
+func (wd *WebDaemon) SignMessageHandler(w http.ResponseWriter, r *http.Request) {
+	// Sign a message with a wallet key
+	// Input
+	// - An address of the wallet
+	// - A message.
+	// Signature (base64) is returned after OK.
+
+	r.ParseForm()
+
+	signature, err := wd.Wallet.SignAddressMessage(r.PostForm.Get("address"), r.PostForm.Get("message"))
+	if err != nil {
+		fmt.Fprintf(w, "NOT OK %s", err)
+		return
+	}
+
+	fmt.Fprintf(w, "OK\n%s\n", signature)
+}
+
+func (wd *WebDaemon) VerifyMessageHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify a signed message
+	// Input
+	// - An address
+	// - A message
+	// - A signature (base64).
+
+	r.ParseForm()
+
+	err := VerifyAddressMessage(r.PostForm.Get("address"), r.PostForm.Get("message"), r.PostForm.Get("signature"), wd.Blockchain.params)
+	if err != nil {
+		fmt.Fprintf(w, "NOT OK %s", err)
+		return
+	}
+
 	fmt.Fprintf(w, "OK")
 }
 
-func WebRun(config Config, wallet Wallet, chain *Blockchain) error {
+// Mine and save a block under chain lock. A block which could not be
+// stored is disconnected, so served chain and indexes match the store.
+func (wd *WebDaemon) mineBlock() error {
+	wd.Blockchain.lock.Lock()
+	defer wd.Blockchain.lock.Unlock()
+
+	err := wd.Blockchain.MineBlock(wd.Config.key)
+	if err != nil {
+		return err
+	}
+
+	err = wd.Blockchain.SaveBlockchain(wd.Config)
+	if err != nil && (wd.Blockchain.store == nil || wd.Blockchain.store.BlockCount() < uint64(len(wd.Blockchain.blocks))) {
+		if wd.Blockchain.DisconnectBlock() != nil {
+			return err
+		}
+
+		return errors.New(fmt.Sprintf("%s, block disconnected", err))
+	}
+
+	return err
+}
+
+func WebRun(config Config, wallet *Wallet, chain *Blockchain) error {
 	daemon := new(WebDaemon)
 	daemon.Blockchain = chain
 	daemon.Config = config
 	daemon.Wallet = wallet
 	daemon.Mine = make(chan bool)
 	daemon.Txn = make(chan *TxnOrder)
+	daemon.Data = make(chan []byte)
+	daemon.Snapshot = make(chan error)
+
+	// Check imported snapshot while new blocks are handled, against a copy
+	// of headers taken before mining starts
+	pending, commitment, err := chain.PendingSnapshot()
+	if err != nil {
+		return err
+	}
+
+	if pending > 0 && config.SnapshotHistory != "" {
+		headers := append([]*Block{}, chain.blocks...)
+
+		go func(wd *WebDaemon) {
+			history, err := OpenChainStore(Config{Blockchain: config.SnapshotHistory, Store: DetectStore(config.SnapshotHistory)})
+			if err == nil {
+				err = checkSnapshotHistory(history, chain.params, headers, pending, commitment)
+				history.Close()
+			}
 
-	// Start mining routine
+			wd.Snapshot <- err
+		}(daemon)
+	}
+
+	// Start mining routine, which also records snapshot check, as it is
+	// the one writing to store
 	go func(wd *WebDaemon) {
 		for {
 			fmt.Println("Waiting for new request.")
-			<-wd.Mine
-			fmt.Println("got mining request...")
 
-			wd.Blockchain.MineBlock(config.key)
+			select {
+			case err := <-wd.Snapshot:
+				if err == nil {
+					wd.Blockchain.lock.Lock()
+					err = wd.Blockchain.store.PutMeta("snapshot-verified", []byte{1})
+					wd.Blockchain.lock.Unlock()
+				}
 
-			err := wd.Blockchain.SaveBlockchain(config)
-			if err != nil {
-				fmt.Println(err)
+				// State built on it can't be trusted
+				if err != nil {
+					fmt.Printf("Snapshot check failed, stopping: %s\n", err)
+					os.Exit(1)
+				}
+
+				fmt.Println("Snapshot checked.")
+
+			case <-wd.Mine:
+				fmt.Println("got mining request...")
+
+				err := wd.mineBlock()
+				if err != nil {
+					fmt.Println(err)
+				}
 			}
 		}
 	}(daemon)
 
-	// Start transaction creator
+	// Start transaction creator. Funds are chosen under chain lock, so
+	// orders don't spend the same ones.
 	go func(wd *WebDaemon) {
 		for {
 			txnOrder := <-wd.Txn
 
+			wd.Blockchain.lock.Lock()
 			txn, err := wd.Blockchain.CreateTransfertTransaction(wd.Wallet, txnOrder)
+			if err == nil {
+				err = wd.Blockchain.QueueTransaction(txn)
+			}
+			wd.Blockchain.lock.Unlock()
+
+			if err != nil {
+				fmt.Println(err)
+			}
+
+			if txnOrder.result != nil {
+				txnOrder.result <- err
+			}
+		}
+	}(daemon)
+
+	// Start timestamp transaction creator
+	go func(wd *WebDaemon) {
+		for {
+			hash := <-wd.Data
+
+			wd.Blockchain.lock.Lock()
+			txn, err := wd.Blockchain.CreateTimestampTransaction(wd.Wallet, hash)
+			if err == nil {
+				err = wd.Blockchain.QueueTransaction(txn)
+			}
+			wd.Blockchain.lock.Unlock()
+
 			if err != nil {
 				fmt.Println(err)
-				continue
 			}
-			wd.Blockchain.QueueTransaction(txn)
 		}
 	}(daemon)
 
 	router := mux.NewRouter().StrictSlash(true)
 	router.HandleFunc("/mine", daemon.MineHandler)
 	router.HandleFunc("/txn/add", daemon.AddTransactionHandler)
+	router.HandleFunc("/txn/select", daemon.SelectCoinsHandler).Methods("POST")
+	router.HandleFunc("/timestamp", daemon.TimestampHandler).Methods("POST")
+	router.HandleFunc("/timestamp/{hash}", daemon.VerifyTimestampHandler)
+	router.HandleFunc("/block/{height}", daemon.BlockHandler).Methods("GET")
+	router.HandleFunc("/txn/{hash}", daemon.TransactionHandler).Methods("GET")
+	router.HandleFunc("/address/{addr}", daemon.AddressHandler).Methods("GET")
+	router.HandleFunc("/history", daemon.HistoryHandler).Methods("GET")
+	router.HandleFunc("/label", daemon.LabelHandler).Methods("POST")
+	router.HandleFunc("/message/sign", daemon.SignMessageHandler).Methods("POST")
+	router.HandleFunc("/message/verify", daemon.VerifyMessageHandler).Methods("POST")
 
-	err := http.ListenAndServe(config.WebListenAddr, router)
+	err = http.ListenAndServe(config.WebListenAddr, router)
 
 	return err
 }
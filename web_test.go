@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Lookups run while blocks are mined, meant for -race.
+func TestWebLookupsWhileMining(t *testing.T) {
+	w1 := CreateTestingWallet()
+	w2 := CreateTestingWallet()
+
+	bc := CreateBlockchain()
+	bc.index = CreateChainIndex()
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+	TransferFund(bc, w1, w2, 40)
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	data, _ := HashDocument(strings.NewReader("Hello World"))
+	txn, err := bc.CreateTimestampTransaction(w1, data)
+	if err == nil {
+		err = bc.QueueTransaction(txn)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.MineBlock(w1.PrivateKeys[0].PublicKey)
+
+	wd := new(WebDaemon)
+	wd.Blockchain = bc
+	wd.Wallet = w1
+	wd.Config = Config{Blockchain: t.TempDir(), Store: STORE_MEMORY, TxIndex: true}
+	wd.Config.key = w1.PrivateKeys[0].PublicKey
+
+	transfer := hex.EncodeToString(bc.blocks[1].txns[1].hash)
+	addr := GetPublicKeyHash(w2.PrivateKeys[0].PublicKey)
+	timestamp := hex.EncodeToString(data)
+
+	// Each lookup runs in its own routine, so unlocked reads overlap mining
+	lookups := []func() (string, bool){
+		func() (string, bool) {
+			w := httptest.NewRecorder()
+			r := mux.SetURLVars(httptest.NewRequest("GET", "/txn/"+transfer, nil), map[string]string{"hash": transfer})
+			wd.TransactionHandler(w, r)
+			return w.Body.String(), strings.HasPrefix(w.Body.String(), "1 ")
+		},
+		func() (string, bool) {
+			w := httptest.NewRecorder()
+			r := mux.SetURLVars(httptest.NewRequest("GET", "/address/"+addr, nil), map[string]string{"addr": addr})
+			wd.AddressHandler(w, r)
+			return w.Body.String(), strings.Contains(w.Body.String(), "+40")
+		},
+		func() (string, bool) {
+			w := httptest.NewRecorder()
+			wd.HistoryHandler(w, httptest.NewRequest("GET", "/history", nil))
+			return w.Body.String(), strings.Contains(w.Body.String(), " out ")
+		},
+		func() (string, bool) {
+			w := httptest.NewRecorder()
+			r := mux.SetURLVars(httptest.NewRequest("GET", "/timestamp/"+timestamp, nil), map[string]string{"hash": timestamp})
+			wd.VerifyTimestampHandler(w, r)
+			return w.Body.String(), strings.HasPrefix(w.Body.String(), hex.EncodeToString(txn.hash)+" 2 ")
+		},
+		func() (string, bool) {
+			w := httptest.NewRecorder()
+			r := mux.SetURLVars(httptest.NewRequest("GET", "/block/1", nil), map[string]string{"height": "1"})
+			wd.BlockHandler(w, r)
+			return w.Body.String(), strings.Contains(w.Body.String(), "Txn count:\t2")
+		},
+	}
+
+	stop := make(chan bool)
+	var started, wg sync.WaitGroup
+	for _, lookup := range lookups {
+		started.Add(1)
+		wg.Add(1)
+		go func(lookup func() (string, bool)) {
+			defer wg.Done()
+			for first := true; ; first = false {
+				body, ok := lookup()
+				if first {
+					started.Done()
+				}
+				if !ok {
+					t.Errorf("Invalid lookup: %s", body)
+					return
+				}
+
+				select {
+				case <-stop:
+					return
+				default:
+				}
+			}
+		}(lookup)
+	}
+	started.Wait()
+
+	for i := 0; i < 50; i++ {
+		err = wd.mineBlock()
+		if err != nil {
+			break
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}